@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Address modes define which resource provides a stable IP address of a
+// NodeID.
+const (
+	// addressModeNetworkInterface attaches a dedicated network interface.
+	addressModeNetworkInterface = "network-interface"
+	// addressModeSecondaryIP assigns a secondary private IP address to the
+	// primary network interface of the instance.
+	addressModeSecondaryIP = "secondary-ip"
+	// addressModeElasticIP associates an Elastic IP address with the primary
+	// network interface of the instance.
+	addressModeElasticIP = "elastic-ip"
+)
+
+// validAddressMode reports whether m is a known address mode.
+func validAddressMode(m string) bool {
+	switch m {
+	case addressModeNetworkInterface, addressModeSecondaryIP, addressModeElasticIP:
+		return true
+	}
+	return false
+}
+
+// findAddresses finds stable addresses of volumes vs. In secondary-ip and
+// elastic-ip modes, a volume tag holds the private IP address or the Elastic
+// IP allocation ID of its NodeID. Addresses are returned as network interfaces,
+// so that they are paired with volumes the same way network interfaces are.
+// An address is available unless it is held by an instance, which also holds
+// the volume with the same NodeID.
+func findAddresses(i *instance, ec2c ec2Client, vs []volume) ([]networkInterface, error) {
+	volumeHolders := make(map[string]string)
+	var values []string
+	for _, v := range vs {
+		if v.tags[opts.addressTag] == "" {
+			continue
+		}
+		volumeHolders[v.nodeID] = v.attachedTo
+		values = append(values, v.tags[opts.addressTag])
+	}
+	var ns []networkInterface
+	if len(values) == 0 {
+		return ns, nil
+	}
+
+	var holders map[string]address
+	var err error
+	switch opts.addressMode {
+	case addressModeSecondaryIP:
+		holders, err = findPrivateIPHolders(i, values, ec2c)
+	case addressModeElasticIP:
+		holders, err = findElasticIPHolders(values, ec2c)
+	}
+	if err != nil {
+		logger.Error("Failed to find addresses", "error", err)
+		return ns, err
+	}
+
+	cidrs, err := getSubnetCIDRs([]string{i.subnetID}, ec2c)
+	if err != nil {
+		logger.Error("Failed to find the subnet of the instance", "error", err)
+	}
+	for _, v := range vs {
+		value := v.tags[opts.addressTag]
+		if value == "" {
+			continue
+		}
+		h := holders[value]
+		// Addresses are identified by the tag value, as they all share the
+		// primary network interface of whichever instance holds them.
+		n := networkInterface{
+			id:            value,
+			nodeID:        v.nodeID,
+			attachedTo:    h.instanceID,
+			IPAddress:     value,
+			subnetID:      i.subnetID,
+			subnetCIDR:    cidrs[i.subnetID],
+			tags:          v.tags,
+			associationID: h.associationID,
+		}
+		if opts.addressMode == addressModeElasticIP {
+			if h.allocationID == "" {
+				continue
+			}
+			n.IPAddress = h.publicIP
+			n.allocationID = h.allocationID
+		}
+		n.available = h.instanceID == "" || (h.instanceID != i.id && h.instanceID != volumeHolders[v.nodeID])
+		ns = append(ns, n)
+	}
+	return ns, nil
+}
+
+// address describes which instance holds a private or an Elastic IP address.
+type address struct {
+	instanceID    string
+	publicIP      string
+	allocationID  string
+	associationID string
+}
+
+// findPrivateIPHolders returns a map of private IP addresses ips to instances
+// holding them.
+func findPrivateIPHolders(i *instance, ips []string, ec2c ec2Client) (map[string]address, error) {
+	holders := make(map[string]address)
+	r, err := ec2c.DescribeNetworkInterfaces(&ec2.DescribeNetworkInterfacesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("vpc-id"),
+				Values: []*string{aws.String(i.vpc)},
+			},
+			{
+				Name:   aws.String("addresses.private-ip-address"),
+				Values: aws.StringSlice(ips),
+			},
+		},
+	})
+	if err != nil {
+		return holders, err
+	}
+	for _, n := range r.NetworkInterfaces {
+		if n.Attachment == nil || n.Attachment.InstanceId == nil {
+			continue
+		}
+		for _, a := range n.PrivateIpAddresses {
+			if !aws.BoolValue(a.Primary) {
+				holders[*a.PrivateIpAddress] = address{instanceID: *n.Attachment.InstanceId}
+			}
+		}
+	}
+	return holders, nil
+}
+
+// findElasticIPHolders returns a map of Elastic IP allocation IDs ids to
+// instances holding them. Unknown allocation IDs are logged and skipped.
+func findElasticIPHolders(ids []string, ec2c ec2Client) (map[string]address, error) {
+	holders := make(map[string]address)
+	r, err := ec2c.DescribeAddresses(&ec2.DescribeAddressesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("allocation-id"),
+				Values: aws.StringSlice(ids),
+			},
+		},
+	})
+	if err != nil {
+		return holders, err
+	}
+	for _, a := range r.Addresses {
+		holders[*a.AllocationId] = address{
+			instanceID:    aws.StringValue(a.InstanceId),
+			publicIP:      aws.StringValue(a.PublicIp),
+			allocationID:  aws.StringValue(a.AllocationId),
+			associationID: aws.StringValue(a.AssociationId),
+		}
+	}
+	for _, id := range ids {
+		if _, ok := holders[id]; !ok {
+			logger.Info("Elastic IP address does not exist", "allocation_id", id)
+		}
+	}
+	return holders, nil
+}
+
+// assignAddress assigns an address n to the primary network interface of an
+// instance i. Secondary private IP addresses are reassigned and Elastic IP
+// addresses reassociated if held by another instance.
+func (i *instance) assignAddress(n networkInterface, ec2c ec2Client) error {
+	var err error
+	switch opts.addressMode {
+	case addressModeSecondaryIP:
+		logger.Info("Assigning private IP address", "ip", n.IPAddress, "eni_id", i.primaryNetworkInterface)
+		_, err = ec2c.AssignPrivateIpAddresses(&ec2.AssignPrivateIpAddressesInput{
+			NetworkInterfaceId: aws.String(i.primaryNetworkInterface),
+			PrivateIpAddresses: []*string{aws.String(n.IPAddress)},
+			AllowReassignment:  aws.Bool(true),
+		})
+	case addressModeElasticIP:
+		logger.Info("Associating Elastic IP address", "ip", n.IPAddress, "eni_id", i.primaryNetworkInterface)
+		var r *ec2.AssociateAddressOutput
+		r, err = ec2c.AssociateAddress(&ec2.AssociateAddressInput{
+			AllocationId:       aws.String(n.allocationID),
+			NetworkInterfaceId: aws.String(i.primaryNetworkInterface),
+			AllowReassociation: aws.Bool(true),
+		})
+		if err == nil {
+			n.associationID = aws.StringValue(r.AssociationId)
+		}
+	}
+	if err != nil {
+		logger.Error("Failed to assign address", "ip", n.IPAddress, "error", err)
+		attachFailures++
+		return err
+	}
+	n.available = false
+	n.attachedTo = i.id
+	i.networkInterface = &n
+	return nil
+}
+
+// unassignAddress unassigns the address of an instance i.
+func (i *instance) unassignAddress() error {
+	var err error
+	switch opts.addressMode {
+	case addressModeSecondaryIP:
+		logger.Info("Unassigning private IP address", "ip", i.networkInterface.IPAddress)
+		removeLocalAddress(i.networkInterface.IPAddress, i)
+		_, err = ec2c.UnassignPrivateIpAddresses(&ec2.UnassignPrivateIpAddressesInput{
+			NetworkInterfaceId: aws.String(i.primaryNetworkInterface),
+			PrivateIpAddresses: []*string{aws.String(i.networkInterface.IPAddress)},
+		})
+	case addressModeElasticIP:
+		logger.Info("Disassociating Elastic IP address", "ip", i.networkInterface.IPAddress)
+		_, err = ec2c.DisassociateAddress(&ec2.DisassociateAddressInput{
+			AssociationId: aws.String(i.networkInterface.associationID),
+		})
+	}
+	if err != nil {
+		logger.Error("Failed to unassign address", "ip", i.networkInterface.IPAddress, "error", err)
+		return err
+	}
+	i.networkInterface = nil
+	return nil
+}
+
+// setupLocalAddress adds a secondary private IP address ip to the primary
+// network interface of an instance i, unless it is already configured. Elastic
+// IP addresses are translated by AWS and need no local configuration.
+func setupLocalAddress(ip string, i *instance) error {
+	if opts.addressMode != addressModeSecondaryIP {
+		return nil
+	}
+	if iface, err := getIfaceNameByIP(ip); err == nil && iface != "" {
+		return nil
+	}
+	logger.Info("Adding address to the primary network interface", "ip", ip)
+	err := changeLocalAddress(ip, i, (*netlinkHandle).addrReplace)
+	if err != nil {
+		logger.Error("Failed to add address", "ip", ip, "error", err)
+	}
+	return err
+}
+
+// removeLocalAddress removes a secondary private IP address ip from the
+// primary network interface of an instance i.
+func removeLocalAddress(ip string, i *instance) error {
+	err := changeLocalAddress(ip, i, (*netlinkHandle).addrDel)
+	if err != nil {
+		logger.Error("Failed to remove address", "ip", ip, "error", err)
+	}
+	return err
+}
+
+// changeLocalAddress adds or removes, depending on change, an address ip on
+// the primary network interface of an instance i.
+func changeLocalAddress(ip string, i *instance, change func(*netlinkHandle, int, net.IP, int) error) error {
+	iface, prefix, err := primaryIfaceAndPrefix(i)
+	if err != nil {
+		return err
+	}
+	link, err := net.InterfaceByName(iface)
+	if err != nil {
+		return err
+	}
+	h, err := newNetlinkHandle()
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+	return change(h, link.Index, net.ParseIP(ip), prefix)
+}
+
+// primaryIfaceAndPrefix returns the name of the primary network interface of
+// an instance i and the prefix length of its subnet.
+func primaryIfaceAndPrefix(i *instance) (string, int, error) {
+	iface, err := getIfaceNameByIP(i.primaryIP)
+	if err != nil {
+		return "", 0, err
+	}
+	if iface == "" {
+		return "", 0, fmt.Errorf("no interface with address %q", i.primaryIP)
+	}
+	cidrs, err := getSubnetCIDRs([]string{i.subnetID}, ec2c)
+	if err != nil {
+		return "", 0, err
+	}
+	_, subnet, err := net.ParseCIDR(cidrs[i.subnetID])
+	if err != nil {
+		return "", 0, err
+	}
+	prefix, _ := subnet.Mask.Size()
+	return iface, prefix, nil
+}
@@ -2,64 +2,149 @@ package main
 
 import (
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/ec2metadata"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
-	"log"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 	"strings"
 )
 
+// ec2Client is the EC2 API used by smilodon, which tests replace with a fake.
+// The interface of the SDK does not cover waiters yet.
+type ec2Client interface {
+	ec2iface.EC2API
+	WaitUntilNetworkInterfaceAvailable(*ec2.DescribeNetworkInterfacesInput) error
+	WaitUntilSnapshotCompleted(*ec2.DescribeSnapshotsInput) error
+	WaitUntilVolumeAvailable(*ec2.DescribeVolumesInput) error
+	WaitUntilVolumeInUse(*ec2.DescribeVolumesInput) error
+}
+
 type instance struct {
-	id               string
-	nodeID           string
-	vpc              string
-	az               string
-	region           string
-	volume           *volume
-	networkInterface *networkInterface
+	id                      string
+	nodeID                  string
+	nodeIP                  string
+	vpc                     string
+	az                      string
+	asg                     string
+	region                  string
+	subnetID                string
+	primaryIP               string
+	primaryNetworkInterface string
+	volume                  *volume
+	networkInterface        *networkInterface
+}
+
+// networkInterfaceID returns the ID of the network interface, which holds the
+// stable IP address of the instance.
+func (i instance) networkInterfaceID() string {
+	if opts.addressMode != addressModeNetworkInterface {
+		return i.primaryNetworkInterface
+	}
+	return i.networkInterface.id
 }
 
+// getMetadata gets the instance ID, region and AZ with identify, and other
+// instance properties from the EC2 API.
 func (i *instance) getMetadata() error {
-	// Get instance id
-	metadata := ec2metadata.New(session.New())
-	id, err := metadata.GetMetadata("instance-id")
-	if err != nil {
-		log.Printf("Failed to get instance ID from the metadata service: %q.\n", err)
+	if err := i.identify(); err != nil {
 		return err
 	}
-	i.id = id
 
-	// Get instance region
-	region, err := metadata.Region()
+	assumeRole(awsSession, i.id, i.region)
+	ec2c = ec2.New(awsSession, awsConfig("ec2", i.region))
+	// Get VpcId
+	params := &ec2.DescribeInstancesInput{
+		InstanceIds: []*string{aws.String(i.id)},
+	}
+	instances, err := ec2c.DescribeInstances(params)
 	if err != nil {
-		log.Printf("Failed to get instance region from the metadata service: %q.\n", err)
+		logger.Error("Failed to get instance VPC ID", "error", err)
 		return err
 	}
-	i.region = region
+	inst := instances.Reservations[0].Instances[0]
+	i.vpc = *inst.VpcId
+	i.subnetID = aws.StringValue(inst.SubnetId)
+	i.primaryIP = aws.StringValue(inst.PrivateIpAddress)
+	i.asg = tagsToMap(inst.Tags)["aws:autoscaling:groupName"]
+	for _, n := range inst.NetworkInterfaces {
+		if n.Attachment != nil && aws.Int64Value(n.Attachment.DeviceIndex) == 0 {
+			i.primaryNetworkInterface = *n.NetworkInterfaceId
+		}
+	}
+	return nil
+}
+
+// identify gets the instance ID, region and AZ from --instance-id, --region
+// and --availability-zone, or from the metadata service if they are not set.
+func (i *instance) identify() error {
+	i.id, i.region, i.az = opts.instanceID, opts.region, opts.az
+	var err error
+
+	// Get instance id
+	if i.id == "" {
+		if i.id, err = metadata.getMetadata("instance-id"); err != nil {
+			logger.Error("Failed to get instance ID from the metadata service", "error", err)
+			return err
+		}
+	}
+
+	// Get instance region
+	if i.region == "" {
+		if i.region, err = metadata.region(); err != nil {
+			logger.Error("Failed to get instance region from the metadata service", "error", err)
+			return err
+		}
+	}
 
 	// Get AZ
-	az, err := metadata.GetMetadata("placement/availability-zone")
+	if i.az == "" {
+		if i.az, err = metadata.getMetadata("placement/availability-zone"); err != nil {
+			logger.Error("Failed to get instance AZ from the metadata service", "error", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// getSubnetCIDRFromMetadata returns the IPv4 CIDR block of the subnet of a
+// network interface with MAC address mac attached to this instance.
+func getSubnetCIDRFromMetadata(mac string) string {
+	cidr, err := metadata.getMetadata("network/interfaces/macs/" + mac + "/subnet-ipv4-cidr-block")
 	if err != nil {
-		log.Printf("Failed to get instance AZ from the metadata service: %q.\n.", err)
-		return err
+		logger.Error("Failed to get subnet CIDR from the metadata service", "mac", mac, "error", err)
+		return ""
 	}
-	i.az = az
+	return cidr
+}
 
-	ec2c := ec2.New(session.New(), aws.NewConfig().WithRegion(i.region))
-	// Get VpcId
-	params := &ec2.DescribeInstancesInput{
-		InstanceIds: []*string{aws.String(id)},
+// getIPv6AddressesFromMetadata returns IPv6 addresses of a network interface
+// with MAC address mac attached to this instance. The EC2 API version in use
+// predates IPv6, so addresses are read from the metadata service instead.
+func getIPv6AddressesFromMetadata(mac string) []string {
+	if mac == "" {
+		return nil
 	}
-	instances, err := ec2c.DescribeInstances(params)
+	// The metadata service returns an error, if there are no IPv6 addresses.
+	ips, err := metadata.getMetadata("network/interfaces/macs/" + mac + "/ipv6s")
 	if err != nil {
-		log.Printf("Failed to get instance VPC ID: %q.\n", err)
-		return err
+		return nil
 	}
-	i.vpc = *instances.Reservations[0].Instances[0].VpcId
-	return nil
+	return strings.Fields(ips)
 }
 
-func getResourceTagValue(id, tag string, ec2c *ec2.EC2) string {
+// getIPv6SubnetCIDRFromMetadata returns the IPv6 CIDR block of the subnet of a
+// network interface with MAC address mac attached to this instance.
+func getIPv6SubnetCIDRFromMetadata(mac string) string {
+	cidrs, err := metadata.getMetadata("network/interfaces/macs/" + mac + "/subnet-ipv6-cidr-blocks")
+	if err != nil {
+		logger.Error("Failed to get IPv6 subnet CIDR from the metadata service", "mac", mac, "error", err)
+		return ""
+	}
+	if f := strings.Fields(cidrs); len(f) > 0 {
+		return f[0]
+	}
+	return ""
+}
+
+func getResourceTagValue(id, tag string, ec2c ec2Client) string {
 	params := &ec2.DescribeTagsInput{
 		Filters: []*ec2.Filter{
 			{
@@ -78,7 +163,7 @@ func getResourceTagValue(id, tag string, ec2c *ec2.EC2) string {
 	}
 	resp, err := ec2c.DescribeTags(params)
 	if err != nil {
-		log.Printf("Cannot get tag %q of %q resource: %q.\n", tag, id, err)
+		logger.Warn("Cannot get resource tag", "tag", tag, "resource_id", id, "error", err)
 		return ""
 	}
 	if len(resp.Tags) > 0 {
@@ -86,10 +171,52 @@ func getResourceTagValue(id, tag string, ec2c *ec2.EC2) string {
 			return *t.Value
 		}
 	}
-	log.Printf("Cannot get tag %q of %q resource.\n", tag, id)
+	logger.Warn("Cannot get resource tag", "tag", tag, "resource_id", id)
 	return ""
 }
 
+// tagsToMap converts a list of EC2 tags to a map of tag keys to tag values.
+func tagsToMap(tags []*ec2.Tag) map[string]string {
+	m := make(map[string]string, len(tags))
+	for _, t := range tags {
+		if t.Key != nil && t.Value != nil {
+			m[*t.Key] = *t.Value
+		}
+	}
+	return m
+}
+
+// getSubnetCIDRs returns a map of subnet IDs to their IPv4 CIDR blocks.
+func getSubnetCIDRs(ids []string, ec2c ec2Client) (map[string]string, error) {
+	cidrs := make(map[string]string)
+	if len(ids) == 0 {
+		return cidrs, nil
+	}
+	r, err := ec2c.DescribeSubnets(&ec2.DescribeSubnetsInput{
+		SubnetIds: aws.StringSlice(uniqueStrings(ids)),
+	})
+	if err != nil {
+		return cidrs, err
+	}
+	for _, s := range r.Subnets {
+		cidrs[*s.SubnetId] = *s.CidrBlock
+	}
+	return cidrs, nil
+}
+
+// uniqueStrings returns a copy of s with duplicate values removed.
+func uniqueStrings(s []string) []string {
+	var u []string
+	seen := make(map[string]bool)
+	for _, v := range s {
+		if !seen[v] {
+			seen[v] = true
+			u = append(u, v)
+		}
+	}
+	return u
+}
+
 // buildFilters builds a list of filters of type []*ec2.Filter. It parses
 // optional filters via cli arguments.
 func buildFilters(i instance) []*ec2.Filter {
@@ -127,6 +254,45 @@ func buildFilters(i instance) []*ec2.Filter {
 	return filters
 }
 
+// peerFilters returns the tag filters of buildFilters, which select the
+// resources of all NodeIDs regardless of their availability zone.
+func peerFilters(i instance) []*ec2.Filter {
+	var fs []*ec2.Filter
+	for _, f := range buildFilters(i) {
+		if name := aws.StringValue(f.Name); name == "tag-key" || strings.HasPrefix(name, "tag:") {
+			fs = append(fs, f)
+		}
+	}
+	return fs
+}
+
+// findPeers finds the stable addresses of all paired NodeIDs in the VPC of
+// instance i, in every availability zone, so that all instances see the same
+// peers. An address is paired while it is held by an instance.
+func findPeers(i *instance, ec2c ec2Client) ([]networkInterface, error) {
+	f := peerFilters(*i)
+	var ns []networkInterface
+	var err error
+	if opts.addressMode == addressModeNetworkInterface {
+		ns, err = findNetworkInterfaces(i, ec2c, f)
+	} else {
+		var vs []volume
+		if vs, err = findVolumes(i, ec2c, f); err == nil {
+			ns, err = findAddresses(i, ec2c, vs)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	var peers []networkInterface
+	for _, n := range ns {
+		if n.nodeID != "" && !n.available {
+			peers = append(peers, n)
+		}
+	}
+	return peers, nil
+}
+
 type networkInterface struct {
 	id           string
 	available    bool
@@ -134,9 +300,18 @@ type networkInterface struct {
 	nodeID       string
 	attachmentID string
 	IPAddress    string
+	subnetID     string
+	subnetCIDR   string
+	mac          string
+	// ipv6Addresses are only known once attached to this instance.
+	ipv6Addresses []string
+	tags          map[string]string
+	// allocationID and associationID are only set for Elastic IP addresses.
+	allocationID  string
+	associationID string
 }
 
-func findNetworkInterfaces(i *instance, ec2c *ec2.EC2, f []*ec2.Filter) ([]networkInterface, error) {
+func findNetworkInterfaces(i *instance, ec2c ec2Client, f []*ec2.Filter) ([]networkInterface, error) {
 	vpcFilter := &ec2.Filter{
 		Name: aws.String("vpc-id"),
 		Values: []*string{
@@ -149,14 +324,26 @@ func findNetworkInterfaces(i *instance, ec2c *ec2.EC2, f []*ec2.Filter) ([]netwo
 	r, err := ec2c.DescribeNetworkInterfaces(params)
 	var ns []networkInterface
 	if err != nil {
-		log.Printf("Failed to find network interfaces: %q.\n", err)
+		logger.Error("Failed to find network interfaces", "error", err)
 		return ns, err
 	}
+	var subnetIDs []string
+	for _, i := range r.NetworkInterfaces {
+		subnetIDs = append(subnetIDs, *i.SubnetId)
+	}
+	cidrs, err := getSubnetCIDRs(subnetIDs, ec2c)
+	if err != nil {
+		logger.Error("Failed to find subnets of network interfaces", "error", err)
+	}
 	for _, i := range r.NetworkInterfaces {
 		var n networkInterface
 		n.id = *i.NetworkInterfaceId
-		n.nodeID = getResourceTagValue(*i.NetworkInterfaceId, "NodeID", ec2c)
+		n.tags = tagsToMap(i.TagSet)
+		n.nodeID = n.tags["NodeID"]
 		n.IPAddress = *i.PrivateIpAddress
+		n.subnetID = *i.SubnetId
+		n.subnetCIDR = cidrs[n.subnetID]
+		n.mac = aws.StringValue(i.MacAddress)
 		if i.Attachment != nil {
 			n.attachmentID = *i.Attachment.AttachmentId
 		}
@@ -176,22 +363,24 @@ type volume struct {
 	available  bool
 	nodeID     string
 	attachedTo string
+	tags       map[string]string
 }
 
-func findVolumes(i *instance, ec2c *ec2.EC2, f []*ec2.Filter) ([]volume, error) {
+func findVolumes(i *instance, ec2c ec2Client, f []*ec2.Filter) ([]volume, error) {
 	params := &ec2.DescribeVolumesInput{
 		Filters: f,
 	}
 	r, err := ec2c.DescribeVolumes(params)
 	var vs []volume
 	if err != nil {
-		log.Printf("Failed to find volumes: %q.\n", err)
+		logger.Error("Failed to find volumes", "error", err)
 		return vs, err
 	}
 	for _, i := range r.Volumes {
 		var v volume
 		v.id = *i.VolumeId
-		v.nodeID = getResourceTagValue(*i.VolumeId, "NodeID", ec2c)
+		v.tags = tagsToMap(i.Tags)
+		v.nodeID = v.tags["NodeID"]
 		if *i.State == ec2.VolumeStateAvailable {
 			v.available = true
 		} else {
@@ -206,35 +395,45 @@ func findVolumes(i *instance, ec2c *ec2.EC2, f []*ec2.Filter) ([]volume, error)
 }
 
 // attachVolume attaches a volume v to an instance i.
-func (i *instance) attachVolume(v volume, ec2c *ec2.EC2) error {
+func (i *instance) attachVolume(v volume, ec2c ec2Client) error {
 	params := &ec2.AttachVolumeInput{
 		Device:     aws.String(opts.blockDevice),
 		InstanceId: aws.String(i.id),
 		VolumeId:   aws.String(v.id),
 	}
-	log.Printf("Attaching volume: %q.\n", v.id)
+	logger.Info("Attaching volume", "volume_id", v.id)
 	// FIXME: wait for the attachment to happen?
 	_, err := ec2c.AttachVolume(params)
 	if err != nil {
-		log.Printf("Failed to attach volume %q: %q.\n", v.id, err)
+		logger.Error("Failed to attach volume", "volume_id", v.id, "error", err)
+		attachFailures++
 		return err
 	}
+	if opts.strategy == "least-recently-used" || opts.crossAZFailover {
+		tagVolumeTimestamp(v.id, tagAttachedAt, ec2c)
+	}
+	// The attachment guards the volume from now on, so a claim made to take
+	// it over is no longer needed.
+	if holder, _, ok := parseClaim(v.tags[tagClaim]); ok && holder == i.id {
+		releaseClaim(v.id)
+	}
 	i.volume = &v
 	return nil
 }
 
 // attachNetworkInterface attaches a network interface n to an instance i.
-func (i *instance) attachNetworkInterface(n networkInterface, ec2c *ec2.EC2) error {
+func (i *instance) attachNetworkInterface(n networkInterface, ec2c ec2Client) error {
 	params := &ec2.AttachNetworkInterfaceInput{
 		InstanceId:         aws.String(i.id),
 		NetworkInterfaceId: aws.String(n.id),
 		DeviceIndex:        aws.Int64(1),
 	}
-	log.Printf("Attaching network interface: %q.\n", n.id)
+	logger.Info("Attaching network interface", "eni_id", n.id)
 	// FIXME: wait for the attachment to happen?
 	_, err := ec2c.AttachNetworkInterface(params)
 	if err != nil {
-		log.Printf("Failed to attach network interface %q: %q.\n", n.id, err)
+		logger.Error("Failed to attach network interface", "eni_id", n.id, "error", err)
+		attachFailures++
 		return err
 	}
 	i.networkInterface = &n
@@ -243,12 +442,12 @@ func (i *instance) attachNetworkInterface(n networkInterface, ec2c *ec2.EC2) err
 
 // dettachNetworkInterface detaches a network interface n.
 func (i *instance) dettachNetworkInterface() error {
-	log.Printf("Detaching network interface: %q.\n", i.networkInterface.id)
+	logger.Info("Detaching network interface", "eni_id", i.networkInterface.id)
 	_, err := ec2c.DetachNetworkInterface(&ec2.DetachNetworkInterfaceInput{
 		AttachmentId: &i.networkInterface.attachmentID,
 	})
 	if err != nil {
-		log.Printf("Failed to dettach network interface %q: %q.\n", i.networkInterface.id, err)
+		logger.Error("Failed to detach network interface", "eni_id", i.networkInterface.id, "error", err)
 		return err
 	}
 	i.networkInterface = nil
@@ -257,7 +456,7 @@ func (i *instance) dettachNetworkInterface() error {
 
 // disableSourceDestCheck sets SourceDestCheck attribute to false on all
 // instance network interfaces.
-func disableSourceDestCheck(instanceID string, ec2c *ec2.EC2) error {
+func disableSourceDestCheck(instanceID string, ec2c ec2Client) error {
 	i, err := ec2c.DescribeInstances(&ec2.DescribeInstancesInput{
 		InstanceIds: []*string{aws.String(instanceID)}},
 	)
@@ -269,10 +468,10 @@ func disableSourceDestCheck(instanceID string, ec2c *ec2.EC2) error {
 			NetworkInterfaceId: n.NetworkInterfaceId,
 			SourceDestCheck:    &ec2.AttributeBooleanValue{Value: aws.Bool(false)},
 		}
-		log.Printf("Disabling SourceDestCheck on %q network interface.\n", *n.NetworkInterfaceId)
+		logger.Info("Disabling SourceDestCheck", "eni_id", *n.NetworkInterfaceId)
 		ec2c.ModifyNetworkInterfaceAttribute(attr)
 		if err != nil {
-			log.Printf("Failed to disable SourceDestCheck attribute of %q network interface: %q.\n", n.NetworkInterfaceId, err)
+			logger.Error("Failed to disable SourceDestCheck", "eni_id", *n.NetworkInterfaceId, "error", err)
 		}
 	}
 	return nil
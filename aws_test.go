@@ -0,0 +1,541 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// fakeEC2 is an in-memory EC2 API. It implements the calls smilodon makes
+// and panics on any other call.
+type fakeEC2 struct {
+	ec2Client
+
+	mu        sync.Mutex
+	nextID    int
+	volumes   map[string]*fakeVolume
+	enis      map[string]*fakeENI
+	snapshots map[string]*fakeSnapshot
+	// instances maps instance IDs to their state.
+	instances map[string]string
+	// subnets maps subnet IDs to their AZ. All subnets are in VPC vpc.
+	subnets map[string]string
+	vpc     string
+	tags    map[string]map[string]string
+	// calls lists called operations with the resource they act on.
+	calls []string
+
+	// failOn, if set, is called before every operation on resource id and
+	// makes the operation fail with the error it returns.
+	failOn func(op, id string) error
+	// afterCreateTags, if set, is called after resource id has been tagged.
+	afterCreateTags func(id string, tags map[string]string)
+}
+
+type fakeVolume struct {
+	az         string
+	state      string
+	attachedTo string
+	snapshotID string
+}
+
+type fakeENI struct {
+	az, subnetID, ip, attachedTo string
+}
+
+type fakeSnapshot struct {
+	volumeID string
+	start    time.Time
+}
+
+func newFakeEC2() *fakeEC2 {
+	return &fakeEC2{
+		volumes:   make(map[string]*fakeVolume),
+		enis:      make(map[string]*fakeENI),
+		snapshots: make(map[string]*fakeSnapshot),
+		instances: make(map[string]string),
+		subnets:   make(map[string]string),
+		vpc:       "vpc-1",
+		tags:      make(map[string]map[string]string),
+	}
+}
+
+// addVolume adds a volume id in az with tags.
+func (f *fakeEC2) addVolume(id, az string, tags map[string]string) {
+	f.volumes[id] = &fakeVolume{az: az, state: ec2.VolumeStateAvailable}
+	f.tags[id] = copyTags(tags)
+}
+
+// addENI adds a network interface id in subnetID with tags.
+func (f *fakeEC2) addENI(id, subnetID, ip string, tags map[string]string) {
+	f.enis[id] = &fakeENI{az: f.subnets[subnetID], subnetID: subnetID, ip: ip}
+	f.tags[id] = copyTags(tags)
+}
+
+// attach attaches volume or network interface id to instance instanceID.
+func (f *fakeEC2) attach(id, instanceID string) {
+	if v, ok := f.volumes[id]; ok {
+		v.state, v.attachedTo = ec2.VolumeStateInUse, instanceID
+	}
+	if n, ok := f.enis[id]; ok {
+		n.attachedTo = instanceID
+	}
+}
+
+func copyTags(tags map[string]string) map[string]string {
+	c := make(map[string]string)
+	for k, v := range tags {
+		c[k] = v
+	}
+	return c
+}
+
+// count returns the number of calls of operation op.
+func (f *fakeEC2) count(op string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var n int
+	for _, c := range f.calls {
+		if strings.HasPrefix(c, op+" ") {
+			n++
+		}
+	}
+	return n
+}
+
+// call records operation op on resource id and returns an injected error.
+func (f *fakeEC2) call(op, id string) error {
+	f.calls = append(f.calls, op+" "+id)
+	if f.failOn != nil {
+		return f.failOn(op, id)
+	}
+	return nil
+}
+
+func (f *fakeEC2) newID(prefix string) string {
+	f.nextID++
+	return fmt.Sprintf("%s-%04d", prefix, f.nextID)
+}
+
+// ec2Tags returns tags of resource id as EC2 tags ordered by key.
+func (f *fakeEC2) ec2Tags(id string) []*ec2.Tag {
+	var keys []string
+	for k := range f.tags[id] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var tags []*ec2.Tag
+	for _, k := range keys {
+		tags = append(tags, &ec2.Tag{Key: aws.String(k), Value: aws.String(f.tags[id][k])})
+	}
+	return tags
+}
+
+// matches reports whether a resource in az and vpc with tags matches all
+// filters fs.
+func matches(fs []*ec2.Filter, az, vpc string, tags map[string]string) bool {
+	for _, filter := range fs {
+		values := aws.StringValueSlice(filter.Values)
+		name := aws.StringValue(filter.Name)
+		switch {
+		case name == "availability-zone":
+			if !containsString(values, az) {
+				return false
+			}
+		case name == "vpc-id":
+			if !containsString(values, vpc) {
+				return false
+			}
+		case name == "tag-key":
+			var found bool
+			for _, k := range values {
+				if _, ok := tags[k]; ok {
+					found = true
+				}
+			}
+			if !found {
+				return false
+			}
+		case strings.HasPrefix(name, "tag:"):
+			v, ok := tags[strings.TrimPrefix(name, "tag:")]
+			if !ok || !containsString(values, v) {
+				return false
+			}
+		default:
+			panic("unsupported filter " + name)
+		}
+	}
+	return true
+}
+
+func (f *fakeEC2) DescribeTags(in *ec2.DescribeTagsInput) (*ec2.DescribeTagsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var ids, keys []string
+	for _, filter := range in.Filters {
+		switch *filter.Name {
+		case "resource-id":
+			ids = aws.StringValueSlice(filter.Values)
+		case "key":
+			keys = aws.StringValueSlice(filter.Values)
+		}
+	}
+	out := &ec2.DescribeTagsOutput{}
+	for _, id := range ids {
+		if err := f.call("DescribeTags", id); err != nil {
+			return nil, err
+		}
+		for _, t := range f.ec2Tags(id) {
+			if len(keys) == 0 || containsString(keys, *t.Key) {
+				out.Tags = append(out.Tags, &ec2.TagDescription{ResourceId: aws.String(id), Key: t.Key, Value: t.Value})
+			}
+		}
+	}
+	return out, nil
+}
+
+func (f *fakeEC2) CreateTags(in *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+	f.mu.Lock()
+	for _, id := range aws.StringValueSlice(in.Resources) {
+		if err := f.call("CreateTags", id); err != nil {
+			f.mu.Unlock()
+			return nil, err
+		}
+	}
+	added := make(map[string]string)
+	for _, t := range in.Tags {
+		added[*t.Key] = *t.Value
+	}
+	for _, id := range aws.StringValueSlice(in.Resources) {
+		if f.tags[id] == nil {
+			f.tags[id] = make(map[string]string)
+		}
+		for k, v := range added {
+			f.tags[id][k] = v
+		}
+	}
+	after := f.afterCreateTags
+	f.mu.Unlock()
+	if after != nil {
+		for _, id := range aws.StringValueSlice(in.Resources) {
+			after(id, added)
+		}
+	}
+	return &ec2.CreateTagsOutput{}, nil
+}
+
+func (f *fakeEC2) DeleteTags(in *ec2.DeleteTagsInput) (*ec2.DeleteTagsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, id := range aws.StringValueSlice(in.Resources) {
+		if err := f.call("DeleteTags", id); err != nil {
+			return nil, err
+		}
+	}
+	for _, id := range aws.StringValueSlice(in.Resources) {
+		for _, t := range in.Tags {
+			delete(f.tags[id], *t.Key)
+		}
+	}
+	return &ec2.DeleteTagsOutput{}, nil
+}
+
+// ec2Volume returns volume id as returned by the EC2 API.
+func (f *fakeEC2) ec2Volume(id string) *ec2.Volume {
+	v := f.volumes[id]
+	ev := &ec2.Volume{
+		VolumeId:         aws.String(id),
+		AvailabilityZone: aws.String(v.az),
+		State:            aws.String(v.state),
+		VolumeType:       aws.String(ec2.VolumeTypeGp2),
+		Tags:             f.ec2Tags(id),
+	}
+	if v.snapshotID != "" {
+		ev.SnapshotId = aws.String(v.snapshotID)
+	}
+	if v.attachedTo != "" {
+		ev.Attachments = []*ec2.VolumeAttachment{{InstanceId: aws.String(v.attachedTo), VolumeId: aws.String(id)}}
+	}
+	return ev
+}
+
+func (f *fakeEC2) DescribeVolumes(in *ec2.DescribeVolumesInput) (*ec2.DescribeVolumesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DescribeVolumes", strings.Join(aws.StringValueSlice(in.VolumeIds), ",")); err != nil {
+		return nil, err
+	}
+	ids := aws.StringValueSlice(in.VolumeIds)
+	if len(ids) == 0 {
+		for id := range f.volumes {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+	}
+	out := &ec2.DescribeVolumesOutput{}
+	for _, id := range ids {
+		v, ok := f.volumes[id]
+		if !ok {
+			return nil, awserr.New("InvalidVolume.NotFound", "volume "+id+" does not exist", nil)
+		}
+		if matches(in.Filters, v.az, "", f.tags[id]) {
+			out.Volumes = append(out.Volumes, f.ec2Volume(id))
+		}
+	}
+	return out, nil
+}
+
+func (f *fakeEC2) DescribeInstances(in *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var instances []*ec2.Instance
+	for _, id := range aws.StringValueSlice(in.InstanceIds) {
+		if err := f.call("DescribeInstances", id); err != nil {
+			return nil, err
+		}
+		state, ok := f.instances[id]
+		if !ok {
+			return nil, awserr.New("InvalidInstanceID.NotFound", "instance "+id+" does not exist", nil)
+		}
+		instances = append(instances, &ec2.Instance{
+			InstanceId: aws.String(id),
+			State:      &ec2.InstanceState{Name: aws.String(state)},
+		})
+	}
+	return &ec2.DescribeInstancesOutput{Reservations: []*ec2.Reservation{{Instances: instances}}}, nil
+}
+
+func (f *fakeEC2) CreateSnapshot(in *ec2.CreateSnapshotInput) (*ec2.Snapshot, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("CreateSnapshot", *in.VolumeId); err != nil {
+		return nil, err
+	}
+	id := f.newID("snap")
+	f.snapshots[id] = &fakeSnapshot{volumeID: *in.VolumeId, start: time.Now()}
+	return &ec2.Snapshot{SnapshotId: aws.String(id), VolumeId: in.VolumeId}, nil
+}
+
+// DescribeSnapshots returns snapshots matching tag filters. All snapshots
+// are completed.
+func (f *fakeEC2) DescribeSnapshots(in *ec2.DescribeSnapshotsInput) (*ec2.DescribeSnapshotsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DescribeSnapshots", ""); err != nil {
+		return nil, err
+	}
+	var fs []*ec2.Filter
+	for _, filter := range in.Filters {
+		if *filter.Name != "status" {
+			fs = append(fs, filter)
+		}
+	}
+	var ids []string
+	for id := range f.snapshots {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	out := &ec2.DescribeSnapshotsOutput{}
+	for _, id := range ids {
+		s := f.snapshots[id]
+		if !matches(fs, "", "", f.tags[id]) {
+			continue
+		}
+		out.Snapshots = append(out.Snapshots, &ec2.Snapshot{
+			SnapshotId: aws.String(id),
+			VolumeId:   aws.String(s.volumeID),
+			StartTime:  aws.Time(s.start),
+			State:      aws.String(ec2.SnapshotStateCompleted),
+			Tags:       f.ec2Tags(id),
+		})
+	}
+	return out, nil
+}
+
+func (f *fakeEC2) WaitUntilSnapshotCompleted(in *ec2.DescribeSnapshotsInput) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.call("WaitUntilSnapshotCompleted", strings.Join(aws.StringValueSlice(in.SnapshotIds), ","))
+}
+
+func (f *fakeEC2) CreateVolume(in *ec2.CreateVolumeInput) (*ec2.Volume, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("CreateVolume", aws.StringValue(in.SnapshotId)); err != nil {
+		return nil, err
+	}
+	id := f.newID("vol")
+	f.volumes[id] = &fakeVolume{az: *in.AvailabilityZone, state: ec2.VolumeStateAvailable, snapshotID: aws.StringValue(in.SnapshotId)}
+	return f.ec2Volume(id), nil
+}
+
+func (f *fakeEC2) WaitUntilVolumeAvailable(in *ec2.DescribeVolumesInput) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.call("WaitUntilVolumeAvailable", strings.Join(aws.StringValueSlice(in.VolumeIds), ","))
+}
+
+func (f *fakeEC2) WaitUntilVolumeInUse(in *ec2.DescribeVolumesInput) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.call("WaitUntilVolumeInUse", strings.Join(aws.StringValueSlice(in.VolumeIds), ","))
+}
+
+func (f *fakeEC2) AttachVolume(in *ec2.AttachVolumeInput) (*ec2.VolumeAttachment, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("AttachVolume", *in.VolumeId); err != nil {
+		return nil, err
+	}
+	v, ok := f.volumes[*in.VolumeId]
+	if !ok || v.state != ec2.VolumeStateAvailable {
+		return nil, awserr.New("VolumeInUse", "volume "+*in.VolumeId+" is not available", nil)
+	}
+	f.attach(*in.VolumeId, *in.InstanceId)
+	return &ec2.VolumeAttachment{VolumeId: in.VolumeId, InstanceId: in.InstanceId}, nil
+}
+
+func (f *fakeEC2) DetachVolume(in *ec2.DetachVolumeInput) (*ec2.VolumeAttachment, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DetachVolume", *in.VolumeId); err != nil {
+		return nil, err
+	}
+	v, ok := f.volumes[*in.VolumeId]
+	if !ok || v.state != ec2.VolumeStateInUse {
+		return nil, awserr.New("IncorrectState", "volume "+*in.VolumeId+" is not attached", nil)
+	}
+	v.state, v.attachedTo = ec2.VolumeStateAvailable, ""
+	return &ec2.VolumeAttachment{VolumeId: in.VolumeId}, nil
+}
+
+func (f *fakeEC2) DeleteVolume(in *ec2.DeleteVolumeInput) (*ec2.DeleteVolumeOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DeleteVolume", *in.VolumeId); err != nil {
+		return nil, err
+	}
+	v, ok := f.volumes[*in.VolumeId]
+	if !ok || v.state != ec2.VolumeStateAvailable {
+		return nil, awserr.New("VolumeInUse", "volume "+*in.VolumeId+" is not available", nil)
+	}
+	delete(f.volumes, *in.VolumeId)
+	delete(f.tags, *in.VolumeId)
+	return &ec2.DeleteVolumeOutput{}, nil
+}
+
+func (f *fakeEC2) DescribeNetworkInterfaces(in *ec2.DescribeNetworkInterfacesInput) (*ec2.DescribeNetworkInterfacesOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DescribeNetworkInterfaces", strings.Join(aws.StringValueSlice(in.NetworkInterfaceIds), ",")); err != nil {
+		return nil, err
+	}
+	var ids []string
+	for id := range f.enis {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	out := &ec2.DescribeNetworkInterfacesOutput{}
+	for _, id := range ids {
+		n := f.enis[id]
+		if !matches(in.Filters, n.az, f.vpc, f.tags[id]) {
+			continue
+		}
+		en := &ec2.NetworkInterface{
+			NetworkInterfaceId: aws.String(id),
+			AvailabilityZone:   aws.String(n.az),
+			SubnetId:           aws.String(n.subnetID),
+			VpcId:              aws.String(f.vpc),
+			PrivateIpAddress:   aws.String(n.ip),
+			Status:             aws.String(ec2.NetworkInterfaceStatusAvailable),
+			TagSet:             f.ec2Tags(id),
+		}
+		if n.attachedTo != "" {
+			en.Status = aws.String(ec2.NetworkInterfaceStatusInUse)
+			en.Attachment = &ec2.NetworkInterfaceAttachment{
+				AttachmentId: aws.String("attach-" + id),
+				InstanceId:   aws.String(n.attachedTo),
+			}
+		}
+		out.NetworkInterfaces = append(out.NetworkInterfaces, en)
+	}
+	return out, nil
+}
+
+func (f *fakeEC2) CreateNetworkInterface(in *ec2.CreateNetworkInterfaceInput) (*ec2.CreateNetworkInterfaceOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("CreateNetworkInterface", *in.SubnetId); err != nil {
+		return nil, err
+	}
+	id := f.newID("eni")
+	f.enis[id] = &fakeENI{az: f.subnets[*in.SubnetId], subnetID: *in.SubnetId, ip: fmt.Sprintf("10.0.0.%d", f.nextID)}
+	return &ec2.CreateNetworkInterfaceOutput{
+		NetworkInterface: &ec2.NetworkInterface{NetworkInterfaceId: aws.String(id), SubnetId: in.SubnetId},
+	}, nil
+}
+
+// DescribeSubnets returns subnets, which all have the same CIDR block.
+func (f *fakeEC2) DescribeSubnets(in *ec2.DescribeSubnetsInput) (*ec2.DescribeSubnetsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("DescribeSubnets", strings.Join(aws.StringValueSlice(in.SubnetIds), ",")); err != nil {
+		return nil, err
+	}
+	out := &ec2.DescribeSubnetsOutput{}
+	for _, id := range aws.StringValueSlice(in.SubnetIds) {
+		az, ok := f.subnets[id]
+		if !ok {
+			return nil, awserr.New("InvalidSubnetID.NotFound", "subnet "+id+" does not exist", nil)
+		}
+		out.Subnets = append(out.Subnets, &ec2.Subnet{
+			SubnetId:         aws.String(id),
+			AvailabilityZone: aws.String(az),
+			VpcId:            aws.String(f.vpc),
+			CidrBlock:        aws.String("10.0.0.0/16"),
+		})
+	}
+	return out, nil
+}
+
+func TestFindNodeIDs(t *testing.T) {
+	f := newFakeEC2()
+	f.subnets["subnet-a"] = "eu-west-1a"
+	f.addVolume("vol-1", "eu-west-1a", map[string]string{"NodeID": "1", "Service": "etcd"})
+	f.addVolume("vol-untagged", "eu-west-1a", map[string]string{"Service": "etcd"})
+	f.addENI("eni-1", "subnet-a", "10.0.1.10", map[string]string{"NodeID": "1", "Service": "etcd"})
+	f.addENI("eni-untagged", "subnet-a", "10.0.1.11", map[string]string{"Service": "etcd"})
+	i := &instance{id: "i-local", az: "eu-west-1a", vpc: "vpc-1"}
+
+	vs, err := findVolumes(i, f, nil)
+	if err != nil {
+		t.Fatalf("findVolumes: %v", err)
+	}
+	got := make(map[string]string)
+	for _, v := range vs {
+		got[v.id] = v.nodeID
+	}
+	ns, err := findNetworkInterfaces(i, f, nil)
+	if err != nil {
+		t.Fatalf("findNetworkInterfaces: %v", err)
+	}
+	for _, n := range ns {
+		got[n.id] = n.nodeID
+	}
+	want := map[string]string{"vol-1": "1", "vol-untagged": "", "eni-1": "1", "eni-untagged": ""}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got NodeIDs %v, want %v", got, want)
+	}
+	// NodeIDs come with the resources, rather than a call per resource.
+	if n := f.count("DescribeTags"); n != 0 {
+		t.Errorf("got %d DescribeTags calls, want none", n)
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// tagInitialized is a volume tag recording where the volume data came from,
+// so that an empty volume is only ever restored once.
+const tagInitialized = "smilodon:initialized"
+
+// Bootstrap policies of empty volumes.
+const (
+	// bootstrapMkfs creates an empty file system.
+	bootstrapMkfs = "mkfs"
+	// bootstrapSnapshot replaces the volume with one restored from the latest
+	// snapshot of a sibling.
+	bootstrapSnapshot = "snapshot"
+	// bootstrapSeed creates a file system and extracts a seed tarball into it.
+	bootstrapSeed = "seed"
+)
+
+// validBootstrap reports whether p is a known bootstrap policy.
+func validBootstrap(p string) bool {
+	switch p {
+	case bootstrapMkfs, bootstrapSnapshot, bootstrapSeed:
+		return true
+	}
+	return false
+}
+
+// bootstrap initializes empty device d of the volume attached to instance i
+// according to the bootstrap policy. A volume which has been initialized before only gets
+// an empty file system, so that a restore never repeats.
+func (i *instance) bootstrap(d string) error {
+	if from := i.volume.tags[tagInitialized]; from != "" {
+		logger.Info("Volume has already been initialized, creating an empty file system", "volume_id", i.volume.id, "bootstrapped_from", from)
+		return mkfs(d, opts.fsType, fsLabel(opts.fsType, i.nodeID))
+	}
+	var from string
+	var err error
+	switch opts.bootstrap {
+	case bootstrapSnapshot:
+		from, err = i.bootstrapFromSnapshot(d)
+	case bootstrapSeed:
+		from, err = i.bootstrapFromSeed(d)
+	default:
+		from, err = bootstrapMkfs, mkfs(d, opts.fsType, fsLabel(opts.fsType, i.nodeID))
+	}
+	if err != nil || from == "" {
+		return err
+	}
+	if err := createTags(i.volume.id, map[string]string{tagInitialized: from}); err != nil {
+		return err
+	}
+	i.volume.tags[tagInitialized] = from
+	return nil
+}
+
+// bootstrapFromSnapshot replaces the empty volume attached to instance i with
+// a volume restored from the latest snapshot of a sibling, that is a snapshot
+// matching the tag filters. It returns the snapshot ID, or falls back to
+// creating an empty file system on device d if there is no such snapshot.
+func (i *instance) bootstrapFromSnapshot(d string) (string, error) {
+	snap, err := findLatestSnapshot()
+	if err != nil {
+		logger.Error("Failed to find snapshots to restore from", "error", err)
+		return "", err
+	}
+	if snap == nil {
+		logger.Info("No snapshots found to restore from, creating an empty file system")
+		return bootstrapMkfs, mkfs(d, opts.fsType, fsLabel(opts.fsType, i.nodeID))
+	}
+	snapshotID := *snap.SnapshotId
+	logger.Info("Restoring volume from snapshot", "snapshot_id", snapshotID)
+
+	r, err := ec2c.DescribeVolumes(&ec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(i.volume.id)},
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(r.Volumes) == 0 {
+		return "", fmt.Errorf("volume %q not found", i.volume.id)
+	}
+	old := r.Volumes[0]
+	params := &ec2.CreateVolumeInput{
+		AvailabilityZone: aws.String(i.az),
+		SnapshotId:       aws.String(snapshotID),
+		VolumeType:       old.VolumeType,
+		Size:             old.Size,
+	}
+	if aws.Int64Value(snap.VolumeSize) > aws.Int64Value(old.Size) {
+		params.Size = snap.VolumeSize
+	}
+	if aws.StringValue(old.VolumeType) == ec2.VolumeTypeIo1 {
+		params.Iops = old.Iops
+	}
+	nv, err := ec2c.CreateVolume(params)
+	if err != nil {
+		return "", err
+	}
+	newID := *nv.VolumeId
+	logger.Info("Created volume from snapshot", "new_volume_id", newID, "snapshot_id", snapshotID)
+
+	// The new volume is claimed until it is attached, so that other instances
+	// leave it alone.
+	tags := copyableTags(i.volume.tags)
+	tags[tagInitialized] = snapshotID
+	tags[tagClaim] = claimValue(i.id, time.Now())
+	if err := createTags(newID, tags); err != nil {
+		i.rollbackBootstrap(newID, nil, false)
+		return "", err
+	}
+	if err := ec2c.WaitUntilVolumeAvailable(&ec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(newID)},
+	}); err != nil {
+		i.rollbackBootstrap(newID, nil, false)
+		return "", err
+	}
+
+	// Swap the empty volume for the new one.
+	prev := *i.volume
+	if err := retire(prev.id, i.nodeID, newID); err != nil {
+		i.rollbackBootstrap(newID, &prev, false)
+		return "", err
+	}
+	if err := detachVolume(prev.id); err != nil {
+		i.rollbackBootstrap(newID, &prev, false)
+		return "", err
+	}
+	v := volume{id: newID, nodeID: i.nodeID, tags: copyableTags(tags)}
+	v.tags[tagInitialized] = snapshotID
+	v.tags[tagClaim] = tags[tagClaim]
+	if err := i.attachVolume(v, ec2c); err != nil {
+		i.rollbackBootstrap(newID, &prev, true)
+		return "", err
+	}
+	// The empty volume is left retired rather than deleted, so that an
+	// operator can still inspect or remove it.
+	logger.Info("Replaced volume, leaving it retired", "volume_id", prev.id, "new_volume_id", newID)
+	if err := ec2c.WaitUntilVolumeInUse(&ec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(newID)},
+	}); err != nil {
+		return "", err
+	}
+	if err := waitForDevice(opts.blockDevice, 5*time.Minute); err != nil {
+		return "", err
+	}
+	return snapshotID, nil
+}
+
+// rollbackBootstrap undoes a failed restore of instance i: it deletes new
+// volume newID and, if empty volume old has been retired, reinstates it and
+// reattaches it if it has been detached. If the new volume cannot be deleted,
+// its claim is released, so that it does not stay blocked.
+func (i *instance) rollbackBootstrap(newID string, old *volume, detached bool) {
+	logger.Warn("Rolling back restore from snapshot", "new_volume_id", newID)
+	if old != nil {
+		if err := unretire(old.id, i.nodeID); err != nil {
+			logger.Error("Failed to reinstate volume", "volume_id", old.id, "error", err)
+		}
+		if detached {
+			i.attachVolume(*old, ec2c)
+		}
+	}
+	if err := deleteVolume(newID); err != nil {
+		releaseClaim(newID)
+	}
+}
+
+// deleteVolume deletes volume id.
+func deleteVolume(id string) error {
+	logger.Info("Deleting volume", "volume_id", id)
+	if _, err := ec2c.DeleteVolume(&ec2.DeleteVolumeInput{VolumeId: aws.String(id)}); err != nil {
+		logger.Error("Failed to delete volume", "volume_id", id, "error", err)
+		return err
+	}
+	return nil
+}
+
+// findLatestSnapshot returns the latest completed snapshot matching the tag
+// filters, or nil if there is none.
+func findLatestSnapshot() (*ec2.Snapshot, error) {
+	f := []*ec2.Filter{
+		{
+			Name:   aws.String("status"),
+			Values: []*string{aws.String(ec2.SnapshotStateCompleted)},
+		},
+	}
+	for _, filter := range filters {
+		if *filter.Name == "tag-key" || strings.HasPrefix(*filter.Name, "tag:") {
+			f = append(f, filter)
+		}
+	}
+	r, err := ec2c.DescribeSnapshots(&ec2.DescribeSnapshotsInput{
+		OwnerIds: []*string{aws.String("self")},
+		Filters:  f,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(r.Snapshots) == 0 {
+		return nil, nil
+	}
+	sort.Sort(byStartTimeDesc(r.Snapshots))
+	return r.Snapshots[0], nil
+}
+
+// detachVolume detaches volume id and waits until it is available.
+func detachVolume(id string) error {
+	logger.Info("Detaching volume", "volume_id", id)
+	if _, err := ec2c.DetachVolume(&ec2.DetachVolumeInput{VolumeId: aws.String(id)}); err != nil {
+		logger.Error("Failed to detach volume", "volume_id", id, "error", err)
+		return err
+	}
+	return ec2c.WaitUntilVolumeAvailable(&ec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(id)},
+	})
+}
+
+// waitForDevice waits for block device d to appear.
+func waitForDevice(d string, timeout time.Duration) error {
+	for start := time.Now(); time.Since(start) < timeout; time.Sleep(5 * time.Second) {
+		if _, err := os.Stat(hostPath(d)); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("device %q did not appear within %v", d, timeout)
+}
+
+// bootstrapFromSeed creates a file system on empty device d and extracts the
+// seed tarball into it. It returns the seed location. If extraction
+// fails, the file system is wiped, so that bootstrapping is retried.
+func (i *instance) bootstrapFromSeed(d string) (string, error) {
+	if err := mkfs(d, opts.fsType, fsLabel(opts.fsType, i.nodeID)); err != nil {
+		return "", err
+	}
+	if err := extractSeed(opts.bootstrapSeed, d, opts.fsType, i.region); err != nil {
+		logger.Error("Failed to extract seed", "seed", opts.bootstrapSeed, "error", err)
+		if o, err := command("wipefs", "-a", cmdPath(d)).CombinedOutput(); err != nil {
+			logger.Error("Failed to wipe device", "device", d, "output", strings.TrimSpace(string(o)))
+		}
+		return "", err
+	}
+	logger.Info("Extracted seed", "seed", opts.bootstrapSeed, "device", d)
+	return opts.bootstrapSeed, nil
+}
+
+// extractSeed mounts device d with file system type t to a temporary mount
+// point and extracts seed tarball src into it. src is either a local path or
+// an s3://bucket/key URL.
+func extractSeed(src, d, t, region string) (err error) {
+	r, err := openSeed(src, region)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// The mount point is created on the host, as mount may run there.
+	tmp, err := ioutil.TempDir(hostPath("/tmp"), "smilodon-seed")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	dir := filepath.Join("/tmp", filepath.Base(tmp))
+	if err := mount(d, dir, t); err != nil {
+		return err
+	}
+	defer func() {
+		if e := unmount(dir); err == nil {
+			err = e
+		}
+	}()
+
+	br := bufio.NewReader(r)
+	var tr io.Reader = br
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		tr = gr
+	}
+	cmd := command("tar", "--numeric-owner", "-xpf", "-", "-C", cmdPath(dir))
+	cmd.Stdin = tr
+	if o, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(o)))
+	}
+	return nil
+}
+
+// openSeed opens seed tarball src, which is either a local path or an
+// s3://bucket/key URL. S3 objects are read from a bucket in region.
+func openSeed(src, region string) (io.ReadCloser, error) {
+	if !strings.HasPrefix(src, "s3://") {
+		return os.Open(src)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(src, "s3://"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid S3 URL %q", src)
+	}
+	s3c := s3.New(awsSession, awsConfig("s3", region))
+	o, err := s3c.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(parts[0]),
+		Key:    aws.String(parts[1]),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return o.Body, nil
+}
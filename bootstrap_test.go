@@ -0,0 +1,164 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// stubBootstrap replaces the EC2 API with a fake holding empty volume
+// vol-empty of NodeID 1 attached to instance i-local and a snapshot of
+// NodeID 2 to restore from. The block device is a temporary file.
+func stubBootstrap(t *testing.T) (*fakeEC2, *instance, func()) {
+	savedOpts, savedEC2, savedFilters := opts, ec2c, filters
+
+	dir, err := ioutil.TempDir("", "smilodon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.blockDevice = filepath.Join(dir, "xvdf")
+	if err := ioutil.WriteFile(opts.blockDevice, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	opts.hostRoot = ""
+	opts.strategy = "api"
+	opts.crossAZFailover = false
+	opts.filters = "tag:Service=etcd"
+
+	f := newFakeEC2()
+	f.instances["i-local"] = ec2.InstanceStateNameRunning
+	f.addVolume("vol-empty", "eu-west-1a", map[string]string{"NodeID": "1", "Service": "etcd"})
+	f.attach("vol-empty", "i-local")
+	f.snapshots["snap-2"] = &fakeSnapshot{volumeID: "vol-2", start: time.Now().Add(-time.Hour)}
+	f.tags["snap-2"] = map[string]string{"NodeID": "2", "Service": "etcd"}
+	ec2c = f
+
+	i := &instance{id: "i-local", nodeID: "1", az: "eu-west-1a"}
+	i.volume = &volume{id: "vol-empty", nodeID: "1", tags: copyTags(f.tags["vol-empty"])}
+	filters = buildFilters(*i)
+
+	return f, i, func() {
+		opts, ec2c, filters = savedOpts, savedEC2, savedFilters
+		os.RemoveAll(dir)
+	}
+}
+
+func TestBootstrapFromSnapshot(t *testing.T) {
+	f, i, restore := stubBootstrap(t)
+	defer restore()
+
+	from, err := i.bootstrapFromSnapshot(opts.blockDevice)
+	if err != nil {
+		t.Fatalf("bootstrapFromSnapshot: %v", err)
+	}
+	if from != "snap-2" {
+		t.Errorf("got restored from %q, want snap-2", from)
+	}
+	if i.volume == nil || i.volume.id == "vol-empty" {
+		t.Fatalf("got volume %+v, want the restored volume", i.volume)
+	}
+	v := f.volumes[i.volume.id]
+	if v.attachedTo != "i-local" || v.snapshotID != "snap-2" {
+		t.Errorf("got volume %+v, want it restored from snap-2 and attached", v)
+	}
+	tags := f.tags[i.volume.id]
+	if tags["NodeID"] != "1" || tags[tagInitialized] != "snap-2" {
+		t.Errorf("got tags %v, want NodeID 1 initialized from snap-2", tags)
+	}
+	if _, ok := tags[tagClaim]; ok {
+		t.Errorf("restored volume is still claimed: %v", tags)
+	}
+	// The empty volume is kept, but retired, so that it is never used again.
+	if v := f.volumes["vol-empty"]; v == nil || v.attachedTo != "" {
+		t.Errorf("got empty volume %+v, want it kept and detached", v)
+	}
+	if tags := f.tags["vol-empty"]; tags["NodeID"] != "" || tags[tagRetiredBy] != i.volume.id || tags[tagRetiredNodeID] != "1" {
+		t.Errorf("got empty volume tags %v, want it retired", tags)
+	}
+	if n := f.count("DeleteVolume"); n != 0 {
+		t.Errorf("got %d volumes deleted, want none", n)
+	}
+}
+
+func TestBootstrapSnapshot(t *testing.T) {
+	f, i, restore := stubBootstrap(t)
+	defer restore()
+	opts.bootstrap = bootstrapSnapshot
+
+	if err := i.bootstrap(opts.blockDevice); err != nil {
+		t.Fatalf("bootstrap: %v", err)
+	}
+	if i.volume.tags[tagInitialized] != "snap-2" || f.tags[i.volume.id][tagInitialized] != "snap-2" {
+		t.Errorf("got volume %+v tagged %v, want it initialized from snap-2", i.volume, f.tags[i.volume.id])
+	}
+}
+
+func TestBootstrapFromSnapshotRollback(t *testing.T) {
+	tests := []struct {
+		name string
+		// failOp fails on the volume which is not vol-empty.
+		failOp string
+		// failOld fails failOp on vol-empty instead.
+		failOld bool
+		// failDelete fails deleting the new volume.
+		failDelete bool
+	}{
+		{name: "tagging", failOp: "CreateTags"},
+		{name: "waiting", failOp: "WaitUntilVolumeAvailable"},
+		{name: "retiring", failOp: "DeleteTags", failOld: true},
+		{name: "detaching", failOp: "DetachVolume", failOld: true},
+		{name: "attaching", failOp: "AttachVolume"},
+		{name: "attaching, deleting", failOp: "AttachVolume", failDelete: true},
+	}
+	for _, tt := range tests {
+		f, i, restore := stubBootstrap(t)
+		var failed bool
+		f.failOn = func(op, id string) error {
+			if op == tt.failOp && !failed && (id == "vol-empty") == tt.failOld {
+				failed = true
+				return awserr.New("InternalError", "injected", nil)
+			}
+			if op == "DeleteVolume" && tt.failDelete && id != "vol-empty" {
+				return awserr.New("InternalError", "injected", nil)
+			}
+			return nil
+		}
+
+		if _, err := i.bootstrapFromSnapshot(opts.blockDevice); err == nil {
+			t.Errorf("%s: bootstrapFromSnapshot succeeded", tt.name)
+		}
+		if v := f.volumes["vol-empty"]; v == nil || v.attachedTo != "i-local" {
+			t.Errorf("%s: empty volume is not attached: %+v", tt.name, v)
+		}
+		if i.volume == nil || i.volume.id != "vol-empty" {
+			t.Errorf("%s: got volume %+v, want vol-empty", tt.name, i.volume)
+		}
+		tags := f.tags["vol-empty"]
+		if tags["NodeID"] != "1" || tags[tagRetiredBy] != "" || tags[tagRetiredNodeID] != "" {
+			t.Errorf("%s: empty volume has not been reinstated: %v", tt.name, tags)
+		}
+		for id := range f.volumes {
+			if id == "vol-empty" {
+				continue
+			}
+			if !tt.failDelete {
+				t.Errorf("%s: restored volume %s has not been deleted", tt.name, id)
+			} else if _, ok := f.tags[id][tagClaim]; ok {
+				t.Errorf("%s: restored volume %s is still claimed", tt.name, id)
+			}
+		}
+		if n := f.count("DeleteVolume"); n != 1 {
+			t.Errorf("%s: got %d volumes deleted, want 1", tt.name, n)
+		}
+		if strings.Contains(strings.Join(f.calls, "\n"), "DeleteVolume vol-empty") {
+			t.Errorf("%s: empty volume has been deleted", tt.name)
+		}
+		restore()
+	}
+}
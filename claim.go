@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// tagClaim is a resource tag, which an instance sets to claim a resource
+// before changing it in a way, which cannot be guarded by an attachment.
+const tagClaim = "smilodon:claim"
+
+// claimTTL is how long a claim is valid without being refreshed.
+const claimTTL = 30 * time.Minute
+
+// claimSettle is how long to wait for competing claims to land, before
+// checking who holds a claim. Tests shorten it.
+var claimSettle = 10 * time.Second
+
+var (
+	errClaimed   = errors.New("resource is claimed by another instance")
+	errClaimLost = errors.New("claim has been taken over by another instance")
+)
+
+// claimValue returns a claim tag value of instance id made at time t.
+func claimValue(id string, t time.Time) string {
+	return id + "/" + t.UTC().Format(time.RFC3339)
+}
+
+// parseClaim parses a claim tag value v and returns the instance ID holding
+// the claim and when it was made. It returns false if v is not a valid claim.
+func parseClaim(v string) (string, time.Time, bool) {
+	parts := strings.SplitN(v, "/", 2)
+	if len(parts) != 2 {
+		return "", time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, parts[1])
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return parts[0], t, true
+}
+
+// claimedByOther reports whether resource tags hold a valid claim of an
+// instance other than id.
+func claimedByOther(tags map[string]string, id string) bool {
+	holder, t, ok := parseClaim(tags[tagClaim])
+	return ok && holder != id && time.Since(t) < claimTTL
+}
+
+// claim claims a resource id with tags for instance i. Competing claims are
+// resolved by the last writer winning: every instance writes its claim, waits
+// for the others to land and then checks whether its own claim survived.
+func (i *instance) claim(id string, tags map[string]string) error {
+	if claimedByOther(tags, i.id) {
+		return errClaimed
+	}
+	logger.Info("Claiming resource", "resource_id", id)
+	if err := setClaim(id, i.id); err != nil {
+		return err
+	}
+	time.Sleep(claimSettle)
+	return i.verifyClaim(id)
+}
+
+// verifyClaim checks that instance i still holds a claim of resource id and
+// refreshes it. It must be called before every step guarded by the claim.
+func (i *instance) verifyClaim(id string) error {
+	holder, _, ok := parseClaim(getResourceTagValue(id, tagClaim, ec2c))
+	if !ok || holder != i.id {
+		logger.Error("Lost claim of resource", "resource_id", id, "holder", holder)
+		return errClaimLost
+	}
+	return setClaim(id, i.id)
+}
+
+// setClaim tags resource id with a claim of instance instanceID.
+func setClaim(id, instanceID string) error {
+	_, err := ec2c.CreateTags(&ec2.CreateTagsInput{
+		Resources: []*string{aws.String(id)},
+		Tags: []*ec2.Tag{
+			{
+				Key:   aws.String(tagClaim),
+				Value: aws.String(claimValue(instanceID, time.Now())),
+			},
+		},
+	})
+	if err != nil {
+		logger.Error("Failed to claim resource", "resource_id", id, "error", err)
+	}
+	return err
+}
+
+// releaseClaim removes a claim of resource id.
+func releaseClaim(id string) error {
+	_, err := ec2c.DeleteTags(&ec2.DeleteTagsInput{
+		Resources: []*string{aws.String(id)},
+		Tags:      []*ec2.Tag{{Key: aws.String(tagClaim)}},
+	})
+	if err != nil {
+		logger.Error("Failed to release claim of resource", "resource_id", id, "error", err)
+	}
+	return err
+}
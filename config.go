@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/route53"
+)
+
+var (
+	// cmdLineFlags are names of flags set on the command line. They take
+	// precedence over the config file.
+	cmdLineFlags = make(map[string]bool)
+	// configFlags are names of flags set by the config file.
+	configFlags = make(map[string]bool)
+	// optsMu guards opts while a reload changes them. Only the main loop
+	// changes opts, so it reads them without locking, but anything else, such
+	// as control API handlers, reads a copy from currentOpts.
+	optsMu sync.RWMutex
+)
+
+// currentOpts returns a copy of the options, which is safe to use outside the
+// main loop.
+func currentOpts() cmdLineOpts {
+	optsMu.RLock()
+	defer optsMu.RUnlock()
+	return opts
+}
+
+// loadConfigFile sets flags from config file f, except those set on the
+// command line. Each line holds a flag name and value as name=value, with or
+// without leading dashes. Blank lines and lines starting with # are ignored.
+// Flags set by the file before, but missing from it now, are reset to their
+// defaults, so that removing a line and reloading takes effect.
+func loadConfigFile(f string) error {
+	file, err := os.Open(f)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	values := make(map[string]string)
+	s := bufio.NewScanner(file)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(strings.TrimLeft(line, "-"), "=", 2)
+		name := strings.TrimSpace(kv[0])
+		if flag.Lookup(name) == nil {
+			return fmt.Errorf("%s:%d: unknown option %q", f, n, name)
+		}
+		if len(kv) == 2 {
+			values[name] = strings.TrimSpace(kv[1])
+		} else {
+			// A boolean flag without a value.
+			values[name] = "true"
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+
+	for name := range configFlags {
+		if _, ok := values[name]; !ok {
+			values[name] = flag.Lookup(name).DefValue
+		}
+	}
+	set := make(map[string]bool)
+	for name, v := range values {
+		if cmdLineFlags[name] || name == "config" {
+			continue
+		}
+		if err := flag.Set(name, v); err != nil {
+			return fmt.Errorf("%s: invalid value %q of option %q: %v", f, v, name, err)
+		}
+		set[name] = true
+	}
+	configFlags = set
+	return nil
+}
+
+// parseOptions validates options and parses those, which need parsing. Parsed
+// values are only applied if all options are valid.
+func parseOptions() error {
+	if !validAddressMode(opts.addressMode) {
+		return fmt.Errorf("invalid --address-mode value: %q", opts.addressMode)
+	}
+	if !validBootstrap(opts.bootstrap) {
+		return fmt.Errorf("invalid --bootstrap value: %q", opts.bootstrap)
+	}
+	if opts.bootstrap == bootstrapSeed && opts.bootstrapSeed == "" {
+		return fmt.Errorf("--bootstrap-seed is required with --bootstrap=%s", bootstrapSeed)
+	}
+	if opts.hostExec != "" && opts.hostExec != hostExecNsenter {
+		return fmt.Errorf("invalid --host-exec value: %q", opts.hostExec)
+	}
+	if !validMetricsSink(opts.metrics) {
+		return fmt.Errorf("invalid --metrics value: %q", opts.metrics)
+	}
+	if !validEventSink(opts.events) {
+		return fmt.Errorf("invalid --events value: %q", opts.events)
+	}
+	if opts.events == "sns" && opts.eventsTopicARN == "" {
+		return fmt.Errorf("--events-topic-arn is required with --events=sns")
+	}
+	if opts.r53ZoneID != "" {
+		if err := validRecordName(opts.r53Name, true); err != nil {
+			return fmt.Errorf("invalid --route53-record-name value: %v", err)
+		}
+		if opts.r53SRVName != "" {
+			if err := validRecordName(opts.r53SRVName, false); err != nil {
+				return fmt.Errorf("invalid --route53-srv-name value: %v", err)
+			}
+		}
+	}
+	if opts.consulService != "" && opts.consulTTL <= runInterval {
+		return fmt.Errorf("invalid --consul-ttl value: %v, it must be longer than the %v between runs", opts.consulTTL, runInterval)
+	}
+	if opts.crossAZFailover && opts.addressMode == addressModeSecondaryIP {
+		return fmt.Errorf("--cross-az-failover is not supported in %q address mode, as private IP addresses cannot move between subnets", opts.addressMode)
+	}
+
+	fs, err := parseEnvFiles(opts.envFile)
+	if err != nil {
+		return fmt.Errorf("invalid --env-file value: %v", err)
+	}
+	ids, err := parseNodeIDs(opts.preferredID)
+	if err != nil {
+		return fmt.Errorf("invalid --preferred-node-id value: %v", err)
+	}
+	ts, err := parseTemplates(opts.templates)
+	if err != nil {
+		return fmt.Errorf("invalid --template value: %v", err)
+	}
+	var schedule *cronSchedule
+	if opts.snapshotCron != "" {
+		schedule, err = parseCron(opts.snapshotCron)
+		if err != nil {
+			return fmt.Errorf("invalid --snapshot-schedule value: %v", err)
+		}
+	}
+	endpoints, err := parseEndpoints(opts.awsEndpoints)
+	if err != nil {
+		return fmt.Errorf("invalid --aws-endpoints value: %v", err)
+	}
+	tags, err := parseExportTags(opts.exportTags)
+	if err != nil {
+		return fmt.Errorf("invalid --export-tag value: %v", err)
+	}
+	retain, err := parseRetention(opts.snapshotRetain)
+	if err != nil {
+		return fmt.Errorf("invalid --snapshot-retention value: %v", err)
+	}
+	if err := logger.configure(opts.logLevel, opts.logFormat); err != nil {
+		return fmt.Errorf("invalid logging options: %v", err)
+	}
+
+	envFiles = fs
+	exportTags = tags
+	preferredIDs = ids
+	templates = ts
+	snapshotSchedule = schedule
+	snapshotRetain = retain
+	awsEndpoints = endpoints
+	return nil
+}
+
+// applyInstanceOptions applies options, which depend on instance i.
+func applyInstanceOptions(i instance) error {
+	s, err := newSelectionStrategy(opts.strategy, i)
+	if err != nil {
+		return fmt.Errorf("invalid --selection-strategy value: %v", err)
+	}
+	strategy = s
+	dns = nil
+	if opts.r53ZoneID != "" {
+		r53c := route53.New(awsSession, awsConfig("route53", i.region))
+		dns = newDNSRecords(r53c, opts.r53ZoneID, opts.r53Name, opts.r53SRVName, opts.r53SRVPort, opts.r53TTL)
+	}
+	kube = nil
+	if opts.kubeNodeName != "" {
+		c, err := newKubeClient(opts.kubeconfig)
+		if err != nil {
+			return fmt.Errorf("invalid Kubernetes options: %v", err)
+		}
+		kube = newKubeNode(c, opts.kubeNodeName)
+	}
+	// Keep track of the registered service, so that it is replaced or
+	// deregistered, if the Consul options change.
+	consulMu.Lock()
+	prev := consul
+	consul = nil
+	if opts.consulService != "" {
+		consul = newConsulService(opts.consulAddress, opts.consulToken, opts.consulService, opts.consulPort, parseConsulTags(opts.consulTags), opts.consulTTL)
+		if prev != nil {
+			consul.registered = prev.registered
+		}
+	} else if prev != nil {
+		if err := prev.deregister(""); err != nil {
+			logger.Error("Failed to deregister Consul service", "service", prev.name, "error", err)
+		}
+	}
+	consulMu.Unlock()
+	filters = buildFilters(i)
+	metrics = newMetricsSink(opts.metrics, opts.metricsNamespace, i.region)
+	events = newEventSink(opts.events, opts.eventsTopicARN, i.region)
+	return nil
+}
+
+// pairedOptionChanged returns the name of an option, which differs from
+// previous options prev, but cannot change while a pair is attached, as the
+// pair has been attached according to it. It returns an empty string if there
+// is none.
+func pairedOptionChanged(prev cmdLineOpts) string {
+	switch {
+	case opts.addressMode != prev.addressMode:
+		return "address-mode"
+	case opts.blockDevice != prev.blockDevice:
+		return "block-device"
+	}
+	return ""
+}
+
+// reloadConfig reloads the config file and applies options of instance i. If
+// any option is invalid, or one which cannot change while instance i is
+// paired does, the previous options are kept.
+func reloadConfig(i instance) error {
+	if opts.config == "" {
+		return fmt.Errorf("no config file given")
+	}
+	optsMu.Lock()
+	defer optsMu.Unlock()
+	saved := opts
+	err := loadConfigFile(opts.config)
+	if err == nil {
+		err = parseOptions()
+	}
+	if name := pairedOptionChanged(saved); err == nil && name != "" && i.nodeID != "" {
+		err = fmt.Errorf("--%s cannot be changed while NodeID %s is paired", name, i.nodeID)
+	}
+	if err == nil {
+		err = applyInstanceOptions(i)
+	}
+	if err != nil {
+		logger.Error("Failed to reload config file", "path", saved.config, "error", err)
+		opts = saved
+		parseOptions()
+		applyInstanceOptions(i)
+		return err
+	}
+	if opts.snapshotCron != saved.snapshotCron {
+		nextSnapshot = time.Time{}
+	}
+	logger.Info("Reloaded config file", "path", opts.config)
+	return nil
+}
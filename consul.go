@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// consul registers the pair of the instance with Consul, if enabled.
+	consul *consulService
+	// consulMu guards consul, which is deregistered on shutdown while a run
+	// may be in progress.
+	consulMu sync.Mutex
+)
+
+// consulService keeps a service of the pair registered with the local Consul
+// agent while the pair is ready. Its TTL check is updated on every run, so
+// that the service turns critical if smilodon stops reconciling.
+type consulService struct {
+	address string
+	token   string
+	name    string
+	port    int
+	tags    []string
+	ttl     time.Duration
+	client  *http.Client
+	// registered is the registration last sent to the agent, if any.
+	registered *consulRegistration
+	// deregistered is the ID of the service last deregistered, so that it is
+	// not deregistered again on every run.
+	deregistered string
+}
+
+// consulRegistration is a service definition of the Consul agent API.
+type consulRegistration struct {
+	ID      string
+	Name    string
+	Address string
+	Port    int `json:",omitempty"`
+	Tags    []string
+	Meta    map[string]string
+	Check   consulCheck
+}
+
+// consulCheck is a TTL check definition of the Consul agent API.
+type consulCheck struct {
+	CheckID string
+	Name    string
+	TTL     string
+}
+
+// newConsulService returns a registrar of service name with the Consul agent
+// at address. Values of resource tags tags are added to the service as
+// key=value Consul tags.
+func newConsulService(address, token, name string, port int, tags []string, ttl time.Duration) *consulService {
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+	return &consulService{
+		address: strings.TrimRight(address, "/"),
+		token:   token,
+		name:    name,
+		port:    port,
+		tags:    tags,
+		ttl:     ttl,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// serviceID returns the ID of the service of NodeID nodeID. It only depends
+// on the NodeID, so that any process can deregister the service, even one
+// which has not registered it.
+func (c *consulService) serviceID(nodeID string) string {
+	return c.name + "-" + nodeID
+}
+
+// registration returns the service definition of the pair of instance i.
+func (c *consulService) registration(i instance) *consulRegistration {
+	id := c.serviceID(i.nodeID)
+	r := &consulRegistration{
+		ID:      id,
+		Name:    c.name,
+		Address: i.networkInterface.IPAddress,
+		Port:    c.port,
+		Tags:    []string{},
+		Meta: map[string]string{
+			"node_id":     i.nodeID,
+			"instance_id": i.id,
+			"volume_id":   i.volume.id,
+		},
+		Check: consulCheck{
+			CheckID: "service:" + id,
+			Name:    "smilodon reconcile loop",
+			TTL:     fmt.Sprintf("%ds", int(c.ttl/time.Second)),
+		},
+	}
+	for _, t := range c.tags {
+		if v, ok := resourceTag(i, t); ok {
+			r.Tags = append(r.Tags, t+"="+v)
+		}
+	}
+	return r
+}
+
+// update registers the pair of instance i, if it is ready, and passes its
+// TTL check, or deregisters it otherwise. The check warns about errors logged
+// in the current run.
+func (c *consulService) update(i instance) error {
+	if i.nodeID == "" || i.volume == nil || i.networkInterface == nil || (opts.mountFs && !isMountPoint(opts.mountPoint)) {
+		return c.deregister(i.nodeID)
+	}
+	r := c.registration(i)
+	if c.registered == nil || !reflect.DeepEqual(c.registered, r) {
+		if c.registered != nil && c.registered.ID != r.ID {
+			if err := c.deregister(""); err != nil {
+				return err
+			}
+		}
+		data, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		if err := c.do("/v1/agent/service/register", data); err != nil {
+			return err
+		}
+		c.registered = r
+		c.deregistered = ""
+		logger.Info("Registered Consul service", "service_id", r.ID, "address", r.Address)
+	}
+
+	check := struct {
+		Status string
+		Output string
+	}{"passing", "Reconciled."}
+	if n := logger.cycleErrors(); n > 0 {
+		check.Status = "warning"
+		check.Output = fmt.Sprintf("Errors logged in the last run: %d.", n)
+	}
+	data, err := json.Marshal(check)
+	if err != nil {
+		return err
+	}
+	if err := c.do("/v1/agent/check/update/"+r.Check.CheckID, data); err != nil {
+		// The agent may have lost the service, register it again on the
+		// next run.
+		c.registered = nil
+		return err
+	}
+	return nil
+}
+
+// deregister deregisters the service registered by this process or, if there
+// is none, the service of NodeID nodeID, which may have been registered by
+// another process, such as the daemon before a restart. A service unknown to
+// the agent counts as deregistered.
+func (c *consulService) deregister(nodeID string) error {
+	var id string
+	if c.registered != nil {
+		id = c.registered.ID
+	} else if nodeID != "" {
+		id = c.serviceID(nodeID)
+	}
+	if id == "" || id == c.deregistered {
+		return nil
+	}
+	if err := c.do("/v1/agent/service/deregister/"+id, nil); err != nil && !isConsulNotFound(err) {
+		return err
+	}
+	c.registered = nil
+	c.deregistered = id
+	logger.Info("Deregistered Consul service", "service_id", id)
+	return nil
+}
+
+// consulError is an error response of the Consul agent API.
+type consulError struct {
+	path   string
+	code   int
+	status string
+	msg    string
+}
+
+func (e *consulError) Error() string {
+	return fmt.Sprintf("PUT %s: %s: %s", e.path, e.status, e.msg)
+}
+
+// isConsulNotFound reports whether err is a 404 response.
+func isConsulNotFound(err error) bool {
+	e, ok := err.(*consulError)
+	return ok && e.code == http.StatusNotFound
+}
+
+// do sends a PUT request with body to agent API path p.
+func (c *consulService) do(p string, body []byte) error {
+	req, err := http.NewRequest("PUT", c.address+p, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return &consulError{p, resp.StatusCode, resp.Status, strings.TrimSpace(string(msg))}
+	}
+	return nil
+}
+
+// parseConsulTags parses a comma-delimited list of resource tag keys.
+func parseConsulTags(s string) []string {
+	var tags []string
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tags = append(tags, t)
+		}
+	}
+	return tags
+}
+
+// updateConsul updates the Consul service of instance i, if enabled.
+func updateConsul(i instance) {
+	consulMu.Lock()
+	defer consulMu.Unlock()
+	if consul == nil {
+		return
+	}
+	if err := consul.update(i); err != nil {
+		logger.Error("Failed to update Consul service", "service", consul.name, "error", err)
+	}
+}
+
+// deregisterConsul deregisters the Consul service of NodeID nodeID, or the
+// one registered by this process.
+func deregisterConsul(nodeID string) {
+	consulMu.Lock()
+	defer consulMu.Unlock()
+	if consul == nil {
+		return
+	}
+	if err := consul.deregister(nodeID); err != nil {
+		logger.Error("Failed to deregister Consul service", "service", consul.name, "error", err)
+	}
+}
+
+// stopConsul deregisters the Consul service registered by this process and
+// disables Consul, so that a run in progress does not register it again.
+func stopConsul() {
+	consulMu.Lock()
+	defer consulMu.Unlock()
+	if consul == nil {
+		return
+	}
+	if err := consul.deregister(""); err != nil {
+		logger.Error("Failed to deregister Consul service", "service", consul.name, "error", err)
+	}
+	consul = nil
+}
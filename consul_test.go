@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeConsulAgent is a Consul agent API keeping registered services by ID.
+type fakeConsulAgent struct {
+	mu       sync.Mutex
+	services map[string]consulRegistration
+	// checks holds the last status of checks by ID.
+	checks map[string]string
+	// requests lists requested paths.
+	requests []string
+}
+
+func newFakeConsulAgent() *fakeConsulAgent {
+	return &fakeConsulAgent{services: make(map[string]consulRegistration), checks: make(map[string]string)}
+}
+
+func (f *fakeConsulAgent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.URL.Path)
+	if r.Method != "PUT" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Header.Get("X-Consul-Token") != "secret" {
+		http.Error(w, "ACL not found", http.StatusForbidden)
+		return
+	}
+	switch {
+	case r.URL.Path == "/v1/agent/service/register":
+		var s consulRegistration
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.services[s.ID] = s
+		f.checks[s.Check.CheckID] = "critical"
+	case strings.HasPrefix(r.URL.Path, "/v1/agent/service/deregister/"):
+		id := strings.TrimPrefix(r.URL.Path, "/v1/agent/service/deregister/")
+		s, ok := f.services[id]
+		if !ok {
+			http.Error(w, "Unknown service ID "+id, http.StatusNotFound)
+			return
+		}
+		delete(f.services, id)
+		delete(f.checks, s.Check.CheckID)
+	case strings.HasPrefix(r.URL.Path, "/v1/agent/check/update/"):
+		id := strings.TrimPrefix(r.URL.Path, "/v1/agent/check/update/")
+		if _, ok := f.checks[id]; !ok {
+			http.Error(w, "Unknown check ID "+id, http.StatusNotFound)
+			return
+		}
+		var check struct{ Status string }
+		if err := json.NewDecoder(r.Body).Decode(&check); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.checks[id] = check.Status
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// stubConsulAgent serves f and returns a registrar of service etcd with it.
+func stubConsulAgent(f *fakeConsulAgent) (*consulService, func()) {
+	s := httptest.NewServer(f)
+	saved := opts
+	opts.mountFs = false
+	logger.nextCycle()
+	return newConsulService(s.URL, "secret", "etcd", 2379, []string{"Role"}, 5*time.Minute), func() {
+		opts = saved
+		s.Close()
+	}
+}
+
+// readyPair returns an instance with the ready pair of NodeID 1.
+func readyPair() instance {
+	i := *attachedPair()
+	i.nodeID = "1"
+	i.nodeIP = "10.0.1.10"
+	i.networkInterface.tags = map[string]string{"Role": "etcd"}
+	return i
+}
+
+func TestConsulUpdate(t *testing.T) {
+	f := newFakeConsulAgent()
+	c, restore := stubConsulAgent(f)
+	defer restore()
+
+	i := readyPair()
+	if err := c.update(i); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	s, ok := f.services["etcd-1"]
+	if !ok {
+		t.Fatalf("service etcd-1 has not been registered: %v", f.services)
+	}
+	if s.Name != "etcd" || s.Address != "10.0.1.10" || s.Port != 2379 || strings.Join(s.Tags, ",") != "Role=etcd" || s.Meta["volume_id"] != "vol-1" {
+		t.Errorf("got service %+v", s)
+	}
+	if s.Check.TTL != "300s" {
+		t.Errorf("got check TTL %s, want 300s", s.Check.TTL)
+	}
+	if got := f.checks["service:etcd-1"]; got != "passing" {
+		t.Errorf("got check status %s, want passing", got)
+	}
+
+	// The service is only registered again if it changes.
+	f.requests = nil
+	if err := c.update(i); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if strings.Join(f.requests, ",") != "/v1/agent/check/update/service:etcd-1" {
+		t.Errorf("got requests %v for an unchanged pair, want a check update", f.requests)
+	}
+
+	// Once the pair is gone, the service is deregistered once.
+	i.nodeID = ""
+	f.requests = nil
+	for n := 0; n < 2; n++ {
+		if err := c.update(i); err != nil {
+			t.Fatalf("update: %v", err)
+		}
+	}
+	if len(f.services) != 0 {
+		t.Errorf("got services %v after the pair was released, want none", f.services)
+	}
+	if strings.Join(f.requests, ",") != "/v1/agent/service/deregister/etcd-1" {
+		t.Errorf("got requests %v, want a single deregistration", f.requests)
+	}
+}
+
+func TestConsulDeregister(t *testing.T) {
+	f := newFakeConsulAgent()
+	c, restore := stubConsulAgent(f)
+	defer restore()
+	if err := c.update(readyPair()); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+
+	// Another process, such as smilodon release or a restarted daemon, has
+	// not registered the service but deregisters it by NodeID.
+	other := newConsulService(c.address, "secret", "etcd", 2379, nil, 5*time.Minute)
+	if err := other.deregister(""); err != nil {
+		t.Fatalf("deregister without a NodeID: %v", err)
+	}
+	if len(f.services) != 1 {
+		t.Fatalf("got services %v, want etcd-1 to be kept without a NodeID", f.services)
+	}
+	if err := other.deregister("1"); err != nil {
+		t.Fatalf("deregister: %v", err)
+	}
+	if len(f.services) != 0 {
+		t.Errorf("got services %v, want none", f.services)
+	}
+
+	// A service unknown to the agent has already been deregistered.
+	f.requests = nil
+	if err := c.deregister("1"); err != nil {
+		t.Errorf("deregister of an unknown service: %v", err)
+	}
+	if len(f.requests) != 1 {
+		t.Errorf("got requests %v, want a deregistration", f.requests)
+	}
+	if c.registered != nil {
+		t.Error("service is still registered after its deregistration")
+	}
+
+	// Other failures are returned.
+	c.token = "invalid"
+	if err := c.update(readyPair()); err == nil {
+		t.Error("update succeeded with an invalid token")
+	}
+	if err := c.deregister("2"); err == nil || isConsulNotFound(err) {
+		t.Errorf("got %v, want an ACL error", err)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"path"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// controlRequest asks the main loop to run action on the instance. The
+// result is sent to reply.
+type controlRequest struct {
+	action string
+	reply  chan error
+}
+
+// errRunInProgress turns down a control request, as the main loop is busy
+// with a run.
+var errRunInProgress = errors.New("a run is in progress, try again later")
+
+var (
+	// controlRequests are serviced by the main loop between runs, as only the
+	// main loop may change the instance.
+	controlRequests = make(chan controlRequest)
+	// reconcileNow wakes the main loop up to run straight away.
+	reconcileNow = make(chan struct{}, 1)
+	// controlWait is how long a control request waits for a run in progress
+	// to end before it is turned down.
+	controlWait = 10 * time.Second
+
+	statusMu sync.Mutex
+	status   controlStatus
+)
+
+// controlStatus is the status of the daemon as of the last run.
+type controlStatus struct {
+	Version            string    `json:"version"`
+	InstanceID         string    `json:"instance_id"`
+	AvailabilityZone   string    `json:"availability_zone"`
+	NodeID             string    `json:"node_id"`
+	NodeIP             string    `json:"node_ip"`
+	VolumeID           string    `json:"volume_id"`
+	NetworkInterfaceID string    `json:"network_interface_id"`
+	Mounted            bool      `json:"mounted"`
+	Paused             bool      `json:"paused"`
+	LastRun            time.Time `json:"last_run"`
+	NextRun            time.Time `json:"next_run"`
+}
+
+// publishStatus records the status of instance i after a run, before the
+// main loop sleeps until next.
+func publishStatus(i instance, next time.Time) {
+	s := controlStatus{
+		Version:          Version,
+		InstanceID:       i.id,
+		AvailabilityZone: i.az,
+		NodeID:           i.nodeID,
+		NodeIP:           i.nodeIP,
+		Mounted:          opts.mountFs && isMountPoint(opts.mountPoint),
+		LastRun:          time.Now().UTC(),
+		NextRun:          next.UTC(),
+	}
+	if i.volume != nil {
+		s.VolumeID = i.volume.id
+	}
+	if i.networkInterface != nil {
+		s.NetworkInterfaceID = i.networkInterfaceID()
+	}
+	statusMu.Lock()
+	status = s
+	statusMu.Unlock()
+}
+
+// handleControlRequest runs a control request action on instance i.
+func handleControlRequest(i *instance, action string) error {
+	switch action {
+	case "release":
+		return release(i, false)
+	case "drain":
+		return release(i, true)
+	case "reload":
+		return reloadConfig(*i)
+	}
+	return fmt.Errorf("unknown action %q", action)
+}
+
+// serveControl serves the control API on unix socket f. Access is controlled
+// by file permissions: the socket is only accessible by its owner, or also by
+// group if one is given.
+func serveControl(f, group string) error {
+	if err := os.MkdirAll(path.Dir(f), 0755); err != nil {
+		return err
+	}
+	if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	l, err := net.Listen("unix", f)
+	if err != nil {
+		return err
+	}
+	mode := os.FileMode(0600)
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			l.Close()
+			return err
+		}
+		gid, _ := strconv.Atoi(g.Gid)
+		if err := os.Chown(f, -1, gid); err != nil {
+			l.Close()
+			return err
+		}
+		mode = 0660
+	}
+	if err := os.Chmod(f, mode); err != nil {
+		l.Close()
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", handleStatus)
+	mux.HandleFunc("/reconcile", post(func() error {
+		select {
+		case reconcileNow <- struct{}{}:
+		default:
+		}
+		return nil
+	}))
+	mux.HandleFunc("/pause", post(func() error { return pause("Paused via the control API") }))
+	mux.HandleFunc("/resume", post(func() error {
+		if err := resume(); err != nil {
+			return err
+		}
+		select {
+		case reconcileNow <- struct{}{}:
+		default:
+		}
+		return nil
+	}))
+	for _, action := range []string{"release", "drain", "reload"} {
+		action := action
+		mux.HandleFunc("/"+action, post(func() error {
+			reply := make(chan error, 1)
+			timer := time.NewTimer(controlWait)
+			defer timer.Stop()
+			select {
+			case controlRequests <- controlRequest{action, reply}:
+			case <-timer.C:
+				return errRunInProgress
+			}
+			return <-reply
+		}))
+	}
+	logger.Info("Serving the control API", "path", f)
+	go http.Serve(l, mux)
+	return nil
+}
+
+// handleStatus responds with the status of the daemon.
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	statusMu.Lock()
+	s := status
+	statusMu.Unlock()
+	s.Paused = paused()
+	writeJSON(w, http.StatusOK, s)
+}
+
+// post returns a handler of POST requests, which runs fn.
+func post(fn func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+		if err := fn(); err == errRunInProgress {
+			w.Header().Set("Retry-After", "30")
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+			return
+		} else if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"result": "ok"})
+	}
+}
+
+// writeJSON writes v as a JSON response with HTTP status code.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	data, _ := json.MarshalIndent(v, "", "  ")
+	w.Write(append(data, '\n'))
+}
+
+// controlListening reports whether a daemon serves the control API on unix
+// socket f. A missing socket or one nobody listens on means there is no
+// daemon, any other error is returned.
+func controlListening(f string) (bool, error) {
+	c, err := net.Dial("unix", f)
+	if err == nil {
+		c.Close()
+		return true, nil
+	}
+	if oe, ok := err.(*net.OpError); ok {
+		if se, ok := oe.Err.(*os.SyscallError); ok {
+			if se.Err == syscall.ENOENT || se.Err == syscall.ECONNREFUSED {
+				return false, nil
+			}
+		}
+	}
+	return false, err
+}
+
+// ctlActions are actions of the ctl command, which are sent as POST requests.
+// status is sent as a GET request.
+var ctlActions = []string{"reconcile", "pause", "resume", "release", "drain", "reload"}
+
+// ctl sends action to the control API on unix socket f and prints the
+// response. Releasing a pair waits for detachments, so release and drain get
+// more time than other actions.
+func ctl(f, action string) error {
+	method := "POST"
+	if action == "status" {
+		method = "GET"
+	} else if !containsString(ctlActions, action) {
+		return fmt.Errorf("unknown action %q", action)
+	}
+	timeout := time.Minute
+	if action == "release" || action == "drain" {
+		timeout = 15 * time.Minute
+	}
+	c := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return net.Dial("unix", f)
+			},
+		},
+	}
+	req, err := http.NewRequest(method, "http://smilodon/"+action, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	os.Stdout.Write(body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s failed: %s", action, resp.Status)
+	}
+	return nil
+}
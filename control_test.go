@@ -0,0 +1,165 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveTestControl serves the control API on a socket in a temporary
+// directory and returns its path.
+func serveTestControl(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "smilodon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := filepath.Join(dir, "control.sock")
+	if err := serveControl(f, ""); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return f, func() { os.RemoveAll(dir) }
+}
+
+func TestControlListening(t *testing.T) {
+	f, cleanup := serveTestControl(t)
+	defer cleanup()
+
+	if listening, err := controlListening(f); err != nil || !listening {
+		t.Errorf("controlListening(%q) = %v, %v, want true", f, listening, err)
+	}
+	missing := filepath.Join(filepath.Dir(f), "missing.sock")
+	if listening, err := controlListening(missing); err != nil || listening {
+		t.Errorf("controlListening(%q) = %v, %v, want false", missing, listening, err)
+	}
+}
+
+func TestCtlRelease(t *testing.T) {
+	f, cleanup := serveTestControl(t)
+	defer cleanup()
+
+	actions := make(chan string, 1)
+	go func() {
+		r := <-controlRequests
+		actions <- r.action
+		r.reply <- nil
+	}()
+	if err := ctl(f, "drain"); err != nil {
+		t.Fatalf("ctl: %v", err)
+	}
+	if action := <-actions; action != "drain" {
+		t.Errorf("got action %q, want drain", action)
+	}
+}
+
+func TestCtlRunInProgress(t *testing.T) {
+	f, cleanup := serveTestControl(t)
+	defer cleanup()
+	saved := controlWait
+	defer func() { controlWait = saved }()
+	controlWait = 10 * time.Millisecond
+
+	// Nothing services control requests, as if a run were in progress.
+	err := ctl(f, "reload")
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("got %v, want 503 Service Unavailable", err)
+	}
+}
+
+// stubConfig writes config file contents to a temporary directory and sets it
+// as --config. The returned func restores options and what they configure.
+func stubConfig(t *testing.T, contents string) func() {
+	savedOpts, savedFlags := opts, configFlags
+	savedEnvFiles, savedTags, savedIDs, savedTemplates := envFiles, exportTags, preferredIDs, templates
+	savedSchedule, savedRetain, savedEndpoints := snapshotSchedule, snapshotRetain, awsEndpoints
+	savedStrategy, savedFilters, savedMetrics, savedEvents := strategy, filters, metrics, events
+	dir, err := ioutil.TempDir("", "smilodon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.config = filepath.Join(dir, "smilodon.conf")
+	opts.pauseFile = filepath.Join(dir, "paused")
+	if err := ioutil.WriteFile(opts.config, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		opts, configFlags = savedOpts, savedFlags
+		envFiles, exportTags, preferredIDs, templates = savedEnvFiles, savedTags, savedIDs, savedTemplates
+		snapshotSchedule, snapshotRetain, awsEndpoints = savedSchedule, savedRetain, savedEndpoints
+		strategy, filters, metrics, events = savedStrategy, savedFilters, savedMetrics, savedEvents
+		os.RemoveAll(dir)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		nodeID string
+		err    bool
+	}{
+		{"unpaired address mode", "address-mode=elastic-ip\n", "", false},
+		{"paired address mode", "address-mode=elastic-ip\n", "1", true},
+		{"unpaired block device", "block-device=/dev/xvdg\n", "", false},
+		{"paired block device", "block-device=/dev/xvdg\n", "1", true},
+		{"paired other option", "template-reload-command=true\n", "1", false},
+		{"invalid option", "address-mode=bogus\n", "", true},
+	}
+	for _, tt := range tests {
+		restore := stubConfig(t, tt.config)
+		saved := opts
+		i := instance{id: "i-local", nodeID: tt.nodeID}
+
+		err := reloadConfig(i)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: got error %v, want error %v", tt.name, err, tt.err)
+		}
+		// Rejected options leave the previous ones in place.
+		if tt.err && opts != saved {
+			t.Errorf("%s: options have changed: %+v", tt.name, opts)
+		}
+		if !tt.err && opts == saved {
+			t.Errorf("%s: options have not changed", tt.name)
+		}
+		restore()
+	}
+}
+
+// TestControlDuringReload serves control requests while the main loop
+// reloads options, which the race detector checks.
+func TestControlDuringReload(t *testing.T) {
+	restore := stubConfig(t, "")
+	defer restore()
+	// Every reload sets the pause file, which control requests read.
+	if err := ioutil.WriteFile(opts.config, []byte("pause-file="+opts.pauseFile+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, cleanup := serveTestControl(t)
+	defer cleanup()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, action := range []string{"pause", "status", "resume", "status"} {
+			if err := ctl(f, action); err != nil {
+				t.Errorf("ctl %s: %v", action, err)
+			}
+		}
+	}()
+	i := instance{id: "i-local"}
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if err := reloadConfig(i); err != nil {
+			t.Fatalf("reloadConfig: %v", err)
+		}
+		logger.setInstance(i)
+		logger.Debug("Reloaded")
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed cron expression with the usual five fields:
+// minute, hour, day of month, month and day of week. Each field is a bit set
+// of matching values.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// domStar and dowStar record whether the day of month and the day of week
+	// are unrestricted, in which case only the other field is matched.
+	domStar, dowStar bool
+}
+
+// cronMacros are shorthands for common cron expressions.
+var cronMacros = map[string]string{
+	"@yearly":  "0 0 1 1 *",
+	"@monthly": "0 0 1 * *",
+	"@weekly":  "0 0 * * 0",
+	"@daily":   "0 0 * * *",
+	"@hourly":  "0 * * * *",
+}
+
+// parseCron parses a cron expression, for example "0 */6 * * *" or "@daily".
+// Fields support "*", lists, ranges and steps. Day of week 7 is Sunday too.
+func parseCron(expr string) (*cronSchedule, error) {
+	if m, ok := cronMacros[strings.TrimSpace(expr)]; ok {
+		expr = m
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields in %q", expr)
+	}
+	var s cronSchedule
+	var err error
+	if s.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if s.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if s.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if s.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if s.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	// Only a plain "*" leaves a day field unrestricted, so that "*/2" in the
+	// day of month still matches either field.
+	s.domStar = fields[2] == "*"
+	s.dowStar = fields[4] == "*"
+	if !s.matchesAnyDay() {
+		return nil, fmt.Errorf("%q never matches", expr)
+	}
+	return &s, nil
+}
+
+// monthDays holds the number of days of each month in a leap year.
+var monthDays = [13]int{0, 31, 29, 31, 30, 31, 30, 31, 31, 30, 31, 30, 31}
+
+// matchesAnyDay reports whether schedule s matches any day at all. Only days
+// of month restricted on their own can miss every month, as in "0 0 30 2 *".
+func (s *cronSchedule) matchesAnyDay() bool {
+	if s.domStar || !s.dowStar {
+		return true
+	}
+	for m := 1; m <= 12; m++ {
+		if s.month&(1<<uint(m)) == 0 {
+			continue
+		}
+		for d := 1; d <= monthDays[m]; d++ {
+			if s.dom&(1<<uint(d)) != 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseCronField parses a comma-delimited cron field with values between min
+// and max into a bit set.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, item := range strings.Split(field, ",") {
+		step := 1
+		if parts := strings.SplitN(item, "/", 2); len(parts) == 2 {
+			var err error
+			if step, err = strconv.Atoi(parts[1]); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in %q", item)
+			}
+			item = parts[0]
+		}
+		from, to := min, max
+		if item != "*" {
+			parts := strings.SplitN(item, "-", 2)
+			var err error
+			if from, err = strconv.Atoi(parts[0]); err != nil {
+				return 0, fmt.Errorf("invalid value in %q", field)
+			}
+			to = from
+			if len(parts) == 2 {
+				if to, err = strconv.Atoi(parts[1]); err != nil {
+					return 0, fmt.Errorf("invalid value in %q", field)
+				}
+			}
+		}
+		if from < min || to > max || from > to {
+			return 0, fmt.Errorf("value out of range %d-%d in %q", min, max, field)
+		}
+		for v := from; v <= to; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// next returns the first time after t matching schedule s, or the zero time
+// if there is none within five years.
+func (s *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// matchDay reports whether the day of t matches schedule s. Like in cron, if
+// both the day of month and the day of week are restricted, either matches.
+func (s *cronSchedule) matchDay(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
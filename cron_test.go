@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expr  string
+		valid bool
+	}{
+		{"* * * * *", true},
+		{"0 */6 * * *", true},
+		{"15,45 9-17 * * 1-5", true},
+		{"0 0 1-31/2 * *", true},
+		{"0 0 * * 7", true},
+		{"@daily", true},
+		{" @weekly ", true},
+		{"", false},
+		{"* * * *", false},
+		{"* * * * * *", false},
+		{"60 * * * *", false},
+		{"* 24 * * *", false},
+		{"* * 0 * *", false},
+		{"* * * 13 *", false},
+		{"* * * * 8", false},
+		{"5-1 * * * *", false},
+		{"*/0 * * * *", false},
+		{"a * * * *", false},
+		{"@sometimes", false},
+		// Days which no month has never match.
+		{"0 0 30 2 *", false},
+		{"0 0 31 2,4,6 *", false},
+		{"0 0 31 2,3 *", true},
+		// Leap years have February 29.
+		{"0 0 29 2 *", true},
+		// Either day field matches if both are restricted.
+		{"0 0 31 2 1", true},
+	}
+	for _, tt := range tests {
+		if _, err := parseCron(tt.expr); (err == nil) != tt.valid {
+			t.Errorf("parseCron(%q) = %v, want valid %v", tt.expr, err, tt.valid)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	at := func(s string) time.Time {
+		t, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+	tests := []struct {
+		expr string
+		from string
+		want []string
+	}{
+		{"* * * * *", "2016-06-01 10:00", []string{"2016-06-01 10:01", "2016-06-01 10:02"}},
+		// Seconds are truncated and the next time is always later.
+		{"30 10 * * *", "2016-06-01 10:30", []string{"2016-06-02 10:30"}},
+		{"0 */6 * * *", "2016-06-01 10:00", []string{"2016-06-01 12:00", "2016-06-01 18:00", "2016-06-02 00:00"}},
+		{"15,45 9-10 * * *", "2016-06-01 10:50", []string{"2016-06-02 09:15", "2016-06-02 09:45", "2016-06-02 10:15"}},
+		{"0 0 1-31/10 * *", "2016-06-01 00:00", []string{"2016-06-11 00:00", "2016-06-21 00:00", "2016-07-01 00:00"}},
+		// Weekdays only, 2016-06-03 is a Friday.
+		{"0 9 * * 1-5", "2016-06-03 10:00", []string{"2016-06-06 09:00", "2016-06-07 09:00"}},
+		// Sunday is 0 and 7.
+		{"0 0 * * 7", "2016-06-01 00:00", []string{"2016-06-05 00:00", "2016-06-12 00:00"}},
+		// Either the day of month or the day of week matches, 2016-06-01 is a
+		// Wednesday.
+		{"0 0 13 * 5", "2016-06-01 00:00", []string{"2016-06-03 00:00", "2016-06-10 00:00", "2016-06-13 00:00", "2016-06-17 00:00"}},
+		// A step restricts the day of month like any other value, 2016-06-06
+		// is a Monday.
+		{"0 0 */2 * 1", "2016-06-01 00:00", []string{"2016-06-03 00:00", "2016-06-05 00:00", "2016-06-06 00:00", "2016-06-07 00:00"}},
+		// Rolls over into the next month and year.
+		{"0 0 31 * *", "2016-06-01 00:00", []string{"2016-07-31 00:00", "2016-08-31 00:00", "2016-10-31 00:00"}},
+		{"@monthly", "2016-12-15 12:00", []string{"2017-01-01 00:00", "2017-02-01 00:00"}},
+		{"@yearly", "2016-06-01 00:00", []string{"2017-01-01 00:00"}},
+		{"0 0 29 2 *", "2016-03-01 00:00", []string{"2020-02-29 00:00"}},
+		{"@hourly", "2016-12-31 23:59", []string{"2017-01-01 00:00"}},
+	}
+	for _, tt := range tests {
+		s, err := parseCron(tt.expr)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", tt.expr, err)
+			continue
+		}
+		next := at(tt.from).Add(20 * time.Second)
+		for _, want := range tt.want {
+			next = s.next(next)
+			if !next.Equal(at(want)) {
+				t.Errorf("%q: got %v, want %s", tt.expr, next, want)
+				break
+			}
+		}
+	}
+}
+
+func TestCronNextNever(t *testing.T) {
+	// parseCron rejects such schedules, so this one is built by hand.
+	s := &cronSchedule{minute: 1, hour: 1, dom: 1 << 30, month: 1 << 2, dow: 1<<7 - 1, dowStar: true}
+	if next := s.next(time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)); !next.IsZero() {
+		t.Errorf("got %v for February 30, want the zero time", next)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// mountDevice returns the device holding the file system of NodeID nodeID on
+// the attached volume: a logical volume of an LVM volume group, a partition
+// selected by number or file system label, or the whole volume. The volume
+// group is activated first.
+func mountDevice(nodeID string) (string, error) {
+	if opts.volumeGroup != "" {
+		vg := fmt.Sprintf(opts.volumeGroup, nodeID)
+		lv := filepath.Join("/dev", vg, opts.logicalVolume)
+		if _, err := os.Stat(hostPath(lv)); err == nil {
+			return lv, nil
+		}
+		if err := activateVolumeGroup(vg); err != nil {
+			return "", err
+		}
+		return lv, nil
+	}
+	if opts.partition > 0 {
+		return findPartition(opts.blockDevice, opts.partition)
+	}
+	if opts.mountLabel != "" {
+		return findByLabel(opts.blockDevice, fmt.Sprintf(opts.mountLabel, nodeID))
+	}
+	return opts.blockDevice, nil
+}
+
+// findPartition returns the device path of partition number n of device d.
+func findPartition(d string, n int) (string, error) {
+	parts, err := devicePartitions(d)
+	if err != nil {
+		return "", err
+	}
+	for _, p := range parts {
+		data, err := ioutil.ReadFile(hostPath(filepath.Join("/sys/class/block", filepath.Base(p), "partition")))
+		if err != nil {
+			return "", err
+		}
+		if strings.TrimSpace(string(data)) == fmt.Sprint(n) {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("partition %d of %s not found", n, d)
+}
+
+// findByLabel returns device d, or the device path of one of its partitions,
+// which holds a file system labelled label.
+func findByLabel(d, label string) (string, error) {
+	parts, err := devicePartitions(d)
+	if err != nil {
+		return "", err
+	}
+	for _, p := range append([]string{d}, parts...) {
+		vars, err := blkidProbe(p)
+		if err != nil {
+			return "", err
+		}
+		if vars["LABEL"] == label {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("file system labelled %q not found on %s", label, d)
+}
+
+// activateVolumeGroup activates LVM volume group vg.
+func activateVolumeGroup(vg string) error {
+	logger.Info("Activating volume group", "volume_group", vg)
+	if o, err := command("vgchange", "-ay", vg).CombinedOutput(); err != nil {
+		logger.Error("Failed to activate volume group", "volume_group", vg, "output", strings.TrimSpace(string(o)))
+		return err
+	}
+	return nil
+}
+
+// deactivateVolumeGroup deactivates the LVM volume group of NodeID nodeID, if
+// volume groups are configured.
+func deactivateVolumeGroup(nodeID string) error {
+	if opts.volumeGroup == "" {
+		return nil
+	}
+	vg := fmt.Sprintf(opts.volumeGroup, nodeID)
+	logger.Info("Deactivating volume group", "volume_group", vg)
+	if o, err := command("vgchange", "-an", vg).CombinedOutput(); err != nil {
+		logger.Error("Failed to deactivate volume group", "volume_group", vg, "output", strings.TrimSpace(string(o)))
+		return err
+	}
+	return nil
+}
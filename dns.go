@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/aws/aws-sdk-go/service/route53/route53iface"
+)
+
+// dnsRecords keeps track of Route 53 records managed by smilodon. Records are
+// only upserted when they change, so that Route 53 API rate limits are not
+// hit on every run.
+type dnsRecords struct {
+	r53c    route53iface.Route53API
+	zoneID  string
+	name    string
+	srvName string
+	srvPort int64
+	ttl     int64
+	// upserted holds the last upserted record values keyed by record name.
+	upserted map[string]string
+}
+
+// newDNSRecords returns Route 53 records manager for a hosted zone zoneID.
+// Record names are built from nameFormat, where %s is replaced by a NodeID.
+func newDNSRecords(r53c route53iface.Route53API, zoneID, nameFormat, srvName string, srvPort, ttl int64) *dnsRecords {
+	return &dnsRecords{
+		r53c:     r53c,
+		zoneID:   zoneID,
+		name:     nameFormat,
+		srvName:  srvName,
+		srvPort:  srvPort,
+		ttl:      ttl,
+		upserted: make(map[string]string),
+	}
+}
+
+// validRecordName checks that a record name format f is set and names a
+// record in a domain, as Route 53 rejects names outside the hosted zone.
+// perNode requires f to hold a %s to be replaced by a NodeID.
+func validRecordName(f string, perNode bool) error {
+	if f == "" {
+		return fmt.Errorf("a record name is required")
+	}
+	if perNode && strings.Count(f, "%s") != 1 {
+		return fmt.Errorf("%q must hold exactly one %%s", f)
+	}
+	if !strings.Contains(strings.TrimSuffix(f, "."), ".") {
+		return fmt.Errorf("%q must end in the domain of the hosted zone", f)
+	}
+	return nil
+}
+
+// recordName returns the A record name of NodeID nodeID.
+func (d *dnsRecords) recordName(nodeID string) string {
+	return fmt.Sprintf(d.name, nodeID)
+}
+
+// upsert upserts an A record of instance i and, if configured, a SRV record
+// listing all paired NodeIDs found in network interfaces ns. As ns is looked
+// up in the whole VPC, every instance upserts the same SRV record. Without
+// any peers, the SRV record is left alone.
+func (d *dnsRecords) upsert(i instance, ns []networkInterface) error {
+	var changes []*route53.Change
+
+	name := d.recordName(i.nodeID)
+	if d.upserted[name] != i.networkInterface.IPAddress {
+		changes = append(changes, d.change(route53.ChangeActionUpsert, name, route53.RRTypeA, i.networkInterface.IPAddress))
+	}
+
+	var srvValues []string
+	if d.srvName != "" {
+		for _, n := range ns {
+			if n.nodeID != "" && !n.available {
+				srvValues = append(srvValues, fmt.Sprintf("0 0 %d %s", d.srvPort, d.recordName(n.nodeID)))
+			}
+		}
+		sort.Strings(srvValues)
+		if len(srvValues) > 0 && d.upserted[d.srvName] != strings.Join(srvValues, ",") {
+			changes = append(changes, d.change(route53.ChangeActionUpsert, d.srvName, route53.RRTypeSrv, srvValues...))
+		}
+	}
+
+	if len(changes) == 0 {
+		return nil
+	}
+	if err := d.apply(changes); err != nil {
+		logger.Error("Failed to upsert DNS records", "zone_id", d.zoneID, "error", err)
+		return err
+	}
+	logger.Info("Upserted DNS record", "name", name, "ip", i.networkInterface.IPAddress)
+	d.upserted[name] = i.networkInterface.IPAddress
+	if len(srvValues) > 0 {
+		d.upserted[d.srvName] = strings.Join(srvValues, ",")
+	}
+	return nil
+}
+
+// remove deletes an A record of NodeID nodeID pointing to ip. The SRV record
+// is left in place, as it describes the whole cluster rather than this node.
+func (d *dnsRecords) remove(nodeID, ip string) error {
+	name := d.recordName(nodeID)
+	err := d.apply([]*route53.Change{d.change(route53.ChangeActionDelete, name, route53.RRTypeA, ip)})
+	if err != nil {
+		// Route 53 refuses to delete records that do not exist, which is fine,
+		// but also records whose value has changed meanwhile, which is not.
+		if !isRecordNotFound(err) {
+			logger.Error("Failed to delete DNS record", "name", name, "error", err)
+			return err
+		}
+	}
+	logger.Info("Deleted DNS record", "name", name)
+	delete(d.upserted, name)
+	return nil
+}
+
+// isRecordNotFound reports whether err is the error Route 53 returns when
+// deleting a record that does not exist.
+func isRecordNotFound(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == "InvalidChangeBatch" && strings.Contains(aerr.Message(), "not found")
+}
+
+// change returns a Route 53 change of record name of type t with values vs.
+func (d *dnsRecords) change(action, name, t string, vs ...string) *route53.Change {
+	var records []*route53.ResourceRecord
+	for _, v := range vs {
+		records = append(records, &route53.ResourceRecord{Value: aws.String(v)})
+	}
+	return &route53.Change{
+		Action: aws.String(action),
+		ResourceRecordSet: &route53.ResourceRecordSet{
+			Name:            aws.String(name),
+			Type:            aws.String(t),
+			TTL:             aws.Int64(d.ttl),
+			ResourceRecords: records,
+		},
+	}
+}
+
+// apply submits changes to the hosted zone.
+func (d *dnsRecords) apply(changes []*route53.Change) error {
+	_, err := d.r53c.ChangeResourceRecordSets(&route53.ChangeResourceRecordSetsInput{
+		HostedZoneId: aws.String(d.zoneID),
+		ChangeBatch: &route53.ChangeBatch{
+			Comment: aws.String("Managed by smilodon"),
+			Changes: changes,
+		},
+	})
+	return err
+}
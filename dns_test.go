@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/aws/aws-sdk-go/service/route53/route53iface"
+)
+
+// fakeRoute53 records change batches instead of sending them to Route 53.
+type fakeRoute53 struct {
+	route53iface.Route53API
+	batches []*route53.ChangeResourceRecordSetsInput
+	err     error
+}
+
+func (f *fakeRoute53) ChangeResourceRecordSets(in *route53.ChangeResourceRecordSetsInput) (*route53.ChangeResourceRecordSetsOutput, error) {
+	f.batches = append(f.batches, in)
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &route53.ChangeResourceRecordSetsOutput{}, nil
+}
+
+// fakeRecord is a change of a record set in a form easy to compare.
+type fakeRecord struct {
+	action, name, kind string
+	ttl                int64
+	values             []string
+}
+
+func (f *fakeRoute53) records(n int) []fakeRecord {
+	var rs []fakeRecord
+	for _, c := range f.batches[n].ChangeBatch.Changes {
+		r := fakeRecord{
+			action: *c.Action,
+			name:   *c.ResourceRecordSet.Name,
+			kind:   *c.ResourceRecordSet.Type,
+			ttl:    *c.ResourceRecordSet.TTL,
+		}
+		for _, v := range c.ResourceRecordSet.ResourceRecords {
+			r.values = append(r.values, *v.Value)
+		}
+		rs = append(rs, r)
+	}
+	return rs
+}
+
+func pairedInstance(nodeID, ip string) instance {
+	return instance{
+		nodeID:           nodeID,
+		networkInterface: &networkInterface{nodeID: nodeID, IPAddress: ip},
+	}
+}
+
+func TestDNSUpsert(t *testing.T) {
+	f := &fakeRoute53{}
+	d := newDNSRecords(f, "Z1", "node-%s.etcd.internal", "", 0, 60)
+	ns := []networkInterface{{nodeID: "1", IPAddress: "10.0.0.1"}}
+
+	if err := d.upsert(pairedInstance("1", "10.0.0.1"), ns); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+	if len(f.batches) != 1 {
+		t.Fatalf("got %d change batches, want 1", len(f.batches))
+	}
+	if got := *f.batches[0].HostedZoneId; got != "Z1" {
+		t.Errorf("got hosted zone %q, want Z1", got)
+	}
+	want := []fakeRecord{{route53.ChangeActionUpsert, "node-1.etcd.internal", route53.RRTypeA, 60, []string{"10.0.0.1"}}}
+	if got := f.records(0); !reflect.DeepEqual(got, want) {
+		t.Errorf("got records %v, want %v", got, want)
+	}
+
+	// Unchanged records are not upserted again.
+	if err := d.upsert(pairedInstance("1", "10.0.0.1"), ns); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+	if len(f.batches) != 1 {
+		t.Errorf("got %d change batches after an unchanged upsert, want 1", len(f.batches))
+	}
+
+	// A failed upsert is retried on the next run.
+	f.err = errors.New("throttled")
+	if err := d.upsert(pairedInstance("1", "10.0.0.2"), ns); err == nil {
+		t.Fatal("upsert succeeded, want an error")
+	}
+	f.err = nil
+	if err := d.upsert(pairedInstance("1", "10.0.0.2"), ns); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+	if len(f.batches) != 3 {
+		t.Errorf("got %d change batches, want 3", len(f.batches))
+	}
+}
+
+func TestDNSUpsertSRV(t *testing.T) {
+	f := &fakeRoute53{}
+	d := newDNSRecords(f, "Z1", "node-%s.etcd.internal", "_etcd-server._tcp.etcd.internal", 2380, 30)
+	ns := []networkInterface{
+		{nodeID: "2", IPAddress: "10.0.0.2"},
+		{nodeID: "", IPAddress: "10.0.0.9"},
+		{nodeID: "4", IPAddress: "10.0.0.4", available: true},
+		{nodeID: "1", IPAddress: "10.0.0.1"},
+	}
+
+	if err := d.upsert(pairedInstance("1", "10.0.0.1"), ns); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+	want := []fakeRecord{
+		{route53.ChangeActionUpsert, "node-1.etcd.internal", route53.RRTypeA, 30, []string{"10.0.0.1"}},
+		{route53.ChangeActionUpsert, "_etcd-server._tcp.etcd.internal", route53.RRTypeSrv, 30, []string{
+			"0 0 2380 node-1.etcd.internal",
+			"0 0 2380 node-2.etcd.internal",
+		}},
+	}
+	if got := f.records(0); !reflect.DeepEqual(got, want) {
+		t.Errorf("got records %v, want %v", got, want)
+	}
+
+	// A new peer only changes the SRV record.
+	ns = append(ns, networkInterface{nodeID: "3", IPAddress: "10.0.0.3"})
+	if err := d.upsert(pairedInstance("1", "10.0.0.1"), ns); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+	if len(f.batches) != 2 {
+		t.Fatalf("got %d change batches, want 2", len(f.batches))
+	}
+	got := f.records(1)
+	if len(got) != 1 || got[0].kind != route53.RRTypeSrv || len(got[0].values) != 3 {
+		t.Errorf("got records %v, want only the SRV record with 3 values", got)
+	}
+}
+
+func TestDNSRemove(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		wantErr bool
+	}{
+		{"deleted", nil, false},
+		{"already gone", awserr.New("InvalidChangeBatch", "Tried to delete resource record set [name='node-1.etcd.internal.', type='A'] but it was not found", nil), false},
+		{"changed", awserr.New("InvalidChangeBatch", "Tried to delete resource record set [name='node-1.etcd.internal.', type='A'] but the values provided do not match the current values", nil), true},
+		{"failed", awserr.New("Throttling", "rate exceeded", nil), true},
+	}
+	for _, tt := range tests {
+		f := &fakeRoute53{}
+		d := newDNSRecords(f, "Z1", "node-%s.etcd.internal", "", 0, 60)
+		d.upserted["node-1.etcd.internal"] = "10.0.0.1"
+		f.err = tt.err
+
+		err := d.remove("1", "10.0.0.1")
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		want := []fakeRecord{{route53.ChangeActionDelete, "node-1.etcd.internal", route53.RRTypeA, 60, []string{"10.0.0.1"}}}
+		if got := f.records(0); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got records %v, want %v", tt.name, got, want)
+		}
+		if _, ok := d.upserted["node-1.etcd.internal"]; ok != tt.wantErr {
+			t.Errorf("%s: got record tracked as upserted %v, want %v", tt.name, ok, tt.wantErr)
+		}
+	}
+}
+
+func TestValidRecordName(t *testing.T) {
+	tests := []struct {
+		name    string
+		perNode bool
+		valid   bool
+	}{
+		{"node-%s.etcd.internal", true, true},
+		{"node-%s.etcd.internal.", true, true},
+		{"node-%s", true, false},
+		{"", true, false},
+		{"node.etcd.internal", true, false},
+		{"_etcd-server._tcp.etcd.internal", false, true},
+		{"etcd", false, false},
+	}
+	for _, tt := range tests {
+		if err := validRecordName(tt.name, tt.perNode); (err == nil) != tt.valid {
+			t.Errorf("validRecordName(%q, %v) = %v, want valid %v", tt.name, tt.perNode, err, tt.valid)
+		}
+	}
+}
+
+func TestDNSUpsertSRVPeers(t *testing.T) {
+	_, i, restore := stubPeers()
+	defer restore()
+
+	// Instances in either availability zone upsert the same SRV record.
+	var srvs [][]string
+	for _, p := range []struct{ id, az, subnet, nodeID, ip string }{
+		{"i-a", "eu-west-1a", "subnet-a", "1", "10.0.1.10"},
+		{"i-b", "eu-west-1b", "subnet-b", "2", "10.0.2.10"},
+	} {
+		i.id, i.az, i.subnetID = p.id, p.az, p.subnet
+		peers, err := findPeers(i, ec2c)
+		if err != nil {
+			t.Fatalf("findPeers: %v", err)
+		}
+		f := &fakeRoute53{}
+		d := newDNSRecords(f, "Z1", "node-%s.etcd.internal", "_etcd-server._tcp.etcd.internal", 2380, 30)
+		if err := d.upsert(pairedInstance(p.nodeID, p.ip), peers); err != nil {
+			t.Fatalf("upsert: %v", err)
+		}
+		rs := f.records(0)
+		if len(rs) != 2 {
+			t.Fatalf("got records %v, want an A and a SRV record", rs)
+		}
+		srvs = append(srvs, rs[1].values)
+	}
+	want := []string{
+		"0 0 2380 node-1.etcd.internal",
+		"0 0 2380 node-10.etcd.internal",
+		"0 0 2380 node-2.etcd.internal",
+	}
+	for n, srv := range srvs {
+		if !reflect.DeepEqual(srv, want) {
+			t.Errorf("instance %d: got SRV record %v, want %v", n, srv, want)
+		}
+	}
+}
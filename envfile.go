@@ -1,29 +1,267 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"net"
 	"os"
 	"path"
+	"regexp"
+	"strconv"
+	"strings"
 )
 
+// Supported environment file formats.
+const (
+	envFormatSystemd = "systemd"
+	envFormatShell   = "shell"
+	envFormatJSON    = "json"
+)
+
+// envFile is an environment file path and the format it is written in.
+type envFile struct {
+	path   string
+	format string
+}
+
+// exportTag maps a resource tag to an environment variable name.
+type exportTag struct {
+	tag string
+	key string
+}
+
+// envVar is a single environment variable written to environment files.
+type envVar struct {
+	key   string
+	value string
+}
+
+var (
+	invalidEnvKeyChars = regexp.MustCompile("[^A-Z0-9_]")
+	validEnvKey        = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+)
+
+// parseEnvFiles parses a comma-delimited list of environment files. Each item
+// is a path optionally followed by a colon and a format, for example
+// "/run/smilodon/environment,/run/smilodon/env.json:json". The format
+// defaults to systemd.
+func parseEnvFiles(s string) ([]envFile, error) {
+	var files []envFile
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		f := envFile{path: item, format: envFormatSystemd}
+		if n := strings.LastIndex(item, ":"); n != -1 {
+			f.path, f.format = item[:n], item[n+1:]
+		}
+		switch f.format {
+		case envFormatSystemd, envFormatShell, envFormatJSON:
+		default:
+			return nil, fmt.Errorf("unknown environment file format %q for %q", f.format, f.path)
+		}
+		if f.path == "" {
+			return nil, fmt.Errorf("missing environment file path in %q", item)
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// parseExportTags parses a comma-delimited list of resource tags to export.
+// Each item is a tag key optionally followed by an equals sign and a variable
+// name, for example "Service=SERVICE_NAME,Env". When the variable name is
+// omitted it is derived from the tag key, so "Env" becomes "TAG_ENV".
+func parseExportTags(s string) ([]exportTag, error) {
+	var tags []exportTag
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		t := exportTag{tag: item}
+		if parts := strings.SplitN(item, "=", 2); len(parts) == 2 {
+			t.tag, t.key = strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+			if !validEnvKey.MatchString(t.key) {
+				return nil, fmt.Errorf("invalid variable name %q in %q", t.key, item)
+			}
+		} else {
+			t.key = "TAG_" + invalidEnvKeyChars.ReplaceAllString(strings.ToUpper(t.tag), "_")
+		}
+		if t.tag == "" {
+			return nil, fmt.Errorf("missing tag key in %q", item)
+		}
+		tags = append(tags, t)
+	}
+	return tags, nil
+}
+
+// envVars returns a list of environment variables describing instance i and
+// its attached volume and network interface.
+func envVars(i instance) []envVar {
+	vars := []envVar{
+		{"NODE_ID", i.nodeID},
+		{"NODE_IP", i.networkInterface.IPAddress},
+		{"NODE_IPV6", firstString(i.networkInterface.ipv6Addresses)},
+		{"VOLUME_ID", i.volume.id},
+		{"NETWORK_INTERFACE_ID", i.networkInterfaceID()},
+		{"INSTANCE_ID", i.id},
+		{"REGION", i.region},
+		{"AVAILABILITY_ZONE", i.az},
+		{"VPC_ID", i.vpc},
+		{"BLOCK_DEVICE", opts.blockDevice},
+		{"MOUNT_POINT", opts.mountPoint},
+		{"SUBNET_CIDR", i.networkInterface.subnetCIDR},
+		{"GATEWAY", subnetGateway(i.networkInterface.subnetCIDR)},
+	}
+	for _, t := range exportTags {
+		v, _ := resourceTag(i, t.tag)
+		vars = append(vars, envVar{t.key, v})
+	}
+	return vars
+}
+
+// resourceTag returns the value of tag key of the network interface of
+// instance i, or of its volume, if the network interface has no such tag.
+func resourceTag(i instance, key string) (string, bool) {
+	if v, ok := i.networkInterface.tags[key]; ok {
+		return v, true
+	}
+	v, ok := i.volume.tags[key]
+	return v, ok
+}
+
+// firstString returns the first item of s or an empty string.
+func firstString(s []string) string {
+	if len(s) > 0 {
+		return s[0]
+	}
+	return ""
+}
+
+// subnetGateway returns the default gateway address of an IPv4 subnet, which
+// in a VPC is always the first host address of the subnet.
+func subnetGateway(cidr string) string {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return ""
+	}
+	ip := n.IP.To4()
+	if ip == nil {
+		return ""
+	}
+	gw := make(net.IP, len(ip))
+	copy(gw, ip)
+	gw[3]++
+	return gw.String()
+}
+
+// formatEnv renders vars in format f.
+func formatEnv(vars []envVar, f string) ([]byte, error) {
+	var b bytes.Buffer
+	switch f {
+	case envFormatSystemd:
+		for _, v := range vars {
+			fmt.Fprintf(&b, "%s=%s\n", v.key, quoteSystemd(v.value))
+		}
+	case envFormatShell:
+		for _, v := range vars {
+			fmt.Fprintf(&b, "export %s=%s\n", v.key, quoteShell(v.value))
+		}
+	case envFormatJSON:
+		m := make(map[string]string, len(vars))
+		for _, v := range vars {
+			m[v.key] = v.value
+		}
+		data, err := json.MarshalIndent(m, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		b.Write(data)
+		b.WriteString("\n")
+	default:
+		return nil, fmt.Errorf("unknown environment file format %q", f)
+	}
+	return b.Bytes(), nil
+}
+
+// quoteSystemd quotes s for a systemd EnvironmentFile, but only when needed,
+// so that simple values stay compatible with plain KEY=VALUE parsers.
+func quoteSystemd(s string) string {
+	if strings.ContainsAny(s, " \t\n\"'\\$") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// quoteShell quotes s using single quotes, so that a shell does not expand it.
+func quoteShell(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// writeEnvFiles writes all environment files fs and returns the last error if
+// any.
+func writeEnvFiles(fs []envFile, i instance) (err error) {
+	vars := envVars(i)
+	for _, f := range fs {
+		data, e := formatEnv(vars, f.format)
+		if e != nil {
+			logger.Error("Failed to format an environment file", "path", f.path, "error", e)
+			err = e
+			continue
+		}
+		if e := writeEnvFile(f.path, data); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
 // writeEnvFile writes an environment file f and returns an error if any. A
 // path to a file gets created as well.
-func writeEnvFile(f string, i instance) (err error) {
-	s := fmt.Sprintf("NODE_IP=%s\nNODE_ID=%s\nVOLUME_ID=%s\nNETWORK_INTERFACE_ID=%s\n",
-		i.networkInterface.IPAddress, i.nodeID, i.volume.id, i.networkInterface.id,
-	)
+func writeEnvFile(f string, data []byte) (err error) {
 	baseDir := path.Dir(f)
 	if _, err := os.Stat(baseDir); os.IsNotExist(err) {
 		err := os.MkdirAll(baseDir, 0755)
 		if err != nil {
-			log.Printf("Unable to create environment file path %q: %q.\n", baseDir, err)
+			logger.Error("Unable to create environment file path", "path", baseDir, "error", err)
 		}
 	}
-	if err := ioutil.WriteFile(f, []byte(s), 0644); err != nil {
-		log.Printf("Failed to write an environment file %q: %q.\n", f, err)
+	if err := writeFileAtomic(f, data, 0644); err != nil {
+		logger.Error("Failed to write an environment file", "path", f, "error", err)
 		return err
 	}
 	return nil
 }
+
+// writeFileAtomic writes data to a temporary file in the same directory as f
+// and then renames it to f, so that readers never see a partially written
+// file.
+func writeFileAtomic(f string, data []byte, perm os.FileMode) (err error) {
+	tmp, err := ioutil.TempFile(path.Dir(f), "."+path.Base(f))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	if _, err = tmp.Write(data); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Chmod(perm); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseEnvFiles(t *testing.T) {
+	tests := []struct {
+		s    string
+		want []envFile
+		err  bool
+	}{
+		{"", nil, false},
+		{"/run/smilodon/environment", []envFile{{"/run/smilodon/environment", envFormatSystemd}}, false},
+		{
+			" /run/env:shell , ,/run/env.json:json",
+			[]envFile{{"/run/env", envFormatShell}, {"/run/env.json", envFormatJSON}},
+			false,
+		},
+		// The format follows the last colon.
+		{"/run/a:b:systemd", []envFile{{"/run/a:b", envFormatSystemd}}, false},
+		{"/run/env.yaml:yaml", nil, true},
+		{"/run/env:", nil, true},
+		{":json", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseEnvFiles(tt.s)
+		if (err != nil) != tt.err {
+			t.Errorf("parseEnvFiles(%q) error = %v, want error %v", tt.s, err, tt.err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseEnvFiles(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestParseExportTags(t *testing.T) {
+	tests := []struct {
+		s    string
+		want []exportTag
+		err  bool
+	}{
+		{"", nil, false},
+		{
+			"Service=SERVICE_NAME, Env ,aws:cloudformation:stack-name",
+			[]exportTag{
+				{"Service", "SERVICE_NAME"},
+				{"Env", "TAG_ENV"},
+				{"aws:cloudformation:stack-name", "TAG_AWS_CLOUDFORMATION_STACK_NAME"},
+			},
+			false,
+		},
+		{"Role = role", []exportTag{{"Role", "role"}}, false},
+		{"Service=", nil, true},
+		{"=SERVICE", nil, true},
+		{"Service=SERVICE NAME", nil, true},
+		{"Service=1SERVICE", nil, true},
+		{"Service=SERVICE=NAME", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseExportTags(tt.s)
+		if (err != nil) != tt.err {
+			t.Errorf("parseExportTags(%q) error = %v, want error %v", tt.s, err, tt.err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseExportTags(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestFormatEnv(t *testing.T) {
+	vars := []envVar{
+		{"NODE_ID", "1"},
+		{"EMPTY", ""},
+		{"SPACES", "a b"},
+		{"COMMENT", "#not a comment"},
+		{"QUOTES", `it's "quoted"`},
+		{"SHELL", "$HOME `id` \\"},
+		{"NEWLINE", "a\nb"},
+	}
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{envFormatSystemd, `NODE_ID=1
+EMPTY=
+SPACES="a b"
+COMMENT="#not a comment"
+QUOTES="it's \"quoted\""
+SHELL="$HOME ` + "`id`" + ` \\"
+NEWLINE="a\nb"
+`},
+		{envFormatShell, `export NODE_ID='1'
+export EMPTY=''
+export SPACES='a b'
+export COMMENT='#not a comment'
+export QUOTES='it'\''s "quoted"'
+export SHELL='$HOME ` + "`id`" + ` \'
+export NEWLINE='a
+b'
+`},
+		{envFormatJSON, `{
+  "COMMENT": "#not a comment",
+  "EMPTY": "",
+  "NEWLINE": "a\nb",
+  "NODE_ID": "1",
+  "QUOTES": "it's \"quoted\"",
+  "SHELL": "$HOME ` + "`id`" + ` \\",
+  "SPACES": "a b"
+}
+`},
+	}
+	for _, tt := range tests {
+		got, err := formatEnv(vars, tt.format)
+		if err != nil {
+			t.Errorf("%s: formatEnv: %v", tt.format, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.format, got, tt.want)
+		}
+	}
+	if _, err := formatEnv(vars, "yaml"); err == nil {
+		t.Error("formatEnv accepted an unknown format")
+	}
+}
+
+// TestFormatEnvShell sources a shell environment file and checks that every
+// value reads back unchanged.
+func TestFormatEnvShell(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no shell")
+	}
+	vars := []envVar{
+		{"SPACES", "a  b"},
+		{"COMMENT", "# x"},
+		{"QUOTES", `it's "quoted"`},
+		{"SHELL", "$HOME `id` \\ $(id)"},
+		{"NEWLINE", "a\nb"},
+	}
+	data, err := formatEnv(vars, envFormatShell)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "smilodon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f := filepath.Join(dir, "environment")
+	if err := ioutil.WriteFile(f, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range vars {
+		out, err := exec.Command("sh", "-c", `. "$1" && printf %s "$`+v.key+`"`, "sh", f).Output()
+		if err != nil {
+			t.Errorf("%s: %v", v.key, err)
+			continue
+		}
+		if string(out) != v.value {
+			t.Errorf("%s: got %q, want %q", v.key, strings.TrimSpace(string(out)), v.value)
+		}
+	}
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Resource tags used to track and resume cross-AZ failovers.
+const (
+	tagHeartbeatAt      = "smilodon:heartbeat-at"
+	tagFailoverSnapshot = "smilodon:failover-snapshot"
+	tagFailoverVolume   = "smilodon:failover-volume"
+	tagFailoverIface    = "smilodon:failover-network-interface"
+	tagRetiredBy        = "smilodon:retired-by"
+	tagRetiredNodeID    = "smilodon:retired-node-id"
+)
+
+// lastHeartbeat is when the attached volume was last tagged with a heartbeat.
+var lastHeartbeat time.Time
+
+// heartbeat tags the volume attached to instance i with the current time, so
+// that instances in other AZs can tell how long it has been idle. It tags at
+// most four times per idle threshold. A heartbeat alone never lets a volume in
+// use be taken over, as it also lapses while its owner is paused or stuck.
+func heartbeat(i *instance) {
+	if !opts.crossAZFailover || i.volume == nil {
+		return
+	}
+	if time.Since(lastHeartbeat) < opts.crossAZIdle/4 {
+		return
+	}
+	if err := tagVolumeTimestamp(i.volume.id, tagHeartbeatAt, ec2c); err == nil {
+		lastHeartbeat = time.Now()
+	}
+}
+
+// needsFailover reports whether a NodeID of another AZ should be taken over,
+// given volumes vs discovered in the local AZ and the error discovering them.
+// It is only the case if discovery succeeded and found no available volume
+// for any NodeID, so that neither a transient API error, nor waiting for a
+// preferred NodeID, nor an attach race lost to a peer takes over a remote
+// volume.
+func needsFailover(vs []volume, discoverErr error) bool {
+	if discoverErr != nil {
+		return false
+	}
+	for _, v := range vs {
+		if v.available && v.nodeID != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// failover takes over a NodeID living in another AZ, when there is no pair
+// available in the AZ of instance i. The volume of the NodeID is snapshotted
+// and restored in the local AZ, the network interface is recreated in a local
+// subnet and the old resources are retired. Every step is guarded by a claim
+// of the old volume, so only one instance can take over a NodeID.
+func (i *instance) failover() error {
+	vs, err := findIdleRemoteVolumes(i)
+	if err != nil {
+		logger.Error("Failed to find volumes in other availability zones", "error", err)
+		return err
+	}
+	if len(vs) == 0 {
+		logger.Info("No idle volumes found in other availability zones")
+		return nil
+	}
+	for _, v := range vs {
+		err = i.failoverVolume(v)
+		if err == nil {
+			return nil
+		}
+		logger.Error("Failed to fail over volume", "volume_id", *v.VolumeId, "error", err)
+	}
+	return err
+}
+
+// findIdleRemoteVolumes returns volumes matching filters in availability
+// zones other than the one of instance i, which have been idle for longer
+// than the idle threshold. Volumes in use are only returned if the instance
+// they are attached to has stopped or is gone, as a lapsed heartbeat does not
+// mean that the volume is no longer mounted.
+func findIdleRemoteVolumes(i *instance) ([]*ec2.Volume, error) {
+	var f []*ec2.Filter
+	for _, filter := range filters {
+		if *filter.Name != "availability-zone" {
+			f = append(f, filter)
+		}
+	}
+	r, err := ec2c.DescribeVolumes(&ec2.DescribeVolumesInput{Filters: f})
+	if err != nil {
+		return nil, err
+	}
+	var vs []*ec2.Volume
+	for _, v := range r.Volumes {
+		if *v.AvailabilityZone == i.az {
+			continue
+		}
+		tags := tagsToMap(v.Tags)
+		if claimedByOther(tags, i.id) {
+			continue
+		}
+		if *v.State != ec2.VolumeStateAvailable && *v.State != ec2.VolumeStateInUse {
+			continue
+		}
+		if time.Since(lastUsed(volume{tags: tags})) < opts.crossAZIdle {
+			continue
+		}
+		if *v.State == ec2.VolumeStateInUse {
+			gone, err := attachedInstancesGone(v)
+			if err != nil {
+				return nil, err
+			}
+			if !gone {
+				continue
+			}
+		}
+		vs = append(vs, v)
+	}
+	sort.Sort(byEC2VolumeNodeID(vs))
+	return vs, nil
+}
+
+// attachedInstancesGone reports whether all instances volume v is attached
+// to are stopped, terminated or no longer exist.
+func attachedInstancesGone(v *ec2.Volume) (bool, error) {
+	var ids []*string
+	for _, a := range v.Attachments {
+		ids = append(ids, a.InstanceId)
+	}
+	if len(ids) == 0 {
+		return true, nil
+	}
+	r, err := ec2c.DescribeInstances(&ec2.DescribeInstancesInput{InstanceIds: ids})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "InvalidInstanceID.NotFound" {
+			return true, nil
+		}
+		return false, err
+	}
+	for _, res := range r.Reservations {
+		for _, inst := range res.Instances {
+			if inst.State == nil {
+				return false, nil
+			}
+			switch aws.StringValue(inst.State.Name) {
+			case ec2.InstanceStateNameStopped, ec2.InstanceStateNameTerminated, ec2.InstanceStateNameShuttingDown:
+			default:
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+type byEC2VolumeNodeID []*ec2.Volume
+
+func (v byEC2VolumeNodeID) Len() int      { return len(v) }
+func (v byEC2VolumeNodeID) Swap(i, j int) { v[i], v[j] = v[j], v[i] }
+func (v byEC2VolumeNodeID) Less(i, j int) bool {
+	return nodeIDLess(tagsToMap(v[i].Tags)["NodeID"], tagsToMap(v[j].Tags)["NodeID"])
+}
+
+// failoverVolume takes over the NodeID of volume v. Every created resource is
+// recorded in tags of v before anything else is done with it, so that a
+// failover interrupted at any step is resumed rather than started over.
+func (i *instance) failoverVolume(v *ec2.Volume) error {
+	oldID := *v.VolumeId
+	tags := tagsToMap(v.Tags)
+	nodeID := tags["NodeID"]
+	logger.Info("Failing over node ID", "node_id", nodeID, "volume_id", oldID, "from_az", *v.AvailabilityZone)
+
+	if err := i.claim(oldID, tags); err != nil {
+		return err
+	}
+
+	// Snapshot the old volume.
+	snapshotID := tags[tagFailoverSnapshot]
+	if snapshotID == "" {
+		s, err := ec2c.CreateSnapshot(&ec2.CreateSnapshotInput{
+			VolumeId:    aws.String(oldID),
+			Description: aws.String(fmt.Sprintf("smilodon failover of node ID %s", nodeID)),
+		})
+		if err != nil {
+			return err
+		}
+		snapshotID = *s.SnapshotId
+		logger.Info("Created snapshot", "snapshot_id", snapshotID, "volume_id", oldID)
+		if err := createTags(oldID, map[string]string{tagFailoverSnapshot: snapshotID}); err != nil {
+			return err
+		}
+	}
+	if err := createTags(snapshotID, copyableTags(tags)); err != nil {
+		return err
+	}
+	if err := i.verifyClaim(oldID); err != nil {
+		return err
+	}
+	logger.Info("Waiting for snapshot to complete", "snapshot_id", snapshotID)
+	if err := ec2c.WaitUntilSnapshotCompleted(&ec2.DescribeSnapshotsInput{
+		SnapshotIds: []*string{aws.String(snapshotID)},
+	}); err != nil {
+		return err
+	}
+
+	// Restore the snapshot in the local AZ. The new volume is claimed too,
+	// so that other local instances leave it alone until it is attached.
+	if err := i.verifyClaim(oldID); err != nil {
+		return err
+	}
+	newID := tags[tagFailoverVolume]
+	if newID == "" {
+		params := &ec2.CreateVolumeInput{
+			AvailabilityZone: aws.String(i.az),
+			SnapshotId:       aws.String(snapshotID),
+			VolumeType:       v.VolumeType,
+		}
+		if aws.StringValue(v.VolumeType) == ec2.VolumeTypeIo1 {
+			params.Iops = v.Iops
+		}
+		nv, err := ec2c.CreateVolume(params)
+		if err != nil {
+			return err
+		}
+		newID = *nv.VolumeId
+		logger.Info("Created volume from snapshot", "new_volume_id", newID, "snapshot_id", snapshotID)
+		if err := createTags(oldID, map[string]string{tagFailoverVolume: newID}); err != nil {
+			return err
+		}
+	}
+	newTags := copyableTags(tags)
+	newTags[tagClaim] = claimValue(i.id, time.Now())
+	if err := createTags(newID, newTags); err != nil {
+		return err
+	}
+	if err := ec2c.WaitUntilVolumeAvailable(&ec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(newID)},
+	}); err != nil {
+		return err
+	}
+
+	// Move the network interface into a local subnet.
+	if err := i.verifyClaim(oldID); err != nil {
+		return err
+	}
+	if opts.addressMode == addressModeNetworkInterface {
+		if err := i.failoverNetworkInterface(oldID, nodeID, tags[tagFailoverIface]); err != nil {
+			return err
+		}
+	}
+
+	// Retire the old volume, so that it no longer matches filters.
+	if err := i.verifyClaim(oldID); err != nil {
+		return err
+	}
+	if err := retire(oldID, nodeID, newID); err != nil {
+		return err
+	}
+
+	// Attaching the new volume releases its claim. If it fails, the volume is
+	// attached by a later run, as other instances leave it alone until the
+	// claim expires.
+	return i.attachVolume(volume{id: newID, nodeID: nodeID, available: true, tags: newTags}, ec2c)
+}
+
+// failoverNetworkInterface creates a network interface with NodeID nodeID in
+// the failover subnet, unless there already is one in the AZ of instance i,
+// and retires the network interface with the same NodeID in another AZ. The
+// created network interface is recorded in tags of volume volumeID. If one
+// has been recorded already as createdID, it is reused.
+func (i *instance) failoverNetworkInterface(volumeID, nodeID, createdID string) error {
+	r, err := ec2c.DescribeNetworkInterfaces(&ec2.DescribeNetworkInterfacesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("vpc-id"),
+				Values: []*string{aws.String(i.vpc)},
+			},
+			{
+				Name:   aws.String("tag:NodeID"),
+				Values: []*string{aws.String(nodeID)},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	var local, remote []*ec2.NetworkInterface
+	for _, n := range r.NetworkInterfaces {
+		if *n.AvailabilityZone == i.az {
+			local = append(local, n)
+		} else {
+			remote = append(remote, n)
+		}
+	}
+	// A network interface in the local AZ was either there before, or it was
+	// created by an interrupted failover, which has not retired the old one.
+	if len(local) > 0 {
+		newID := *local[0].NetworkInterfaceId
+		logger.Info("Network interface already exists", "eni_id", newID, "node_id", nodeID)
+		for _, n := range remote {
+			if err := retire(*n.NetworkInterfaceId, nodeID, newID); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if len(remote) == 0 {
+		return fmt.Errorf("no network interface with node ID %q found", nodeID)
+	}
+	old := remote[0]
+
+	newID := createdID
+	if newID == "" {
+		var groups []*string
+		for _, g := range old.Groups {
+			groups = append(groups, g.GroupId)
+		}
+		subnetID := opts.failoverSubnet
+		if subnetID == "" {
+			subnetID = i.subnetID
+		}
+		n, err := ec2c.CreateNetworkInterface(&ec2.CreateNetworkInterfaceInput{
+			SubnetId:    aws.String(subnetID),
+			Groups:      groups,
+			Description: old.Description,
+		})
+		if err != nil {
+			return err
+		}
+		newID = *n.NetworkInterface.NetworkInterfaceId
+		logger.Info("Created network interface", "eni_id", newID, "subnet_id", subnetID)
+		if err := createTags(volumeID, map[string]string{tagFailoverIface: newID}); err != nil {
+			return err
+		}
+	}
+	if err := createTags(newID, copyableTags(tagsToMap(old.TagSet))); err != nil {
+		return err
+	}
+	for _, n := range remote {
+		if err := retire(*n.NetworkInterfaceId, nodeID, newID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retire removes the NodeID tag of resource id, so that it no longer matches
+// filters, and records which resource replaced it.
+func retire(id, nodeID, replacementID string) error {
+	logger.Info("Retiring resource", "resource_id", id, "replaced_by", replacementID)
+	if err := createTags(id, map[string]string{
+		tagRetiredBy:     replacementID,
+		tagRetiredNodeID: nodeID,
+	}); err != nil {
+		return err
+	}
+	_, err := ec2c.DeleteTags(&ec2.DeleteTagsInput{
+		Resources: []*string{aws.String(id)},
+		Tags: []*ec2.Tag{
+			{Key: aws.String("NodeID")},
+			{Key: aws.String(tagClaim)},
+		},
+	})
+	return err
+}
+
+// unretire undoes retire of resource id, restoring its NodeID tag nodeID.
+func unretire(id, nodeID string) error {
+	logger.Info("Reinstating resource", "resource_id", id, "node_id", nodeID)
+	if err := createTags(id, map[string]string{"NodeID": nodeID}); err != nil {
+		return err
+	}
+	_, err := ec2c.DeleteTags(&ec2.DeleteTagsInput{
+		Resources: []*string{aws.String(id)},
+		Tags: []*ec2.Tag{
+			{Key: aws.String(tagRetiredBy)},
+			{Key: aws.String(tagRetiredNodeID)},
+		},
+	})
+	return err
+}
+
+// copyableTags returns tags, which should be copied to a replacement
+// resource. AWS reserved tags and smilodon bookkeeping tags are left out.
+func copyableTags(tags map[string]string) map[string]string {
+	c := make(map[string]string)
+	for k, v := range tags {
+		if strings.HasPrefix(k, "aws:") || strings.HasPrefix(k, "smilodon:") {
+			continue
+		}
+		c[k] = v
+	}
+	return c
+}
+
+// createTags tags resource id with tags.
+func createTags(id string, tags map[string]string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	var t []*ec2.Tag
+	for k, v := range tags {
+		t = append(t, &ec2.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+	_, err := ec2c.CreateTags(&ec2.CreateTagsInput{
+		Resources: []*string{aws.String(id)},
+		Tags:      t,
+	})
+	if err != nil {
+		logger.Error("Failed to tag resource", "resource_id", id, "error", err)
+	}
+	return err
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// stubFailover sets up a fake EC2 API holding NodeID 1, whose volume and
+// network interface live in eu-west-1a, and an instance in eu-west-1b without
+// a pair. It returns a function restoring the globals it replaces.
+func stubFailover(t *testing.T) (*fakeEC2, *instance, func()) {
+	savedOpts, savedEC2, savedFilters, savedSettle := opts, ec2c, filters, claimSettle
+	savedStrategy, savedState, savedIDs := strategy, lastState, preferredIDs
+
+	opts.crossAZFailover = true
+	opts.crossAZIdle = time.Hour
+	opts.addressMode = addressModeNetworkInterface
+	opts.strategy = "api"
+	opts.blockDevice = "/dev/xvdf"
+	opts.failoverSubnet = ""
+	opts.filters = "tag:Service=etcd"
+	claimSettle = 0
+	strategy = apiStrategy{}
+	lastState = nil
+	preferredIDs = nil
+
+	f := newFakeEC2()
+	f.subnets["subnet-a"] = "eu-west-1a"
+	f.subnets["subnet-b"] = "eu-west-1b"
+	f.instances["i-old"] = ec2.InstanceStateNameTerminated
+	f.instances["i-local"] = ec2.InstanceStateNameRunning
+	f.instances["i-other"] = ec2.InstanceStateNameRunning
+	idle := time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339)
+	f.addVolume("vol-old", "eu-west-1a", map[string]string{"NodeID": "1", "Service": "etcd", tagDetachedAt: idle})
+	f.addENI("eni-old", "subnet-a", "10.0.1.10", map[string]string{"NodeID": "1", "Service": "etcd"})
+	ec2c = f
+
+	i := &instance{id: "i-local", az: "eu-west-1b", vpc: "vpc-1", subnetID: "subnet-b"}
+	filters = buildFilters(*i)
+
+	return f, i, func() {
+		opts, ec2c, filters, claimSettle = savedOpts, savedEC2, savedFilters, savedSettle
+		strategy, lastState, preferredIDs = savedStrategy, savedState, savedIDs
+	}
+}
+
+// checkFailedOver checks that NodeID 1 has been taken over by instance i
+// exactly once.
+func checkFailedOver(t *testing.T, f *fakeEC2, i *instance) {
+	if n := f.count("CreateSnapshot"); n != 1 {
+		t.Errorf("got %d snapshots, want 1", n)
+	}
+	if n := f.count("CreateVolume"); n != 1 {
+		t.Errorf("got %d volumes created, want 1", n)
+	}
+	if n := f.count("CreateNetworkInterface"); n != 1 {
+		t.Errorf("got %d network interfaces created, want 1", n)
+	}
+	if i.volume == nil {
+		t.Fatal("no volume attached")
+	}
+	newID := i.volume.id
+	if v := f.volumes[newID]; v.az != "eu-west-1b" || v.attachedTo != "i-local" {
+		t.Errorf("new volume is in %q attached to %q, want eu-west-1b attached to i-local", v.az, v.attachedTo)
+	}
+	if tags := f.tags[newID]; tags["NodeID"] != "1" || tags["Service"] != "etcd" || tags[tagClaim] != "" {
+		t.Errorf("new volume has tags %v, want NodeID and Service without a claim", tags)
+	}
+	if tags := f.tags["vol-old"]; tags["NodeID"] != "" || tags[tagClaim] != "" || tags[tagRetiredBy] != newID || tags[tagRetiredNodeID] != "1" {
+		t.Errorf("old volume has tags %v, want it retired by %s", tags, newID)
+	}
+	var enis []string
+	for id, n := range f.enis {
+		if f.tags[id]["NodeID"] == "1" {
+			enis = append(enis, id)
+			if n.az != "eu-west-1b" || f.tags[id]["Service"] != "etcd" {
+				t.Errorf("network interface %s is in %q with tags %v", id, n.az, f.tags[id])
+			}
+		}
+	}
+	if len(enis) != 1 {
+		t.Errorf("got network interfaces %v with NodeID 1, want exactly one", enis)
+	}
+	if tags := f.tags["eni-old"]; tags[tagRetiredBy] == "" || tags[tagRetiredNodeID] != "1" {
+		t.Errorf("old network interface has tags %v, want it retired", tags)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	f, i, restore := stubFailover(t)
+	defer restore()
+
+	if err := i.failover(); err != nil {
+		t.Fatalf("failover: %v", err)
+	}
+	checkFailedOver(t, f, i)
+	for id := range f.snapshots {
+		if f.tags[id]["NodeID"] != "1" {
+			t.Errorf("snapshot %s has tags %v, want NodeID 1", id, f.tags[id])
+		}
+	}
+}
+
+func TestFindIdleRemoteVolumes(t *testing.T) {
+	recent := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	tests := []struct {
+		name string
+		// setup changes vol-old.
+		setup func(f *fakeEC2)
+		want  bool
+	}{
+		{"available and idle", func(f *fakeEC2) {}, true},
+		{"recently detached", func(f *fakeEC2) {
+			f.tags["vol-old"][tagDetachedAt] = recent
+		}, false},
+		{"in use by a running instance with a lapsed heartbeat", func(f *fakeEC2) {
+			f.attach("vol-old", "i-other")
+		}, false},
+		{"in use by a running instance with a recent heartbeat", func(f *fakeEC2) {
+			f.attach("vol-old", "i-other")
+			f.tags["vol-old"][tagHeartbeatAt] = recent
+		}, false},
+		{"in use by a stopped instance", func(f *fakeEC2) {
+			f.instances["i-other"] = ec2.InstanceStateNameStopped
+			f.attach("vol-old", "i-other")
+		}, true},
+		{"in use by a stopping instance", func(f *fakeEC2) {
+			f.instances["i-other"] = ec2.InstanceStateNameStopping
+			f.attach("vol-old", "i-other")
+		}, false},
+		{"in use by a terminated instance", func(f *fakeEC2) {
+			f.attach("vol-old", "i-old")
+		}, true},
+		{"in use by an instance, which no longer exists", func(f *fakeEC2) {
+			f.attach("vol-old", "i-gone")
+		}, true},
+		{"claimed by another instance", func(f *fakeEC2) {
+			f.tags["vol-old"][tagClaim] = claimValue("i-other", time.Now())
+		}, false},
+		{"in the local AZ", func(f *fakeEC2) {
+			f.volumes["vol-old"].az = "eu-west-1b"
+		}, false},
+		{"not matching filters", func(f *fakeEC2) {
+			f.tags["vol-old"]["Service"] = "zookeeper"
+		}, false},
+	}
+	for _, tt := range tests {
+		f, i, restore := stubFailover(t)
+		tt.setup(f)
+		vs, err := findIdleRemoteVolumes(i)
+		restore()
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := len(vs) == 1; got != tt.want {
+			t.Errorf("%s: got idle %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestClaim(t *testing.T) {
+	f, i, restore := stubFailover(t)
+	defer restore()
+	other := &instance{id: "i-other"}
+	stale := copyTags(f.tags["vol-old"])
+
+	// Instance i-other claims the volume while i-local waits for competing
+	// claims to land, so its claim wins.
+	f.afterCreateTags = func(id string, tags map[string]string) {
+		if id == "vol-old" && strings.HasPrefix(tags[tagClaim], "i-local/") {
+			f.afterCreateTags = nil
+			if err := other.claim("vol-old", stale); err != nil {
+				t.Errorf("competing claim: %v", err)
+			}
+		}
+	}
+	if err := i.claim("vol-old", stale); err != errClaimLost {
+		t.Errorf("got %v for a concurrent claim, want %v", err, errClaimLost)
+	}
+	if holder, _, _ := parseClaim(f.tags["vol-old"][tagClaim]); holder != "i-other" {
+		t.Errorf("claim is held by %q, want i-other", holder)
+	}
+
+	// A valid claim of another instance is respected.
+	if err := i.claim("vol-old", copyTags(f.tags["vol-old"])); err != errClaimed {
+		t.Errorf("got %v for a claimed volume, want %v", err, errClaimed)
+	}
+	if err := i.verifyClaim("vol-old"); err != errClaimLost {
+		t.Errorf("got %v verifying a claim of another instance, want %v", err, errClaimLost)
+	}
+
+	// An expired claim is taken over.
+	f.tags["vol-old"][tagClaim] = claimValue("i-other", time.Now().Add(-claimTTL-time.Minute))
+	if err := i.claim("vol-old", copyTags(f.tags["vol-old"])); err != nil {
+		t.Errorf("claiming over an expired claim: %v", err)
+	}
+	if holder, _, _ := parseClaim(f.tags["vol-old"][tagClaim]); holder != "i-local" {
+		t.Errorf("claim is held by %q, want i-local", holder)
+	}
+	if err := other.verifyClaim("vol-old"); err != errClaimLost {
+		t.Errorf("got %v verifying a claim taken over, want %v", err, errClaimLost)
+	}
+}
+
+func TestFailoverLosesClaim(t *testing.T) {
+	f, i, restore := stubFailover(t)
+	defer restore()
+
+	// Another instance takes over the claim once the snapshot is recorded.
+	f.afterCreateTags = func(id string, tags map[string]string) {
+		if id == "vol-old" && tags[tagFailoverSnapshot] != "" {
+			f.tags["vol-old"][tagClaim] = claimValue("i-other", time.Now())
+		}
+	}
+	if err := i.failover(); err != errClaimLost {
+		t.Fatalf("got %v, want %v", err, errClaimLost)
+	}
+	if n := f.count("CreateVolume"); n != 0 {
+		t.Errorf("created %d volumes without holding the claim", n)
+	}
+	if i.volume != nil {
+		t.Errorf("attached volume %q without holding the claim", i.volume.id)
+	}
+}
+
+func TestFailoverResume(t *testing.T) {
+	isNew := func(id, prefix string) bool {
+		return strings.HasPrefix(id, prefix+"-") && !strings.HasSuffix(id, "-old")
+	}
+	tests := []struct {
+		name string
+		fail func(op, id string) bool
+	}{
+		{"snapshot recorded", func(op, id string) bool {
+			return op == "WaitUntilSnapshotCompleted"
+		}},
+		{"snapshot not tagged", func(op, id string) bool {
+			return op == "CreateTags" && isNew(id, "snap")
+		}},
+		{"volume recorded", func(op, id string) bool {
+			return op == "CreateTags" && isNew(id, "vol")
+		}},
+		{"volume not available yet", func(op, id string) bool {
+			return op == "WaitUntilVolumeAvailable"
+		}},
+		{"network interface recorded", func(op, id string) bool {
+			return op == "CreateTags" && isNew(id, "eni")
+		}},
+		{"old network interface not retired", func(op, id string) bool {
+			return op == "DeleteTags" && id == "eni-old"
+		}},
+		{"old volume not retired", func(op, id string) bool {
+			return op == "DeleteTags" && id == "vol-old"
+		}},
+	}
+	for _, tt := range tests {
+		f, i, restore := stubFailover(t)
+		var failed bool
+		f.failOn = func(op, id string) error {
+			if !failed && tt.fail(op, id) {
+				failed = true
+				return errors.New("interrupted")
+			}
+			return nil
+		}
+		if err := i.failover(); err == nil || !failed {
+			t.Errorf("%s: got %v, want the failover interrupted", tt.name, err)
+		}
+		if err := i.failover(); err != nil {
+			t.Errorf("%s: resuming: %v", tt.name, err)
+		} else {
+			checkFailedOver(t, f, i)
+		}
+		restore()
+	}
+}
+
+// TestFailoverResumeAttach checks that a volume taken over, but not attached
+// because of an interruption, is picked up by the instance, which took it
+// over, rather than by another one.
+func TestFailoverResumeAttach(t *testing.T) {
+	f, i, restore := stubFailover(t)
+	defer restore()
+	f.failOn = func(op, id string) error {
+		if op == "AttachVolume" {
+			return errors.New("interrupted")
+		}
+		return nil
+	}
+	if err := i.failover(); err == nil {
+		t.Fatal("failover succeeded, want it interrupted")
+	}
+	f.failOn = nil
+
+	if vs, err := findIdleRemoteVolumes(i); err != nil || len(vs) != 0 {
+		t.Errorf("got remote volumes %v, %v, want none", vs, err)
+	}
+	vs, err := findVolumes(i, ec2c, filters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := candidateVolumes(vs, nil, "i-other"); len(got) != 0 {
+		t.Errorf("another instance got candidates %v, want none", got)
+	}
+	got := candidateVolumes(vs, nil, "i-local")
+	if len(got) != 1 || got[0].nodeID != "1" {
+		t.Fatalf("got candidates %v, want the new volume", got)
+	}
+	if err := i.attachVolume(got[0], ec2c); err != nil {
+		t.Fatal(err)
+	}
+	checkFailedOver(t, f, i)
+}
+
+func TestRunFailoverGate(t *testing.T) {
+	tests := []struct {
+		name string
+		// setup changes the fake EC2 API and instance before the run.
+		setup    func(f *fakeEC2, i *instance)
+		failover bool
+	}{
+		{"no local volumes", func(f *fakeEC2, i *instance) {}, true},
+		{"volumes cannot be listed", func(f *fakeEC2, i *instance) {
+			var calls int
+			f.failOn = func(op, id string) error {
+				// Only discovery fails, looking for remote volumes would not.
+				if op == "DescribeVolumes" {
+					if calls++; calls == 1 {
+						return errors.New("RequestLimitExceeded")
+					}
+				}
+				return nil
+			}
+		}, false},
+		{"waiting for a preferred NodeID", func(f *fakeEC2, i *instance) {
+			f.addVolume("vol-2", "eu-west-1b", map[string]string{"NodeID": "2", "Service": "etcd"})
+			preferredIDs = []string{"3"}
+			opts.preferredTimeout = time.Hour
+		}, false},
+		{"attach race lost to a peer", func(f *fakeEC2, i *instance) {
+			f.addVolume("vol-2", "eu-west-1b", map[string]string{"NodeID": "2", "Service": "etcd"})
+			f.failOn = func(op, id string) error {
+				if op == "AttachVolume" && id == "vol-2" {
+					f.volumes[id].state = ec2.VolumeStateInUse
+					return errors.New("VolumeInUse")
+				}
+				return nil
+			}
+		}, false},
+	}
+	for _, tt := range tests {
+		f, i, restore := stubFailover(t)
+		opts.stateFile = ""
+		opts.daemon = true
+		tt.setup(f, i)
+		run(i)
+		if got := f.count("CreateSnapshot") > 0; got != tt.failover {
+			t.Errorf("%s: got failover %v, want %v", tt.name, got, tt.failover)
+		}
+		restore()
+	}
+}
@@ -1,74 +1,390 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"syscall"
 )
 
-// hasFs checks if d has a file system created and returns a bool.
-func hasFs(d, f string) bool {
-	o, err := exec.Command("/usr/bin/lsblk", "-n", "-o", "FSTYPE", d).Output()
+// fsDriver describes how to create, check, grow and mount a file system type.
+type fsDriver struct {
+	// mkfsArgs are passed to mkfs.<type> before user arguments.
+	mkfsArgs []string
+	// labelFlag is the mkfs flag setting a label, if supported.
+	labelFlag string
+	// labelMax is the maximum label length.
+	labelMax int
+	// check is a command checking a file system without mounting it. The
+	// device is appended to it.
+	check []string
+	// checkMaxExit is the highest exit code of check, which means the file
+	// system is fine, for example because errors have been corrected.
+	checkMaxExit int
+	// grow returns a command growing a file system on device d mounted at
+	// mount point p to the size of the device.
+	grow func(d, p string) []string
+	// mountOptions are default mount options.
+	mountOptions string
+}
+
+// extDriver is a driver of ext3 and ext4 file systems.
+var extDriver = fsDriver{
+	mkfsArgs:     []string{"-q"},
+	labelFlag:    "-L",
+	labelMax:     16,
+	check:        []string{"e2fsck", "-p"},
+	checkMaxExit: 1,
+	grow:         func(d, p string) []string { return []string{"resize2fs", d} },
+	mountOptions: "noatime",
+}
+
+// fsDrivers are file system drivers by file system type. Other file system
+// types can only be created and mounted.
+var fsDrivers = map[string]fsDriver{
+	"ext3": extDriver,
+	"ext4": extDriver,
+	"xfs": {
+		mkfsArgs:     []string{"-q"},
+		labelFlag:    "-L",
+		labelMax:     12,
+		check:        []string{"xfs_repair", "-n"},
+		grow:         func(d, p string) []string { return []string{"xfs_growfs", p} },
+		mountOptions: "noatime",
+	},
+	"btrfs": {
+		labelFlag:    "-L",
+		labelMax:     255,
+		check:        []string{"btrfs", "check", "--readonly"},
+		grow:         func(d, p string) []string { return []string{"btrfs", "filesystem", "resize", "max", p} },
+		mountOptions: "noatime",
+	},
+}
+
+// lookBin returns the path of binary name. Directories given by --bin-path
+// are searched first, then $PATH. If name is not found, it is returned as is
+// and running it fails with a descriptive error. Host binaries are looked up
+// with --host-exec=nsenter.
+func lookBin(name string) string {
+	for _, dir := range filepath.SplitList(opts.binPath) {
+		p := filepath.Join(dir, name)
+		hp := p
+		if opts.hostExec == hostExecNsenter {
+			hp = hostPath(p)
+		}
+		if fi, err := os.Stat(hp); err == nil && !fi.IsDir() && fi.Mode()&0111 != 0 {
+			return p
+		}
+	}
+	if opts.hostExec == hostExecNsenter {
+		return name
+	}
+	if p, err := exec.LookPath(name); err == nil {
+		return p
+	}
+	return name
+}
+
+// command returns a command running binary args[0], looked up by lookBin,
+// with the rest of args. With --host-exec=nsenter, it runs in the mount
+// namespace of the host.
+func command(args ...string) *exec.Cmd {
+	if opts.hostExec == hostExecNsenter {
+		return hostCommand(lookBin(args[0]), args[1:]...)
+	}
+	return exec.Command(lookBin(args[0]), args[1:]...)
+}
+
+// fsLabel returns a file system label of type t for NodeID nodeID, or an empty
+// string if labels are disabled or not supported.
+func fsLabel(t, nodeID string) string {
+	drv := fsDrivers[t]
+	if opts.fsLabel == "" || drv.labelFlag == "" || nodeID == "" {
+		return ""
+	}
+	label := fmt.Sprintf(opts.fsLabel, nodeID)
+	if len(label) > drv.labelMax {
+		label = label[:drv.labelMax]
+	}
+	return label
+}
+
+// deviceState is what a block device holds according to probeDevice.
+type deviceState int
+
+const (
+	// deviceUnknown means the device could not be probed.
+	deviceUnknown deviceState = iota
+	// deviceEmpty means the device has no partitions and no signatures.
+	deviceEmpty
+	// deviceFormatted means the device holds a file system of the expected
+	// type on the whole device.
+	deviceFormatted
+	// deviceForeign means the device holds anything else: partitions, another
+	// file system, or other signatures such as LVM or RAID metadata.
+	deviceForeign
+)
+
+// errDeviceFormatted is returned when refusing to format a device, which
+// already has a file system.
+var errDeviceFormatted = errors.New("device already has a file system")
+
+// foreignDeviceError is returned by probeDevice for a device holding data
+// smilodon does not know about.
+type foreignDeviceError struct {
+	device string
+	reason string
+}
+
+func (e *foreignDeviceError) Error() string {
+	return fmt.Sprintf("device %s holds foreign data: %s", e.device, e.reason)
+}
+
+// probeDevice probes device d and its partitions for signatures and tells
+// whether it is empty, formatted with file system f, or holds foreign data.
+// It returns an error unless the device is empty or formatted.
+func probeDevice(d, f string) (deviceState, error) {
+	parts, err := devicePartitions(d)
+	if err != nil {
+		return deviceUnknown, err
+	}
+	for _, p := range parts {
+		sig, err := probeSignature(p)
+		if err != nil {
+			return deviceUnknown, err
+		}
+		if sig != "" {
+			return deviceForeign, &foreignDeviceError{d, fmt.Sprintf("partition %s has a %s signature", p, sig)}
+		}
+	}
+	if len(parts) > 0 {
+		return deviceForeign, &foreignDeviceError{d, fmt.Sprintf("%d partitions", len(parts))}
+	}
+
+	sig, err := probeSignature(d)
+	if err != nil {
+		return deviceUnknown, err
+	}
+	if sig == f {
+		return deviceFormatted, nil
+	}
+	if sig != "" {
+		return deviceForeign, &foreignDeviceError{d, fmt.Sprintf("a %s signature instead of %s", sig, f)}
+	}
+
+	// blkid reports a single signature only, so check with wipefs, which
+	// lists all of them, that there really is nothing on the device.
+	o, err := command("wipefs", "-n", cmdPath(d)).Output()
+	if err != nil {
+		return deviceUnknown, fmt.Errorf("failed to list signatures of %s: %v", d, err)
+	}
+	if strings.TrimSpace(string(o)) != "" {
+		return deviceForeign, &foreignDeviceError{d, "signatures found by wipefs"}
+	}
+	return deviceEmpty, nil
+}
+
+// probeSignature returns the file system or partition table type of device d
+// using low-level blkid probing, or an empty string if there is none.
+func probeSignature(d string) (string, error) {
+	vars, err := blkidProbe(d)
+	if err != nil || vars == nil {
+		return "", err
+	}
+	if t := vars["PTTYPE"]; t != "" {
+		return t + " partition table", nil
+	}
+	if t := vars["TYPE"]; t != "" {
+		return t, nil
+	}
+	return "unknown", nil
+}
+
+// blkidProbe returns low-level blkid probe values of device d, such as TYPE,
+// PTTYPE and LABEL, or nil values if nothing was found.
+func blkidProbe(d string) (map[string]string, error) {
+	o, err := command("blkid", "-p", "-o", "export", cmdPath(d)).Output()
+	if e, ok := err.(*exec.ExitError); ok {
+		if s, ok := e.Sys().(syscall.WaitStatus); ok {
+			switch s.ExitStatus() {
+			case 2:
+				// Nothing found.
+				return nil, nil
+			case 8:
+				return map[string]string{"TYPE": "ambivalent"}, nil
+			}
+		}
+	}
 	if err != nil {
-		log.Printf("Failed to read file system type of %q: %q.\n", d, err)
-		// Return true here just to be on the safe side
-		// FIXME: I think the process should exit here?
-		return true
+		return nil, fmt.Errorf("failed to probe %s: %v", d, err)
+	}
+	vars := make(map[string]string)
+	for _, line := range strings.Split(string(o), "\n") {
+		if kv := strings.SplitN(line, "=", 2); len(kv) == 2 {
+			vars[kv[0]] = kv[1]
+		}
+	}
+	return vars, nil
+}
+
+// devicePartitions returns device paths of partitions of device d, as listed
+// in sysfs. d may be a symlink, for example to an NVMe device.
+func devicePartitions(d string) ([]string, error) {
+	if _, err := os.Stat(hostPath(d)); err != nil {
+		return nil, err
 	}
-	fs := strings.Trim(string(o), "\n")
-	if fs == f {
-		return true
+	dev := resolveHostPath(d)
+	name := filepath.Base(dev)
+	entries, err := ioutil.ReadDir(hostPath(filepath.Join("/sys/class/block", name)))
+	if err != nil {
+		return nil, err
 	}
-	if fs == "" {
-		return false
+	var parts []string
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), name) {
+			continue
+		}
+		if _, err := os.Stat(hostPath(filepath.Join("/sys/class/block", name, e.Name(), "partition"))); err == nil {
+			parts = append(parts, filepath.Join(filepath.Dir(dev), e.Name()))
+		}
 	}
-	log.Printf("Device %q appears to have a %q file system. However specified file system is %q.\n", d, fs, f)
-	return true
+	return parts, nil
 }
 
-// mkfs creates file system f on device d.
-func mkfs(d, f string) error {
-	mkfsCmd := "/usr/sbin/mkfs." + f
-	cmd := exec.Command(mkfsCmd, "-q", d)
-	err := cmd.Run()
+// mkfs creates file system f with label on device d. Driver arguments come
+// first, then --mkfs-args. It refuses to format anything, but a device which
+// has been verified to be empty.
+func mkfs(d, f, label string) error {
+	if state, err := probeDevice(d, f); state != deviceEmpty {
+		if err == nil {
+			err = errDeviceFormatted
+		}
+		logger.Error("Refusing to create file system", "fs_type", f, "device", d, "error", err)
+		return err
+	}
+	drv := fsDrivers[f]
+	args := append([]string{"mkfs." + f}, drv.mkfsArgs...)
+	if label != "" {
+		args = append(args, drv.labelFlag, label)
+	}
+	args = append(args, strings.Fields(opts.mkfsArgs)...)
+	args = append(args, cmdPath(d))
+	o, err := command(args...).CombinedOutput()
 	if err != nil {
-		log.Printf("Failed to create %q file system on %q device: %q.\n", f, d, err)
+		logger.Error("Failed to create file system", "fs_type", f, "device", d, "error", err, "output", strings.TrimSpace(string(o)))
+		return err
+	}
+	logger.Info("Successfully formatted device", "device", d, "fs_type", f)
+	return nil
+}
+
+// checkFs checks file system f on unmounted device d.
+func checkFs(d, f string) error {
+	drv := fsDrivers[f]
+	if len(drv.check) == 0 {
+		return nil
+	}
+	logger.Info("Checking file system", "fs_type", f, "device", d)
+	o, err := command(append(drv.check, cmdPath(d))...).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	if e, ok := err.(*exec.ExitError); ok {
+		if s, ok := e.Sys().(syscall.WaitStatus); ok && s.ExitStatus() <= drv.checkMaxExit {
+			logger.Warn("Corrected file system errors", "fs_type", f, "device", d, "output", strings.TrimSpace(string(o)))
+			return nil
+		}
+	}
+	logger.Error("File system check failed", "device", d, "error", err, "output", strings.TrimSpace(string(o)))
+	return err
+}
+
+// growFs grows file system f on device d mounted at mount point p to the
+// size of the device, for example after the volume has been enlarged.
+func growFs(d, p, f string) error {
+	drv := fsDrivers[f]
+	if drv.grow == nil {
+		return nil
+	}
+	o, err := command(drv.grow(cmdPath(d), cmdPath(p))...).CombinedOutput()
+	if err != nil {
+		logger.Error("Failed to grow file system", "fs_type", f, "device", d, "error", err, "output", strings.TrimSpace(string(o)))
 		return err
 	}
-	log.Printf("Successfully formatted device %q with file system %q.\n", d, f)
 	return nil
 }
 
 // mount mounts device d with file system type t to mount point p and returns an error if any.
 func mount(d, p, t string) (err error) {
-	if _, err := os.Stat(p); os.IsNotExist(err) {
-		log.Printf("Mount point %q does not exist. Creating %q.\n", p, p)
-		if err := os.MkdirAll(p, 0750); err != nil {
-			log.Printf("Failed to create the mount path: %q.\n", err)
+	if _, err := os.Stat(hostPath(p)); os.IsNotExist(err) {
+		logger.Info("Mount point does not exist, creating it", "mount_point", p)
+		if err := os.MkdirAll(hostPath(p), 0750); err != nil {
+			logger.Error("Failed to create the mount point", "mount_point", p, "error", err)
 			return err
 		}
 	}
-	log.Printf("Mounting %q to %q.\n", d, p)
-	cmd := exec.Command("/usr/bin/mount", "-t", t, d, p)
-	o, err := cmd.CombinedOutput()
+	logger.Info("Mounting device", "device", d, "mount_point", p)
+	args := []string{"mount", "-t", t}
+	options := opts.mountOptions
+	if options == "" {
+		options = fsDrivers[t].mountOptions
+	}
+	if options != "" {
+		args = append(args, "-o", options)
+	}
+	o, err := command(append(args, cmdPath(d), cmdPath(p))...).CombinedOutput()
 	if err != nil {
-		log.Printf("Mount failed: %q to %q: %q.\n", d, p, string(o))
+		logger.Error("Mount failed", "device", d, "mount_point", p, "output", strings.TrimSpace(string(o)))
 		return err
 	}
-	log.Printf("Successfully mounted device %q to %q.\n", d, p)
+	logger.Info("Successfully mounted device", "device", d, "mount_point", p)
 	return nil
 }
 
-// isMounted checks if device d is mounted. It returns a boolean
+// isMounted checks if device d is mounted. It returns a boolean. Symlinks
+// are resolved, so that for example /dev/vg/lv matches /dev/mapper/vg-lv.
 func isMounted(d string) bool {
-	v, err := ioutil.ReadFile("/proc/mounts")
+	v, err := ioutil.ReadFile(mountsFile())
 	if err != nil {
-		log.Printf("Failed to read mounts information from /proc/mounts: %q.\n", err)
+		logger.Error("Failed to read mounts information", "path", mountsFile(), "error", err)
 	}
-	if strings.Contains(string(v), d+" ") {
-		return true
+	d = resolveHostPath(d)
+	for _, line := range strings.Split(string(v), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if resolveHostPath(mountSource(fields[0])) == d {
+			return true
+		}
 	}
 	return false
 }
+
+// isMountPoint checks if something is mounted at mount point p.
+func isMountPoint(p string) bool {
+	v, err := ioutil.ReadFile(mountsFile())
+	if err != nil {
+		logger.Error("Failed to read mounts information", "path", mountsFile(), "error", err)
+	}
+	for _, line := range strings.Split(string(v), "\n") {
+		if fields := strings.Fields(line); len(fields) > 1 && fields[1] == p {
+			return true
+		}
+	}
+	return false
+}
+
+// unmount unmounts mount point p and returns an error if any.
+func unmount(p string) error {
+	o, err := command("umount", cmdPath(p)).CombinedOutput()
+	if err != nil {
+		logger.Error("Unmount failed", "mount_point", p, "output", strings.TrimSpace(string(o)))
+		return err
+	}
+	return nil
+}
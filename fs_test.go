@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeCmd is what a stubbed command prints and exits with.
+type fakeCmd struct {
+	out  string
+	exit int
+}
+
+// stubCommands creates a --bin-path below host root root with a script for
+// each command in cmds, keyed by the base name of the last argument, for
+// example a device or a mount point. "*" matches any other argument and
+// commands exit with 0 by default. Every call is appended to root/calls.
+func stubCommands(t *testing.T, root string, cmds map[string]map[string]fakeCmd) {
+	bin := filepath.Join(root, "bin")
+	if err := os.MkdirAll(bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	opts.binPath = bin
+	for name, byArg := range cmds {
+		script := "#!/bin/sh\n" +
+			fmt.Sprintf("echo %s \"$@\" >> '%s'\n", name, filepath.Join(root, "calls")) +
+			"for last; do :; done\n" +
+			"case \"${last##*/}\" in\n"
+		for arg, c := range byArg {
+			if arg != "*" {
+				script += fmt.Sprintf("%s) printf '%%s' '%s'; exit %d;;\n", arg, c.out, c.exit)
+			}
+		}
+		if c, ok := byArg["*"]; ok {
+			script += fmt.Sprintf("*) printf '%%s' '%s'; exit %d;;\n", c.out, c.exit)
+		}
+		script += "esac\n"
+		if err := ioutil.WriteFile(filepath.Join(bin, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// stubCalls returns the commands run so far with host root root removed from
+// their arguments.
+func stubCalls(root string) []string {
+	data, _ := ioutil.ReadFile(filepath.Join(root, "calls"))
+	s := strings.TrimSpace(strings.Replace(string(data), root, "", -1))
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+func TestProbeDevice(t *testing.T) {
+	tests := []struct {
+		name string
+		// sysfs lists entries of /sys/class/block/xvdf, with partitions
+		// holding a partition file. A nil sysfs has no such directory.
+		sysfs      []string
+		partitions []string
+		blkid      map[string]fakeCmd
+		wipefs     map[string]fakeCmd
+		want       deviceState
+		reason     string
+		err        bool
+	}{
+		{
+			name:   "empty",
+			sysfs:  []string{"holders"},
+			blkid:  map[string]fakeCmd{"*": {exit: 2}},
+			wipefs: map[string]fakeCmd{"*": {}},
+			want:   deviceEmpty,
+		},
+		{
+			name:  "formatted",
+			sysfs: []string{},
+			blkid: map[string]fakeCmd{"xvdf": {out: "DEVNAME=/dev/xvdf\nLABEL=data\nTYPE=ext4\n"}},
+			want:  deviceFormatted,
+		},
+		{
+			name:   "another file system",
+			sysfs:  []string{},
+			blkid:  map[string]fakeCmd{"xvdf": {out: "TYPE=xfs\n"}},
+			want:   deviceForeign,
+			reason: "a xfs signature instead of ext4",
+		},
+		{
+			name:   "partition table",
+			sysfs:  []string{},
+			blkid:  map[string]fakeCmd{"xvdf": {out: "PTUUID=1234\nPTTYPE=gpt\n"}},
+			want:   deviceForeign,
+			reason: "a gpt partition table signature instead of ext4",
+		},
+		{
+			name:   "signature of unknown type",
+			sysfs:  []string{},
+			blkid:  map[string]fakeCmd{"xvdf": {out: "UUID=1234\n"}},
+			want:   deviceForeign,
+			reason: "a unknown signature instead of ext4",
+		},
+		{
+			name:   "ambivalent signatures",
+			sysfs:  []string{},
+			blkid:  map[string]fakeCmd{"xvdf": {exit: 8}},
+			want:   deviceForeign,
+			reason: "a ambivalent signature instead of ext4",
+		},
+		{
+			// blkid finds nothing, but wipefs does, for example a signature at
+			// the end of the device.
+			name:   "signatures found by wipefs only",
+			sysfs:  []string{},
+			blkid:  map[string]fakeCmd{"xvdf": {exit: 2}},
+			wipefs: map[string]fakeCmd{"xvdf": {out: "DEVICE OFFSET TYPE UUID LABEL\nxvdf 0x1fffffe00 linux_raid_member\n"}},
+			want:   deviceForeign,
+			reason: "signatures found by wipefs",
+		},
+		{
+			name:   "wipefs fails",
+			sysfs:  []string{},
+			blkid:  map[string]fakeCmd{"xvdf": {exit: 2}},
+			wipefs: map[string]fakeCmd{"xvdf": {exit: 1}},
+			want:   deviceUnknown,
+			err:    true,
+		},
+		{
+			name:  "blkid fails",
+			sysfs: []string{},
+			blkid: map[string]fakeCmd{"xvdf": {exit: 4}},
+			want:  deviceUnknown,
+			err:   true,
+		},
+		{
+			name:       "empty partition",
+			sysfs:      []string{"holders", "xvdf1"},
+			partitions: []string{"xvdf1"},
+			blkid:      map[string]fakeCmd{"*": {exit: 2}},
+			want:       deviceForeign,
+			reason:     "1 partitions",
+		},
+		{
+			name:       "partition with a file system",
+			sysfs:      []string{"xvdf1", "xvdf2"},
+			partitions: []string{"xvdf1", "xvdf2"},
+			blkid:      map[string]fakeCmd{"xvdf2": {out: "TYPE=ext4\n"}, "*": {exit: 2}},
+			want:       deviceForeign,
+			reason:     "partition /dev/xvdf2 has a ext4 signature",
+		},
+		{
+			name:  "no sysfs entry",
+			blkid: map[string]fakeCmd{"*": {exit: 2}},
+			want:  deviceUnknown,
+			err:   true,
+		},
+	}
+	for _, tt := range tests {
+		root, restore := stubHostRoot(t)
+		if tt.sysfs != nil {
+			for _, e := range append(tt.sysfs, "") {
+				if err := os.MkdirAll(filepath.Join(root, "sys/class/block/xvdf", e), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, p := range tt.partitions {
+				if err := ioutil.WriteFile(filepath.Join(root, "sys/class/block/xvdf", p, "partition"), []byte("1\n"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		stubCommands(t, root, map[string]map[string]fakeCmd{"blkid": tt.blkid, "wipefs": tt.wipefs})
+
+		state, err := probeDevice("/dev/xvdf", "ext4")
+		if state != tt.want {
+			t.Errorf("%s: got state %d, want %d", tt.name, state, tt.want)
+		}
+		switch e := err.(type) {
+		case nil:
+			if tt.err || tt.reason != "" {
+				t.Errorf("%s: got no error", tt.name)
+			}
+		case *foreignDeviceError:
+			if e.reason != tt.reason {
+				t.Errorf("%s: got reason %q, want %q", tt.name, e.reason, tt.reason)
+			}
+		default:
+			if !tt.err {
+				t.Errorf("%s: got error %v", tt.name, err)
+			}
+		}
+		restore()
+	}
+}
+
+func TestMkfsRefusesNonEmptyDevice(t *testing.T) {
+	tests := []struct {
+		name  string
+		blkid fakeCmd
+		calls []string
+	}{
+		{"empty", fakeCmd{exit: 2}, []string{
+			"blkid -p -o export /dev/xvdf",
+			"wipefs -n /dev/xvdf",
+			"mkfs.ext4 -q -L data /dev/xvdf",
+		}},
+		{"formatted", fakeCmd{out: "TYPE=ext4\n"}, []string{"blkid -p -o export /dev/xvdf"}},
+		{"foreign", fakeCmd{out: "TYPE=LVM2_member\n"}, []string{"blkid -p -o export /dev/xvdf"}},
+	}
+	for _, tt := range tests {
+		root, restore := stubHostRoot(t)
+		if err := os.MkdirAll(filepath.Join(root, "sys/class/block/xvdf"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		stubCommands(t, root, map[string]map[string]fakeCmd{
+			"blkid":     {"*": tt.blkid},
+			"wipefs":    {"*": {}},
+			"mkfs.ext4": {"*": {}},
+		})
+
+		err := mkfs("/dev/xvdf", "ext4", "data")
+		if (err == nil) != (tt.name == "empty") {
+			t.Errorf("%s: got error %v", tt.name, err)
+		}
+		if got := stubCalls(root); strings.Join(got, "\n") != strings.Join(tt.calls, "\n") {
+			t.Errorf("%s: got calls %q, want %q", tt.name, got, tt.calls)
+		}
+		restore()
+	}
+}
+
+func TestCheckFs(t *testing.T) {
+	tests := []struct {
+		fsType string
+		exit   int
+		call   string
+		err    bool
+	}{
+		{"ext4", 0, "e2fsck -p /dev/xvdf", false},
+		// e2fsck exits with 1 once it corrected errors.
+		{"ext3", 1, "e2fsck -p /dev/xvdf", false},
+		{"ext4", 4, "e2fsck -p /dev/xvdf", true},
+		{"xfs", 0, "xfs_repair -n /dev/xvdf", false},
+		{"xfs", 1, "xfs_repair -n /dev/xvdf", true},
+		{"btrfs", 0, "btrfs check --readonly /dev/xvdf", false},
+		{"btrfs", 1, "btrfs check --readonly /dev/xvdf", true},
+		// Other file systems are not checked.
+		{"vfat", 0, "", false},
+	}
+	for _, tt := range tests {
+		root, restore := stubHostRoot(t)
+		cmd := map[string]fakeCmd{"*": {exit: tt.exit}}
+		stubCommands(t, root, map[string]map[string]fakeCmd{"e2fsck": cmd, "xfs_repair": cmd, "btrfs": cmd})
+
+		err := checkFs("/dev/xvdf", tt.fsType)
+		if (err != nil) != tt.err {
+			t.Errorf("%s exiting with %d: got error %v, want error %v", tt.fsType, tt.exit, err, tt.err)
+		}
+		if got := strings.Join(stubCalls(root), "\n"); got != tt.call {
+			t.Errorf("%s: got calls %q, want %q", tt.fsType, got, tt.call)
+		}
+		restore()
+	}
+}
+
+func TestGrowFs(t *testing.T) {
+	tests := []struct {
+		fsType string
+		exit   int
+		call   string
+		err    bool
+	}{
+		// resize2fs grows the device, the others the mount point.
+		{"ext4", 0, "resize2fs /dev/xvdf", false},
+		{"ext3", 1, "resize2fs /dev/xvdf", true},
+		{"xfs", 0, "xfs_growfs /mnt/data", false},
+		{"btrfs", 0, "btrfs filesystem resize max /mnt/data", false},
+		{"vfat", 0, "", false},
+	}
+	for _, tt := range tests {
+		root, restore := stubHostRoot(t)
+		cmd := map[string]fakeCmd{"*": {exit: tt.exit}}
+		stubCommands(t, root, map[string]map[string]fakeCmd{"resize2fs": cmd, "xfs_growfs": cmd, "btrfs": cmd})
+
+		err := growFs("/dev/xvdf", "/mnt/data", tt.fsType)
+		if (err != nil) != tt.err {
+			t.Errorf("%s exiting with %d: got error %v, want error %v", tt.fsType, tt.exit, err, tt.err)
+		}
+		if got := strings.Join(stubCalls(root), "\n"); got != tt.call {
+			t.Errorf("%s: got calls %q, want %q", tt.fsType, got, tt.call)
+		}
+		restore()
+	}
+}
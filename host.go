@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// hostExecNsenter runs commands in the mount namespace of the host.
+const hostExecNsenter = "nsenter"
+
+// hostPath returns the path, at which smilodon finds path p of the host. It
+// is below --host-root, when running in a container with the host file system
+// mounted there.
+func hostPath(p string) string {
+	if opts.hostRoot == "" {
+		return p
+	}
+	return filepath.Join(opts.hostRoot, p)
+}
+
+// cmdPath returns the path, which commands are given for path p of the host.
+// Commands run in the mount namespace of the host with nsenter see host paths
+// as they are, others see them below --host-root.
+func cmdPath(p string) string {
+	if opts.hostExec == hostExecNsenter {
+		return p
+	}
+	return hostPath(p)
+}
+
+// resolveHostPath returns host path p with symlinks resolved, or p if it
+// cannot be resolved.
+func resolveHostPath(p string) string {
+	resolved, err := filepath.EvalSymlinks(hostPath(p))
+	if err != nil {
+		return p
+	}
+	if opts.hostRoot == "" {
+		return resolved
+	}
+	rel, err := filepath.Rel(opts.hostRoot, resolved)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return p
+	}
+	return "/" + rel
+}
+
+// mountSource returns host path of mount table source s. Devices mounted
+// from a container without nsenter are recorded below --host-root.
+func mountSource(s string) string {
+	if opts.hostRoot == "" {
+		return s
+	}
+	root := filepath.Clean(opts.hostRoot)
+	if strings.HasPrefix(s, root+"/") {
+		return strings.TrimPrefix(s, root)
+	}
+	return s
+}
+
+// mountsFile returns the path of the mount table of the host. In a container,
+// it is the mount table of the host init process, as /proc/mounts lists the
+// mounts of the container.
+func mountsFile() string {
+	if opts.hostRoot == "" && opts.hostExec == "" {
+		return "/proc/mounts"
+	}
+	return hostPath("/proc/1/mounts")
+}
+
+// hostCommand returns a command running host binary name with args in the
+// mount namespace of the host.
+func hostCommand(name string, args ...string) *exec.Cmd {
+	return exec.Command("nsenter", append([]string{"--target", "1", "--mount", "--", name}, args...)...)
+}
+
+// pairInfo is the pair of an instance as published in the pair file.
+type pairInfo struct {
+	InstanceID         string   `json:"instance_id"`
+	AvailabilityZone   string   `json:"availability_zone"`
+	NodeID             string   `json:"node_id"`
+	NodeIP             string   `json:"node_ip"`
+	NodeIPv6           []string `json:"node_ipv6,omitempty"`
+	VolumeID           string   `json:"volume_id"`
+	NetworkInterfaceID string   `json:"network_interface_id"`
+	MountPoint         string   `json:"mount_point,omitempty"`
+	Mounted            bool     `json:"mounted"`
+}
+
+// pairFileData is the content last written to the pair file.
+var pairFileData []byte
+
+// writePairFile writes the pair of instance i as JSON to --pair-file, if it
+// has changed, so that workloads sharing the file can read it.
+func writePairFile(i instance) error {
+	if opts.pairFile == "" || i.nodeID == "" || i.volume == nil || i.networkInterface == nil {
+		return nil
+	}
+	p := pairInfo{
+		InstanceID:         i.id,
+		AvailabilityZone:   i.az,
+		NodeID:             i.nodeID,
+		NodeIP:             i.nodeIP,
+		VolumeID:           i.volume.id,
+		NetworkInterfaceID: i.networkInterfaceID(),
+		NodeIPv6:           i.networkInterface.ipv6Addresses,
+	}
+	if opts.mountFs {
+		p.MountPoint = opts.mountPoint
+		p.Mounted = isMountPoint(opts.mountPoint)
+	}
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if bytes.Equal(data, pairFileData) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(opts.pairFile), 0755); err != nil {
+		logger.Error("Failed to create pair file path", "path", opts.pairFile, "error", err)
+		return err
+	}
+	if err := writeFileAtomic(opts.pairFile, data, 0644); err != nil {
+		logger.Error("Failed to write pair file", "path", opts.pairFile, "error", err)
+		return err
+	}
+	pairFileData = data
+	return nil
+}
+
+// removePairFile removes --pair-file, once the pair has been released.
+func removePairFile() {
+	if opts.pairFile == "" {
+		return
+	}
+	if err := os.Remove(opts.pairFile); err != nil && !os.IsNotExist(err) {
+		logger.Error("Failed to remove pair file", "path", opts.pairFile, "error", err)
+	}
+	pairFileData = nil
+}
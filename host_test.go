@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// stubHostRoot creates a host file system in a temporary directory with
+// device /dev/xvdf and symlink /dev/disk/by-label/data to it, and sets it as
+// --host-root.
+func stubHostRoot(t *testing.T) (string, func()) {
+	saved := opts
+	root, err := ioutil.TempDir("", "smilodon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []string{"dev/disk/by-label", "proc/1"} {
+		if err := os.MkdirAll(filepath.Join(root, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "dev/xvdf"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../../xvdf", filepath.Join(root, "dev/disk/by-label/data")); err != nil {
+		t.Fatal(err)
+	}
+	opts.hostRoot = root
+	return root, func() {
+		opts = saved
+		os.RemoveAll(root)
+	}
+}
+
+func TestIsMountedHostRoot(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		// belowRoot records the source below --host-root.
+		belowRoot bool
+	}{
+		{"mounted on the host", "/dev/xvdf", false},
+		{"mounted from the container", "/dev/xvdf", true},
+		{"mounted by symlink", "/dev/disk/by-label/data", false},
+		{"mounted by symlink from the container", "/dev/disk/by-label/data", true},
+	}
+	for _, tt := range tests {
+		root, restore := stubHostRoot(t)
+		source := tt.source
+		if tt.belowRoot {
+			source = filepath.Join(root, source)
+		}
+		mounts := "/dev/xvda1 / ext4 rw 0 0\n" + source + " /mnt/data ext4 rw 0 0\n"
+		if err := ioutil.WriteFile(filepath.Join(root, "proc/1/mounts"), []byte(mounts), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if !isMounted("/dev/xvdf") {
+			t.Errorf("%s: /dev/xvdf is not mounted", tt.name)
+		}
+		if !isMounted("/dev/disk/by-label/data") {
+			t.Errorf("%s: /dev/disk/by-label/data is not mounted", tt.name)
+		}
+		if isMounted("/dev/xvdg") {
+			t.Errorf("%s: /dev/xvdg is mounted", tt.name)
+		}
+		restore()
+	}
+}
+
+func TestWritePairFile(t *testing.T) {
+	root, restore := stubHostRoot(t)
+	defer restore()
+	saved := pairFileData
+	defer func() { pairFileData = saved }()
+	pairFileData = nil
+	opts.pairFile = filepath.Join(root, "run/smilodon/pair.json")
+	opts.addressMode = addressModeNetworkInterface
+	opts.mountFs = false
+
+	i := instance{
+		id:               "i-1234",
+		az:               "eu-west-1a",
+		nodeID:           "1",
+		nodeIP:           "10.0.1.10",
+		volume:           &volume{id: "vol-1"},
+		networkInterface: &networkInterface{id: "eni-1"},
+	}
+	if err := writePairFile(i); err != nil {
+		t.Fatalf("writePairFile: %v", err)
+	}
+	data, err := ioutil.ReadFile(opts.pairFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p pairInfo
+	if err := json.Unmarshal(data, &p); err != nil {
+		t.Fatalf("invalid pair file: %v", err)
+	}
+	want := pairInfo{InstanceID: "i-1234", AvailabilityZone: "eu-west-1a", NodeID: "1", NodeIP: "10.0.1.10", VolumeID: "vol-1", NetworkInterfaceID: "eni-1"}
+	if !reflect.DeepEqual(p, want) {
+		t.Errorf("got pair %+v, want %+v", p, want)
+	}
+	fi, err := os.Stat(opts.pairFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0644 {
+		t.Errorf("got pair file mode %v, want 0644", fi.Mode())
+	}
+	files, _ := ioutil.ReadDir(filepath.Dir(opts.pairFile))
+	if len(files) != 1 {
+		t.Errorf("got %d files next to the pair file, want only the pair file", len(files))
+	}
+
+	removePairFile()
+	if _, err := os.Stat(opts.pairFile); !os.IsNotExist(err) {
+		t.Errorf("pair file has not been removed: %v", err)
+	}
+}
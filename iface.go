@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// configureIface configures a network interface name for a network interface
+// n. It brings the link up, assigns the IP address of n, creates a dedicated
+// routing table with a default route via the subnet gateway and adds a rule,
+// so that traffic sourced from the IP address leaves via the same interface.
+func configureIface(name string, n networkInterface, table int) error {
+	link, err := net.InterfaceByName(name)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(n.IPAddress)
+	if ip == nil {
+		return fmt.Errorf("invalid IP address %q", n.IPAddress)
+	}
+	cidr := getSubnetCIDRFromMetadata(n.mac)
+	if cidr == "" {
+		cidr = n.subnetCIDR
+	}
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return fmt.Errorf("invalid subnet CIDR %q of %q: %v", cidr, n.id, err)
+	}
+	prefix, _ := subnet.Mask.Size()
+	gw := net.ParseIP(subnetGateway(cidr))
+
+	h, err := newNetlinkHandle()
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	logger.Info("Configuring network interface", "iface", name, "address", fmt.Sprintf("%s/%d", ip, prefix), "route_table", table)
+	if err := h.linkUp(link.Index); err != nil {
+		return fmt.Errorf("failed to bring %q up: %v", name, err)
+	}
+	if err := h.addrReplace(link.Index, ip, prefix); err != nil {
+		return fmt.Errorf("failed to add address %q to %q: %v", ip, name, err)
+	}
+	if err := h.routeReplace(route{table: table, index: link.Index, dst: subnet, src: ip}); err != nil {
+		return fmt.Errorf("failed to add subnet route to table %d: %v", table, err)
+	}
+	if err := h.routeReplace(route{table: table, index: link.Index, gw: gw, src: ip}); err != nil {
+		return fmt.Errorf("failed to add default route to table %d: %v", table, err)
+	}
+	if err := h.ruleReplace(ip, table, table); err != nil {
+		return fmt.Errorf("failed to add rule for %q: %v", ip, err)
+	}
+	if len(n.ipv6Addresses) > 0 {
+		return configureIfaceIPv6(h, link, n, table)
+	}
+	return nil
+}
+
+// configureIfaceIPv6 configures IPv6 addresses of a network interface n on a
+// link the same way configureIface does for the IPv4 address. The IPv6
+// gateway is the VPC router link-local address learned from router
+// advertisements, so it fails until one has been received.
+func configureIfaceIPv6(h *netlinkHandle, link *net.Interface, n networkInterface, table int) error {
+	cidr := getIPv6SubnetCIDRFromMetadata(n.mac)
+	if cidr == "" {
+		return fmt.Errorf("unknown IPv6 subnet CIDR of %q", n.id)
+	}
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return fmt.Errorf("invalid IPv6 subnet CIDR %q of %q: %v", cidr, n.id, err)
+	}
+	prefix, _ := subnet.Mask.Size()
+	gw, err := h.defaultGateway(link.Index, true)
+	if err != nil {
+		return fmt.Errorf("failed to find IPv6 gateway of %q: %v", link.Name, err)
+	}
+	if gw == nil {
+		return fmt.Errorf("no IPv6 router advertisement received on %q yet", link.Name)
+	}
+	for _, a := range n.ipv6Addresses {
+		ip := net.ParseIP(a)
+		if ip == nil {
+			return fmt.Errorf("invalid IPv6 address %q", a)
+		}
+		logger.Info("Configuring network interface", "iface", link.Name, "address", fmt.Sprintf("%s/%d", ip, prefix), "route_table", table)
+		if err := h.addrReplace(link.Index, ip, prefix); err != nil {
+			return fmt.Errorf("failed to add address %q to %q: %v", ip, link.Name, err)
+		}
+		if err := h.routeReplace(route{table: table, index: link.Index, dst: subnet, src: ip}); err != nil {
+			return fmt.Errorf("failed to add IPv6 subnet route to table %d: %v", table, err)
+		}
+		if err := h.routeReplace(route{table: table, index: link.Index, gw: gw, src: ip}); err != nil {
+			return fmt.Errorf("failed to add IPv6 default route to table %d: %v", table, err)
+		}
+		if err := h.ruleReplace(ip, table, table); err != nil {
+			return fmt.Errorf("failed to add rule for %q: %v", ip, err)
+		}
+	}
+	return nil
+}
+
+// getIfaceNameByMAC returns network interface name by MAC address.
+func getIfaceNameByMAC(mac string) (string, error) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return "", err
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+	for _, iface := range ifaces {
+		if iface.HardwareAddr.String() == hw.String() {
+			return iface.Name, nil
+		}
+	}
+	return "", nil
+}
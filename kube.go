@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Labels, annotations and the taint of Kubernetes nodes reflecting their
+// pair.
+const (
+	kubeLabelNodeID      = "smilodon/node-id"
+	kubeLabelPaired      = "smilodon/paired"
+	kubeAnnotationNodeIP = "smilodon/node-ip"
+	kubeTaintKey         = "smilodon/unpaired"
+	kubeTaintEffect      = "NoSchedule"
+)
+
+// In-cluster service account credentials.
+const (
+	kubeServiceAccountToken = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	kubeServiceAccountCA    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+// kube is the Kubernetes node of the instance, if node updates are enabled.
+var kube *kubeNode
+
+// kubeClient calls the Kubernetes API server.
+type kubeClient struct {
+	server string
+	client *http.Client
+	// token is a bearer token. tokenFile is read on every call instead, if
+	// set, as service account tokens are rotated.
+	token     string
+	tokenFile string
+}
+
+// newKubeClient returns a client configured by kubeconfig file kubeconfig, or
+// by the service account of the pod, if kubeconfig is empty.
+func newKubeClient(kubeconfig string) (*kubeClient, error) {
+	if kubeconfig != "" {
+		return kubeconfigClient(kubeconfig)
+	}
+	return inClusterKubeClient()
+}
+
+// inClusterKubeClient returns a client using the service account of the pod
+// smilodon runs in.
+func inClusterKubeClient() (*kubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a Kubernetes cluster, --kubeconfig is required")
+	}
+	ca, err := ioutil.ReadFile(kubeServiceAccountCA)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := kubeTLSConfig(ca, nil, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	return &kubeClient{
+		server:    "https://" + net.JoinHostPort(host, port),
+		client:    newKubeHTTPClient(tlsConfig),
+		tokenFile: kubeServiceAccountToken,
+	}, nil
+}
+
+// kubeTLSConfig returns a TLS config trusting PEM certificate authorities ca
+// and authenticating with PEM client certificate cert and key, if given.
+func kubeTLSConfig(ca, cert, key []byte, insecure bool) (*tls.Config, error) {
+	c := &tls.Config{InsecureSkipVerify: insecure}
+	if len(ca) > 0 {
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificate authorities found")
+		}
+	}
+	if len(cert) > 0 {
+		pair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{pair}
+	}
+	return c, nil
+}
+
+// newKubeHTTPClient returns an HTTP client of the API server.
+func newKubeHTTPClient(c *tls.Config) *http.Client {
+	return &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSClientConfig:     c,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}
+}
+
+// do calls method on API path p with body of contentType, if body is not nil,
+// and decodes the response into out, if out is not nil.
+func (c *kubeClient) do(method, p, contentType string, body []byte, out interface{}) error {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, c.server+p, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	token := c.token
+	if c.tokenFile != "" {
+		data, err := ioutil.ReadFile(c.tokenFile)
+		if err != nil {
+			return err
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		// Failures are described by a Status object.
+		var s struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(data, &s) == nil && s.Message != "" {
+			return fmt.Errorf("%s %s: %s: %s", method, p, resp.Status, s.Message)
+		}
+		return fmt.Errorf("%s %s: %s", method, p, resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// kubeNode keeps labels and taints of a Kubernetes node in line with the
+// pair of the instance. The node is only patched when the pair changes, so
+// that the API server is not called on every run.
+type kubeNode struct {
+	c    *kubeClient
+	name string
+	// nodeID and nodeIP are the NodeID and IP last applied to the node, if
+	// synced is set.
+	nodeID string
+	nodeIP string
+	synced bool
+}
+
+// newKubeNode returns a manager of Kubernetes node name.
+func newKubeNode(c *kubeClient, name string) *kubeNode {
+	return &kubeNode{c: c, name: name}
+}
+
+// k8sNode holds the fields of a Node object, which smilodon manages. Taints
+// are kept as they are, so that fields unknown to smilodon survive a patch.
+type k8sNode struct {
+	Metadata struct {
+		ResourceVersion string            `json:"resourceVersion"`
+		Labels          map[string]string `json:"labels"`
+		Annotations     map[string]string `json:"annotations"`
+	} `json:"metadata"`
+	Spec struct {
+		Taints []map[string]interface{} `json:"taints"`
+	} `json:"spec"`
+}
+
+// update labels the node with NodeID nodeID, annotates it with IP nodeIP and
+// removes the unpaired taint, or taints it and marks it unpaired, if nodeID
+// is empty. The IP is an annotation, as IPv6 addresses are no valid label
+// values.
+func (k *kubeNode) update(nodeID, nodeIP string) error {
+	if nodeID == "" {
+		nodeIP = ""
+	}
+	if k.synced && k.nodeID == nodeID && k.nodeIP == nodeIP {
+		return nil
+	}
+	p := "/api/v1/nodes/" + k.name
+	var n k8sNode
+	if err := k.c.do("GET", p, "", nil, &n); err != nil {
+		return err
+	}
+
+	labels := make(map[string]interface{})
+	if nodeID != "" {
+		if n.Metadata.Labels[kubeLabelNodeID] != nodeID {
+			labels[kubeLabelNodeID] = nodeID
+		}
+		if n.Metadata.Labels[kubeLabelPaired] != "true" {
+			labels[kubeLabelPaired] = "true"
+		}
+	} else {
+		if _, ok := n.Metadata.Labels[kubeLabelNodeID]; ok {
+			// A null value removes the label.
+			labels[kubeLabelNodeID] = nil
+		}
+		if n.Metadata.Labels[kubeLabelPaired] != "false" {
+			labels[kubeLabelPaired] = "false"
+		}
+	}
+	annotations := make(map[string]interface{})
+	ip, annotated := n.Metadata.Annotations[kubeAnnotationNodeIP]
+	if nodeIP != "" && ip != nodeIP {
+		annotations[kubeAnnotationNodeIP] = nodeIP
+	} else if nodeIP == "" && annotated {
+		annotations[kubeAnnotationNodeIP] = nil
+	}
+
+	var taints []map[string]interface{}
+	tainted := false
+	for _, t := range n.Spec.Taints {
+		if t["key"] == kubeTaintKey && t["effect"] == kubeTaintEffect {
+			tainted = true
+			if nodeID != "" {
+				continue
+			}
+		}
+		taints = append(taints, t)
+	}
+	if nodeID == "" && !tainted {
+		taints = append(taints, map[string]interface{}{"key": kubeTaintKey, "effect": kubeTaintEffect})
+	}
+	taintsChanged := tainted == (nodeID != "")
+
+	if len(labels) > 0 || len(annotations) > 0 || taintsChanged {
+		patch := map[string]interface{}{
+			// The resource version makes the patch fail, if the node has
+			// changed since it was read. It is retried on the next run.
+			"metadata": map[string]interface{}{
+				"resourceVersion": n.Metadata.ResourceVersion,
+				"labels":          labels,
+				"annotations":     annotations,
+			},
+		}
+		if taintsChanged {
+			if taints == nil {
+				taints = []map[string]interface{}{}
+			}
+			// Taints are a list, which a merge patch replaces as a whole.
+			patch["spec"] = map[string]interface{}{"taints": taints}
+		}
+		data, err := json.Marshal(patch)
+		if err != nil {
+			return err
+		}
+		if err := k.c.do("PATCH", p, "application/merge-patch+json", data, nil); err != nil {
+			return err
+		}
+		if nodeID != "" {
+			logger.Info("Labelled Kubernetes node", "kube_node", k.name, "node_id", nodeID, "node_ip", nodeIP)
+		} else {
+			logger.Info("Tainted Kubernetes node as unpaired", "kube_node", k.name)
+		}
+	}
+	k.nodeID = nodeID
+	k.nodeIP = nodeIP
+	k.synced = true
+	return nil
+}
+
+// updateKubeNode updates the Kubernetes node of instance i, if enabled. The
+// node stays tainted until the file system is mounted, if it is to be.
+func updateKubeNode(i instance) {
+	if kube == nil {
+		return
+	}
+	nodeID := i.nodeID
+	if nodeID != "" && opts.mountFs && !isMountPoint(opts.mountPoint) {
+		nodeID = ""
+	}
+	if err := kube.update(nodeID, i.nodeIP); err != nil {
+		logger.Error("Failed to update Kubernetes node", "kube_node", kube.name, "error", err)
+	}
+}
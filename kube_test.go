@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeKubeAPI is a Kubernetes API server serving a single node.
+type fakeKubeAPI struct {
+	mu   sync.Mutex
+	name string
+	node map[string]interface{}
+	// version is the resource version of the node.
+	version int
+	// patches lists applied merge patches.
+	patches []map[string]interface{}
+	// requests is the number of requests served.
+	requests int
+	// beforePatch, if set, is called before a patch is applied.
+	beforePatch func()
+}
+
+func newFakeKubeAPI(name, node string) *fakeKubeAPI {
+	f := &fakeKubeAPI{name: name, version: 1}
+	if err := json.Unmarshal([]byte(node), &f.node); err != nil {
+		panic(err)
+	}
+	return f
+}
+
+func (f *fakeKubeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests++
+	if r.URL.Path != "/api/v1/nodes/"+f.name {
+		writeJSON(w, http.StatusNotFound, map[string]string{"kind": "Status", "message": "not found"})
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer secret" {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"kind": "Status", "message": "unauthorized"})
+		return
+	}
+	switch r.Method {
+	case "GET":
+		f.node["metadata"].(map[string]interface{})["resourceVersion"] = strconv.Itoa(f.version)
+		writeJSON(w, http.StatusOK, f.node)
+	case "PATCH":
+		if r.Header.Get("Content-Type") != "application/merge-patch+json" {
+			writeJSON(w, http.StatusUnsupportedMediaType, map[string]string{"kind": "Status", "message": "unsupported patch"})
+			return
+		}
+		if f.beforePatch != nil {
+			f.beforePatch()
+		}
+		var patch map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"kind": "Status", "message": err.Error()})
+			return
+		}
+		if v, _ := patch["metadata"].(map[string]interface{})["resourceVersion"].(string); v != strconv.Itoa(f.version) {
+			writeJSON(w, http.StatusConflict, map[string]string{"kind": "Status", "message": "the object has been modified"})
+			return
+		}
+		f.patches = append(f.patches, patch)
+		mergePatch(f.node, patch)
+		f.version++
+		writeJSON(w, http.StatusOK, f.node)
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"kind": "Status", "message": "method not allowed"})
+	}
+}
+
+// mergePatch applies JSON merge patch patch to object o.
+func mergePatch(o, patch map[string]interface{}) {
+	for k, v := range patch {
+		switch v := v.(type) {
+		case nil:
+			delete(o, k)
+		case map[string]interface{}:
+			m, ok := o[k].(map[string]interface{})
+			if !ok {
+				m = make(map[string]interface{})
+				o[k] = m
+			}
+			mergePatch(m, v)
+		default:
+			o[k] = v
+		}
+	}
+}
+
+// get returns the node field at path, for example metadata.labels.
+func (f *fakeKubeAPI) get(path string) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var v interface{} = f.node
+	for _, k := range strings.Split(path, ".") {
+		m, _ := v.(map[string]interface{})
+		v = m[k]
+	}
+	// Return a copy, which is safe to use without the lock.
+	data, _ := json.Marshal(v)
+	var c interface{}
+	json.Unmarshal(data, &c)
+	return c
+}
+
+const kubeTestNode = `{
+  "metadata": {
+    "name": "node-a",
+    "labels": {"kubernetes.io/hostname": "node-a"},
+    "annotations": {"node.alpha.kubernetes.io/ttl": "0"}
+  },
+  "spec": {
+    "taints": [
+      {"key": "smilodon/unpaired", "effect": "NoSchedule"},
+      {"key": "dedicated", "value": "etcd", "effect": "NoExecute"}
+    ]
+  }
+}`
+
+// stubKubeAPI serves f and returns a node manager of it.
+func stubKubeAPI(f *fakeKubeAPI) (*kubeNode, func()) {
+	s := httptest.NewServer(f)
+	c := &kubeClient{server: s.URL, client: &http.Client{}, token: "secret"}
+	return newKubeNode(c, f.name), s.Close
+}
+
+func TestKubeNodeUpdate(t *testing.T) {
+	f := newFakeKubeAPI("node-a", kubeTestNode)
+	k, closeAPI := stubKubeAPI(f)
+	defer closeAPI()
+
+	if err := k.update("1", "10.0.1.10"); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	labels := map[string]interface{}{"kubernetes.io/hostname": "node-a", kubeLabelNodeID: "1", kubeLabelPaired: "true"}
+	if got := f.get("metadata.labels"); !reflect.DeepEqual(got, labels) {
+		t.Errorf("got labels %v, want %v", got, labels)
+	}
+	annotations := map[string]interface{}{"node.alpha.kubernetes.io/ttl": "0", kubeAnnotationNodeIP: "10.0.1.10"}
+	if got := f.get("metadata.annotations"); !reflect.DeepEqual(got, annotations) {
+		t.Errorf("got annotations %v, want %v", got, annotations)
+	}
+	taints := []interface{}{map[string]interface{}{"key": "dedicated", "value": "etcd", "effect": "NoExecute"}}
+	if got := f.get("spec.taints"); !reflect.DeepEqual(got, taints) {
+		t.Errorf("got taints %v, want %v", got, taints)
+	}
+
+	// Nothing is called while the pair stays the same.
+	requests := f.requests
+	if err := k.update("1", "10.0.1.10"); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if f.requests != requests {
+		t.Errorf("got %d requests for an unchanged pair, want none", f.requests-requests)
+	}
+
+	if err := k.update("", ""); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	labels = map[string]interface{}{"kubernetes.io/hostname": "node-a", kubeLabelPaired: "false"}
+	if got := f.get("metadata.labels"); !reflect.DeepEqual(got, labels) {
+		t.Errorf("got labels %v, want %v", got, labels)
+	}
+	annotations = map[string]interface{}{"node.alpha.kubernetes.io/ttl": "0"}
+	if got := f.get("metadata.annotations"); !reflect.DeepEqual(got, annotations) {
+		t.Errorf("got annotations %v, want %v", got, annotations)
+	}
+	taints = []interface{}{
+		map[string]interface{}{"key": "dedicated", "value": "etcd", "effect": "NoExecute"},
+		map[string]interface{}{"key": kubeTaintKey, "effect": kubeTaintEffect},
+	}
+	if got := f.get("spec.taints"); !reflect.DeepEqual(got, taints) {
+		t.Errorf("got taints %v, want %v", got, taints)
+	}
+
+	// Labels are only patched if they differ and taints only if they change.
+	want := []string{
+		`{"metadata":{"annotations":{"smilodon/node-ip":"10.0.1.10"},"labels":{"smilodon/node-id":"1","smilodon/paired":"true"},"resourceVersion":"1"},"spec":{"taints":[{"effect":"NoExecute","key":"dedicated","value":"etcd"}]}}`,
+		`{"metadata":{"annotations":{"smilodon/node-ip":null},"labels":{"smilodon/node-id":null,"smilodon/paired":"false"},"resourceVersion":"2"},"spec":{"taints":[{"effect":"NoExecute","key":"dedicated","value":"etcd"},{"effect":"NoSchedule","key":"smilodon/unpaired"}]}}`,
+	}
+	if len(f.patches) != len(want) {
+		t.Fatalf("got %d patches, want %d", len(f.patches), len(want))
+	}
+	for n, p := range f.patches {
+		if data, _ := json.Marshal(p); string(data) != want[n] {
+			t.Errorf("got patch %s, want %s", data, want[n])
+		}
+	}
+}
+
+func TestKubeNodeConflict(t *testing.T) {
+	f := newFakeKubeAPI("node-a", kubeTestNode)
+	k, closeAPI := stubKubeAPI(f)
+	defer closeAPI()
+
+	// The node changes between reading and patching it.
+	f.beforePatch = func() {
+		f.version++
+		f.node["metadata"].(map[string]interface{})["labels"].(map[string]interface{})["team"] = "storage"
+		f.beforePatch = nil
+	}
+	err := k.update("1", "10.0.1.10")
+	if err == nil || !strings.Contains(err.Error(), "409") {
+		t.Fatalf("got %v, want a conflict", err)
+	}
+	if len(f.patches) != 0 {
+		t.Errorf("got patches %v after a conflict, want none", f.patches)
+	}
+
+	// The next run reads the node again and keeps the concurrent change.
+	if err := k.update("1", "10.0.1.10"); err != nil {
+		t.Fatalf("update after a conflict: %v", err)
+	}
+	labels := map[string]interface{}{"kubernetes.io/hostname": "node-a", "team": "storage", kubeLabelNodeID: "1", kubeLabelPaired: "true"}
+	if got := f.get("metadata.labels"); !reflect.DeepEqual(got, labels) {
+		t.Errorf("got labels %v, want %v", got, labels)
+	}
+}
+
+func TestKubeconfigClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smilodon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "token"), []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	configs := map[string]string{
+		"yaml": `apiVersion: v1
+kind: Config
+# Written by hand.
+current-context: prod
+clusters:
+- name: staging
+  cluster:
+    server: https://staging.example.com
+- name: prod
+  cluster: &prod
+    server: "https://prod.example.com:6443/"
+    insecure-skip-tls-verify: true
+contexts:
+- name: prod
+  context: {cluster: prod, user: smilodon}
+users:
+- name: smilodon
+  user:
+    tokenFile: token
+`,
+		"json": `{
+  "current-context": "prod",
+  "clusters": [{"name": "prod", "cluster": {"server": "https://prod.example.com:6443/", "insecure-skip-tls-verify": true}}],
+  "contexts": [{"name": "prod", "context": {"cluster": "prod", "user": "smilodon"}}],
+  "users": [{"name": "smilodon", "user": {"tokenFile": "token"}}]
+}`,
+	}
+	for format, config := range configs {
+		f := filepath.Join(dir, "kubeconfig."+format)
+		if err := ioutil.WriteFile(f, []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+		c, err := kubeconfigClient(f)
+		if err != nil {
+			t.Errorf("%s: kubeconfigClient: %v", format, err)
+			continue
+		}
+		if c.server != "https://prod.example.com:6443" {
+			t.Errorf("%s: got server %q, want https://prod.example.com:6443", format, c.server)
+		}
+		if c.tokenFile != filepath.Join(dir, "token") {
+			t.Errorf("%s: got token file %q, want %q", format, c.tokenFile, filepath.Join(dir, "token"))
+		}
+	}
+
+	f := filepath.Join(dir, "invalid")
+	if err := ioutil.WriteFile(f, []byte("clusters: [unclosed\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kubeconfigClient(f); err == nil {
+		t.Error("kubeconfigClient accepted invalid YAML")
+	}
+}
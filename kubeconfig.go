@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/ghodss/yaml"
+)
+
+// kubeconfig holds the parts of a kubeconfig file, which smilodon uses.
+type kubeconfig struct {
+	CurrentContext string `json:"current-context"`
+	Clusters       []struct {
+		Name    string `json:"name"`
+		Cluster struct {
+			Server                   string `json:"server"`
+			CertificateAuthority     string `json:"certificate-authority"`
+			CertificateAuthorityData string `json:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `json:"insecure-skip-tls-verify"`
+		} `json:"cluster"`
+	} `json:"clusters"`
+	Users []struct {
+		Name string `json:"name"`
+		User struct {
+			Token                 string      `json:"token"`
+			TokenFile             string      `json:"tokenFile"`
+			ClientCertificate     string      `json:"client-certificate"`
+			ClientCertificateData string      `json:"client-certificate-data"`
+			ClientKey             string      `json:"client-key"`
+			ClientKeyData         string      `json:"client-key-data"`
+			Exec                  interface{} `json:"exec"`
+			AuthProvider          interface{} `json:"auth-provider"`
+		} `json:"user"`
+	} `json:"users"`
+	Contexts []struct {
+		Name    string `json:"name"`
+		Context struct {
+			Cluster string `json:"cluster"`
+			User    string `json:"user"`
+		} `json:"context"`
+	} `json:"contexts"`
+}
+
+// kubeconfigClient returns a client configured by the current context of
+// kubeconfig file f. Only tokens and client certificates are supported, not
+// exec or auth provider plugins.
+func kubeconfigClient(f string) (*kubeClient, error) {
+	data, err := ioutil.ReadFile(f)
+	if err != nil {
+		return nil, err
+	}
+	var kc kubeconfig
+	if err := parseKubeconfig(data, &kc); err != nil {
+		return nil, fmt.Errorf("%s: %v", f, err)
+	}
+
+	var clusterName, userName string
+	found := false
+	for _, c := range kc.Contexts {
+		if c.Name == kc.CurrentContext {
+			clusterName, userName = c.Context.Cluster, c.Context.User
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("%s: current context %q not found", f, kc.CurrentContext)
+	}
+
+	// Relative paths are relative to the kubeconfig file.
+	dir := filepath.Dir(f)
+	read := func(file, data string) ([]byte, error) {
+		if data != "" {
+			return base64.StdEncoding.DecodeString(data)
+		}
+		if file == "" {
+			return nil, nil
+		}
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(dir, file)
+		}
+		return ioutil.ReadFile(file)
+	}
+
+	c := &kubeClient{}
+	var ca, cert, key []byte
+	insecure := false
+	found = false
+	for _, cl := range kc.Clusters {
+		if cl.Name != clusterName {
+			continue
+		}
+		found = true
+		c.server = strings.TrimRight(cl.Cluster.Server, "/")
+		insecure = cl.Cluster.InsecureSkipTLSVerify
+		if ca, err = read(cl.Cluster.CertificateAuthority, cl.Cluster.CertificateAuthorityData); err != nil {
+			return nil, fmt.Errorf("%s: certificate authority of cluster %q: %v", f, clusterName, err)
+		}
+	}
+	if !found || c.server == "" {
+		return nil, fmt.Errorf("%s: server of cluster %q not found", f, clusterName)
+	}
+	for _, u := range kc.Users {
+		if u.Name != userName {
+			continue
+		}
+		if u.User.Exec != nil || u.User.AuthProvider != nil {
+			return nil, fmt.Errorf("%s: user %q uses a credential plugin, which is not supported", f, userName)
+		}
+		c.token = u.User.Token
+		if u.User.TokenFile != "" {
+			c.tokenFile = u.User.TokenFile
+			if !filepath.IsAbs(c.tokenFile) {
+				c.tokenFile = filepath.Join(dir, c.tokenFile)
+			}
+		}
+		if cert, err = read(u.User.ClientCertificate, u.User.ClientCertificateData); err != nil {
+			return nil, fmt.Errorf("%s: client certificate of user %q: %v", f, userName, err)
+		}
+		if key, err = read(u.User.ClientKey, u.User.ClientKeyData); err != nil {
+			return nil, fmt.Errorf("%s: client key of user %q: %v", f, userName, err)
+		}
+	}
+
+	tlsConfig, err := kubeTLSConfig(ca, cert, key, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", f, err)
+	}
+	c.client = newKubeHTTPClient(tlsConfig)
+	return c, nil
+}
+
+// parseKubeconfig parses kubeconfig data in JSON or YAML into kc.
+func parseKubeconfig(data []byte, kc *kubeconfig) error {
+	// YAML is converted to JSON, so that the JSON field tags apply.
+	j, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(j, kc)
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logLevel is the severity of a log line.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = map[logLevel]string{
+	levelDebug: "debug",
+	levelInfo:  "info",
+	levelWarn:  "warn",
+	levelError: "error",
+}
+
+// journalPriorities map log levels to syslog priorities used by journald.
+var journalPriorities = map[logLevel]int{
+	levelDebug: 7,
+	levelInfo:  6,
+	levelWarn:  4,
+	levelError: 3,
+}
+
+// journalSocket is the socket of the journald native protocol.
+const journalSocket = "/run/systemd/journal/socket"
+
+// leveledLogger writes leveled log lines in text, JSON or journald format.
+// Every line carries fields of the instance being reconciled and the current
+// reconcile cycle, besides fields given by the caller.
+type leveledLogger struct {
+	mu      sync.Mutex
+	level   logLevel
+	format  string
+	out     io.Writer
+	journal net.Conn
+	inst    logInstance
+	cycle   int
+	// errors is the number of errors logged in the current cycle.
+	errors int
+}
+
+// logInstance holds correlation fields of an instance. It is a copy, as the
+// main loop changes the instance while other goroutines log.
+type logInstance struct {
+	id, az, nodeID, volumeID, eniID string
+}
+
+// logField is a key and a value of a log line.
+type logField struct {
+	key   string
+	value string
+}
+
+var logger = &leveledLogger{level: levelInfo, format: "text", out: os.Stderr}
+
+// parseLogLevel parses a log level name.
+func parseLogLevel(s string) (logLevel, error) {
+	for l, name := range levelNames {
+		if name == s {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// configure sets the log level and format. The journald format writes to
+// journald directly. Lines journald does not accept are written as text to
+// standard error instead.
+func (l *leveledLogger) configure(level, format string) error {
+	lvl, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case "text", "json":
+	case "journald":
+		c, err := net.Dial("unixgram", journalSocket)
+		if err != nil {
+			return fmt.Errorf("failed to connect to journald: %v", err)
+		}
+		l.mu.Lock()
+		if l.journal != nil {
+			l.journal.Close()
+		}
+		l.journal = c
+		l.mu.Unlock()
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	l.mu.Lock()
+	l.level = lvl
+	l.format = format
+	l.mu.Unlock()
+	return nil
+}
+
+// setInstance makes log lines carry fields of instance i until it is called
+// again, so it is called whenever the main loop changes the instance.
+func (l *leveledLogger) setInstance(i instance) {
+	li := logInstance{id: i.id, az: i.az, nodeID: i.nodeID}
+	if i.volume != nil {
+		li.volumeID = i.volume.id
+	}
+	if i.networkInterface != nil {
+		li.eniID = i.networkInterfaceID()
+	}
+	l.mu.Lock()
+	l.inst = li
+	l.mu.Unlock()
+}
+
+// nextCycle starts a new reconcile cycle.
+func (l *leveledLogger) nextCycle() {
+	l.mu.Lock()
+	l.cycle++
+	l.errors = 0
+	l.mu.Unlock()
+}
+
+// cycleErrors returns the number of errors logged in the current cycle.
+func (l *leveledLogger) cycleErrors() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.errors
+}
+
+// fields returns fields kv, given as alternating keys and values, followed
+// by correlation fields of the current instance and cycle. Empty correlation
+// fields and those overridden by kv are left out.
+func (l *leveledLogger) fields(kv []interface{}) []logField {
+	var fs []logField
+	given := make(map[string]bool)
+	for n := 0; n < len(kv); n += 2 {
+		f := logField{key: fmt.Sprint(kv[n])}
+		if n+1 < len(kv) {
+			f.value = fmt.Sprint(kv[n+1])
+		} else {
+			// A value without a key.
+			f = logField{key: "extra", value: f.key}
+		}
+		given[f.key] = true
+		fs = append(fs, f)
+	}
+	add := func(k, v string) {
+		if v != "" && !given[k] {
+			fs = append(fs, logField{k, v})
+		}
+	}
+	add("instance_id", l.inst.id)
+	add("az", l.inst.az)
+	add("node_id", l.inst.nodeID)
+	add("volume_id", l.inst.volumeID)
+	add("eni_id", l.inst.eniID)
+	if l.cycle > 0 {
+		add("cycle", strconv.Itoa(l.cycle))
+	}
+	return fs
+}
+
+// output writes a log line of level with message msg and fields kv.
+func (l *leveledLogger) output(level logLevel, msg string, kv []interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if level == levelError {
+		l.errors++
+	}
+	if level < l.level {
+		return
+	}
+	fs := l.fields(kv)
+	now := time.Now().UTC()
+
+	switch l.format {
+	case "journald":
+		if l.writeJournal(level, msg, fs) == nil {
+			return
+		}
+	case "json":
+		m := map[string]string{
+			"time":  now.Format(time.RFC3339Nano),
+			"level": levelNames[level],
+			"msg":   msg,
+		}
+		for _, f := range fs {
+			m[f.key] = f.value
+		}
+		data, _ := json.Marshal(m)
+		l.out.Write(append(data, '\n'))
+		return
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "time=%s level=%s msg=%s", now.Format(time.RFC3339), levelNames[level], strconv.Quote(msg))
+	for _, f := range fs {
+		fmt.Fprintf(&b, " %s=%s", f.key, quoteValue(f.value))
+	}
+	b.WriteByte('\n')
+	l.out.Write(b.Bytes())
+}
+
+// writeJournal sends a log line to journald using its native protocol.
+func (l *leveledLogger) writeJournal(level logLevel, msg string, fs []logField) error {
+	var b bytes.Buffer
+	writeJournalField(&b, "MESSAGE", msg)
+	writeJournalField(&b, "PRIORITY", strconv.Itoa(journalPriorities[level]))
+	writeJournalField(&b, "SYSLOG_IDENTIFIER", "smilodon")
+	for _, f := range fs {
+		writeJournalField(&b, strings.ToUpper(f.key), f.value)
+	}
+	_, err := l.journal.Write(b.Bytes())
+	return err
+}
+
+// writeJournalField writes a journald native protocol field. Values holding
+// newlines are written with an explicit length.
+func writeJournalField(b *bytes.Buffer, key, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(b, "%s=%s\n", key, value)
+		return
+	}
+	b.WriteString(key)
+	b.WriteByte('\n')
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
+
+// quoteValue quotes a text log field value, if it is empty or holds spaces,
+// quotes or equal signs.
+func quoteValue(v string) string {
+	if v == "" || strings.ContainsAny(v, " \t\n\"=") {
+		return strconv.Quote(v)
+	}
+	return v
+}
+
+// Debug logs a debug message with fields kv, given as alternating keys and
+// values.
+func (l *leveledLogger) Debug(msg string, kv ...interface{}) {
+	l.output(levelDebug, msg, kv)
+}
+
+// Info logs an informational message with fields kv.
+func (l *leveledLogger) Info(msg string, kv ...interface{}) {
+	l.output(levelInfo, msg, kv)
+}
+
+// Warn logs a warning with fields kv.
+func (l *leveledLogger) Warn(msg string, kv ...interface{}) {
+	l.output(levelWarn, msg, kv)
+}
+
+// Error logs an error with fields kv.
+func (l *leveledLogger) Error(msg string, kv ...interface{}) {
+	l.output(levelError, msg, kv)
+}
+
+// Fatal logs an error with fields kv and exits.
+func (l *leveledLogger) Fatal(msg string, kv ...interface{}) {
+	l.output(levelError, msg, kv)
+	os.Exit(1)
+}
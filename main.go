@@ -3,35 +3,116 @@ package main
 import (
 	"flag"
 	"fmt"
-	"log"
 	"net"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
 )
 
 type cmdLineOpts struct {
-	filters     string
-	blockDevice string
-	createFs    bool
-	fsType      string
-	mountFs     bool
-	mountPoint  string
-	envFile     string
-	daemon      bool
-	help        bool
-	version     bool
+	filters          string
+	blockDevice      string
+	createFs         bool
+	fsType           string
+	mountFs          bool
+	mountPoint       string
+	envFile          string
+	exportTags       string
+	templates        string
+	reloadCmd        string
+	r53ZoneID        string
+	r53Name          string
+	r53SRVName       string
+	r53SRVPort       int64
+	r53TTL           int64
+	stateFile        string
+	preferredID      string
+	preferredTimeout time.Duration
+	strategy         string
+	addressMode      string
+	addressTag       string
+	configIface      bool
+	routeTable       int
+	crossAZFailover  bool
+	crossAZIdle      time.Duration
+	failoverSubnet   string
+	snapshotCron     string
+	snapshotRetain   string
+	snapshotPreHook  string
+	snapshotPostHook string
+	bootstrap        string
+	mkfsArgs         string
+	fsLabel          string
+	mountOptions     string
+	checkFs          bool
+	growFs           bool
+	binPath          string
+	partition        int
+	mountLabel       string
+	volumeGroup      string
+	logicalVolume    string
+	pauseFile        string
+	preReleaseHook   string
+	config           string
+	controlSocket    string
+	controlGroup     string
+	logFormat        string
+	metrics          string
+	metricsNamespace string
+	awsMaxRetries    int
+	awsTimeout       time.Duration
+	awsRateLimit     float64
+	awsProfile       string
+	awsRoleARN       string
+	awsExternalID    string
+	awsSTSRegional   bool
+	awsEndpoints     string
+	awsCABundle      string
+	metadataEndpoint string
+	metadataTimeout  time.Duration
+	instanceID       string
+	region           string
+	az               string
+	hostRoot         string
+	hostExec         string
+	pairFile         string
+	kubeNodeName     string
+	kubeconfig       string
+	consulService    string
+	consulAddress    string
+	consulToken      string
+	consulPort       int
+	consulTags       string
+	consulTTL        time.Duration
+	events           string
+	eventsTopicARN   string
+	logLevel         string
+	bootstrapSeed    string
+	daemon           bool
+	help             bool
+	version          bool
 }
 
 var (
 	opts              cmdLineOpts
 	region            string
-	ec2c              *ec2.EC2
+	ec2c              ec2Client
 	filters           []*ec2.Filter
 	volumeAttachTries int
+	envFiles          []envFile
+	exportTags        []exportTag
+	templates         []templateFile
+	dns               *dnsRecords
+	lastState         *state
+	preferredIDs      []string
+	startTime         = time.Now()
+	strategy          selectionStrategy
+	snapshotSchedule  *cronSchedule
+	snapshotRetain    *snapshotRetention
+	nextSnapshot      time.Time
 )
 
 func init() {
@@ -39,9 +120,80 @@ func init() {
 	flag.StringVar(&opts.blockDevice, "block-device", "/dev/xvde", "linux block device path")
 	flag.BoolVar(&opts.createFs, "create-file-system", false, "whether to create a file system")
 	flag.StringVar(&opts.fsType, "file-system-type", "ext4", "file system type")
+	flag.StringVar(&opts.bootstrap, "bootstrap", bootstrapMkfs, "how to initialize an empty volume when --create-file-system is set: mkfs creates an empty file system, snapshot restores the latest snapshot matching the tag filters and seed extracts --bootstrap-seed into a new file system")
+	flag.StringVar(&opts.bootstrapSeed, "bootstrap-seed", "", "a local path or an s3://bucket/key URL of a tarball, optionally gzip compressed, to seed empty volumes with")
+	flag.StringVar(&opts.mkfsArgs, "mkfs-args", "", "extra arguments to pass to mkfs. For example --mkfs-args='-i 65536' for ext4 or --mkfs-args='-b size=4096' for xfs")
+	flag.StringVar(&opts.fsLabel, "file-system-label", "node-%s", "a file system label, where %s is replaced by NodeID. It is truncated to the maximum label length of the file system. An empty value disables labels")
+	flag.StringVar(&opts.mountOptions, "mount-options", "", "mount options. Defaults to noatime for ext3, ext4, xfs and btrfs")
+	flag.BoolVar(&opts.checkFs, "check-file-system", false, "whether to check the file system before mounting it. It is not mounted if the check fails")
+	flag.BoolVar(&opts.growFs, "grow-file-system", false, "whether to grow the file system to the size of the volume after mounting it")
+	flag.StringVar(&opts.binPath, "bin-path", "/usr/sbin:/usr/bin:/sbin:/bin", "a colon-delimited list of directories to look up binaries such as mkfs, mount and lsblk in, before $PATH")
+	flag.IntVar(&opts.partition, "partition", 0, "a partition number of the attached volume holding the file system. Zero means the whole volume")
+	flag.StringVar(&opts.mountLabel, "mount-label", "", "a file system label of the attached volume or one of its partitions to mount, where %s is replaced by NodeID. For example --mount-label='data-%s'")
+	flag.StringVar(&opts.volumeGroup, "volume-group", "", "an LVM volume group on the attached volume to activate before mounting, where %s is replaced by NodeID. For example --volume-group='vg-node-%s'")
+	flag.StringVar(&opts.logicalVolume, "logical-volume", "data", "an LVM logical volume in --volume-group holding the file system")
 	flag.BoolVar(&opts.mountFs, "mount-fs", false, "whether to mount a file system")
 	flag.StringVar(&opts.mountPoint, "mount-point", "/data", "mount point path")
-	flag.StringVar(&opts.envFile, "env-file", "/run/smilodon/environment", "environment file path")
+	flag.StringVar(&opts.envFile, "env-file", "/run/smilodon/environment", "a comma-delimited list of environment file paths, each optionally suffixed with a format: systemd, shell or json. For example --env-file='/run/smilodon/environment,/run/smilodon/environment.json:json'")
+	flag.StringVar(&opts.exportTags, "export-tag", "", "a comma-delimited list of resource tags to export to environment files, each optionally mapped to a variable name. For example --export-tag='Service=SERVICE_NAME,Env'")
+	flag.StringVar(&opts.templates, "template", "", "a comma-delimited list of text/template files to render with pair data, each as <source>:<destination>. For example --template='/etc/smilodon/etcd.conf.tmpl:/etc/etcd/etcd.conf'")
+	flag.StringVar(&opts.reloadCmd, "template-reload-command", "", "a shell command to run after any template has been re-rendered")
+	flag.StringVar(&opts.r53ZoneID, "route53-zone-id", "", "a Route 53 hosted zone ID to register a DNS record of the node in")
+	flag.StringVar(&opts.r53Name, "route53-record-name", "", "a Route 53 A record name in the hosted zone, where %s is replaced by NodeID. It is required with --route53-zone-id. For example --route53-record-name='node-%s.etcd.internal'")
+	flag.StringVar(&opts.r53SRVName, "route53-srv-name", "", "an optional Route 53 SRV record name listing all nodes. For example --route53-srv-name='_etcd-server._tcp.etcd.internal'")
+	flag.Int64Var(&opts.r53SRVPort, "route53-srv-port", 0, "a port number used in the Route 53 SRV record")
+	flag.Int64Var(&opts.r53TTL, "route53-ttl", 60, "a TTL of Route 53 records in seconds")
+	flag.StringVar(&opts.addressMode, "address-mode", addressModeNetworkInterface, "how a stable IP address is provided: network-interface attaches a dedicated network interface, secondary-ip assigns a secondary private IP address and elastic-ip associates an Elastic IP address with the primary network interface")
+	flag.StringVar(&opts.addressTag, "address-tag", "NodeIP", "a volume tag holding a private IP address in secondary-ip address mode or an Elastic IP allocation ID in elastic-ip address mode")
+	flag.BoolVar(&opts.configIface, "configure-interface", false, "whether to configure the attached network interface: bring it up, assign its address and set up policy routing. Do not enable it together with ec2-net-utils")
+	flag.IntVar(&opts.routeTable, "route-table", 1001, "a routing table ID, also used as the routing rule priority, for the attached network interface")
+	flag.StringVar(&opts.stateFile, "state-file", "/var/lib/smilodon/state.json", "a state file path, which lets smilodon survive restarts. An empty value disables it")
+	flag.StringVar(&opts.preferredID, "preferred-node-id", "", "a comma-delimited list of node IDs or node ID ranges to prefer, in order of preference. For example --preferred-node-id='3' or --preferred-node-id='1-3,7'")
+	flag.DurationVar(&opts.preferredTimeout, "preferred-node-id-timeout", 10*time.Minute, "how long to wait for a preferred node ID, including the one held before a restart, before falling back to any node ID")
+	flag.StringVar(&opts.strategy, "selection-strategy", "api", "how to order available pairs: api keeps the EC2 API order, lowest prefers the lowest node ID, random shuffles them with a seed derived from the instance ID, least-recently-used prefers pairs unused for the longest time and spread prefers network interface subnets with the fewest attached network interfaces")
+	flag.BoolVar(&opts.crossAZFailover, "cross-az-failover", false, "whether to take over node IDs from other availability zones by snapshotting their idle volumes and restoring them in the local availability zone, when no pair is available locally")
+	flag.DurationVar(&opts.crossAZIdle, "cross-az-idle-threshold", time.Hour, "how long a volume in another availability zone must have been idle, before its node ID can be taken over")
+	flag.StringVar(&opts.failoverSubnet, "failover-subnet-id", "", "a subnet ID to create network interfaces of taken over node IDs in. Defaults to the subnet of the instance")
+	flag.StringVar(&opts.snapshotCron, "snapshot-schedule", "", "a cron expression to take snapshots of the attached volume on, in UTC. For example --snapshot-schedule='0 */6 * * *' or --snapshot-schedule='@daily'. An empty value disables snapshots")
+	flag.StringVar(&opts.snapshotRetain, "snapshot-retention", "", "how many of the most recent hourly, daily and weekly scheduled snapshots to keep. For example --snapshot-retention='hourly=24,daily=7,weekly=4'. An empty value keeps all snapshots")
+	flag.StringVar(&opts.snapshotPreHook, "snapshot-pre-hook", "", "a shell command to run before taking a snapshot, for example 'fsfreeze -f /data'. The snapshot is skipped if it fails")
+	flag.StringVar(&opts.snapshotPostHook, "snapshot-post-hook", "", "a shell command to run after a snapshot has been started, for example 'fsfreeze -u /data'")
+	flag.StringVar(&opts.pauseFile, "pause-file", "/run/smilodon/paused", "a file, which pauses smilodon while it exists, so that it does not attach or reclaim any pairs. It is created by the drain command and removed by the resume command")
+	flag.StringVar(&opts.preReleaseHook, "pre-release-hook", "", "a shell command to run before releasing a pair, for example 'systemctl stop etcd'. The pair is not released if it fails")
+	flag.StringVar(&opts.config, "config", "", "a config file holding options as name=value lines. Options given on the command line take precedence. The config file is reloaded by 'smilodon ctl reload'")
+	flag.StringVar(&opts.controlSocket, "control-socket", "/run/smilodon/control.sock", "a unix socket path to serve the control API on. An empty value disables it")
+	flag.StringVar(&opts.controlGroup, "control-socket-group", "", "a group allowed to use the control API besides the owner of the socket")
+	flag.StringVar(&opts.logFormat, "log-format", "text", "the log format: text, json or journald. journald sends logs to the systemd journal with structured fields")
+	flag.StringVar(&opts.logLevel, "log-level", "info", "the lowest level of messages to log: debug, info, warn or error")
+	flag.StringVar(&opts.metrics, "metrics", "", "where to publish metrics after every run: cloudwatch, or log to log them. An empty value disables metrics")
+	flag.StringVar(&opts.metricsNamespace, "metrics-namespace", "Smilodon", "the CloudWatch namespace of metrics")
+	flag.StringVar(&opts.events, "events", "", "where to send events of pairs being acquired, lost or released: eventbridge, sns, or log to log them. An empty value disables events")
+	flag.StringVar(&opts.eventsTopicARN, "events-topic-arn", "", "the ARN of an SNS topic to publish events to with --events=sns")
+	flag.IntVar(&opts.awsMaxRetries, "aws-max-retries", 8, "how many times to retry failed AWS API calls. Throttled calls are retried with jittered exponential backoff")
+	flag.DurationVar(&opts.awsTimeout, "aws-timeout", 2*time.Minute, "the deadline of every AWS API call, retries included. 0 disables it")
+	flag.Float64Var(&opts.awsRateLimit, "aws-rate-limit", 10, "the maximum rate of EC2 Describe and Attach calls per second. 0 disables it")
+	flag.StringVar(&opts.awsProfile, "aws-profile", "", "a profile of the shared AWS credentials file to use instead of the default credential chain")
+	flag.StringVar(&opts.awsRoleARN, "aws-role-arn", "", "the ARN of an IAM role to assume, for example a role in another account")
+	flag.StringVar(&opts.awsExternalID, "aws-external-id", "", "the external ID to assume --aws-role-arn with")
+	flag.BoolVar(&opts.awsSTSRegional, "aws-sts-regional-endpoint", false, "whether to assume --aws-role-arn with the STS endpoint of the region of the instance instead of the global one")
+	flag.StringVar(&opts.awsEndpoints, "aws-endpoints", "", "custom AWS endpoint URLs as a comma separated list of service=url, for example --aws-endpoints='ec2=https://vpce-1234.ec2.eu-west-1.vpce.amazonaws.com'. Services are ec2, route53, s3, sts, cloudwatch, events and sns")
+	flag.StringVar(&opts.awsCABundle, "aws-ca-bundle", "", "a PEM file of certificate authorities to trust when calling AWS endpoints")
+	flag.StringVar(&opts.metadataEndpoint, "metadata-endpoint", envOr("AWS_EC2_METADATA_SERVICE_ENDPOINT", "http://169.254.169.254"), "the URL of the EC2 instance metadata service. Defaults to $AWS_EC2_METADATA_SERVICE_ENDPOINT if set")
+	flag.DurationVar(&opts.metadataTimeout, "metadata-timeout", 5*time.Second, "the timeout of requests to the EC2 instance metadata service")
+	flag.StringVar(&opts.instanceID, "instance-id", os.Getenv("SMILODON_INSTANCE_ID"), "the ID of the instance, instead of reading it from the metadata service. Defaults to $SMILODON_INSTANCE_ID")
+	flag.StringVar(&opts.region, "region", os.Getenv("SMILODON_REGION"), "the region of the instance, instead of reading it from the metadata service. Defaults to $SMILODON_REGION")
+	flag.StringVar(&opts.az, "availability-zone", os.Getenv("SMILODON_AVAILABILITY_ZONE"), "the availability zone of the instance, instead of reading it from the metadata service. Defaults to $SMILODON_AVAILABILITY_ZONE")
+	flag.StringVar(&opts.hostRoot, "host-root", "", "the path, at which the host file system is mounted, when running in a container. Devices, mount points, /sys, /proc/sys and the host mount table are accessed below it")
+	flag.StringVar(&opts.hostExec, "host-exec", "", "how to run commands such as mkfs and mount in a container: empty to run them in the container, relying on mount propagation of --host-root, or nsenter to run host binaries in the mount namespace of the host, which needs the host PID namespace")
+	flag.StringVar(&opts.pairFile, "pair-file", "", "a file to write the pair of the instance to as JSON, for example on a volume shared with workloads. It is removed when the pair is released")
+	flag.StringVar(&opts.kubeNodeName, "kube-node-name", os.Getenv("SMILODON_KUBE_NODE_NAME"), "a Kubernetes node to label with the NodeID of the instance and to taint while it has no pair. Defaults to $SMILODON_KUBE_NODE_NAME. An empty value disables it")
+	flag.StringVar(&opts.kubeconfig, "kubeconfig", "", "a kubeconfig file to call the Kubernetes API server with. Defaults to the service account of the pod smilodon runs in")
+	flag.StringVar(&opts.consulService, "consul-service", "", "a Consul service name to register the pair with the local Consul agent under, once it is ready. An empty value disables it")
+	flag.StringVar(&opts.consulAddress, "consul-address", envOr("CONSUL_HTTP_ADDR", "http://127.0.0.1:8500"), "the address of the HTTP API of the local Consul agent. Defaults to $CONSUL_HTTP_ADDR if set")
+	flag.StringVar(&opts.consulToken, "consul-token", os.Getenv("CONSUL_HTTP_TOKEN"), "an ACL token to call the Consul agent with. Defaults to $CONSUL_HTTP_TOKEN")
+	flag.IntVar(&opts.consulPort, "consul-service-port", 0, "a port number of the Consul service")
+	flag.StringVar(&opts.consulTags, "consul-tags", "", "a comma-delimited list of resource tags to add to the Consul service as key=value tags. For example --consul-tags='Env,Role'")
+	flag.DurationVar(&opts.consulTTL, "consul-ttl", 5*time.Minute, "the TTL of the health check of the Consul service, which is passed on every run. It must be longer than the 2 minutes between runs")
 	flag.BoolVar(&opts.daemon, "daemon", true, "whether to run as daemon")
 	flag.BoolVar(&opts.help, "help", false, "print this message")
 	flag.BoolVar(&opts.version, "version", false, "print version and exit")
@@ -50,8 +202,28 @@ func init() {
 func main() {
 	flag.Parse()
 
-	if flag.NArg() > 0 || opts.help {
-		fmt.Fprintf(os.Stderr, "Usage: %q [OPTION]...\n", os.Args[0])
+	// A command may be followed by more options. The ctl command is followed
+	// by an action first.
+	var cmd, action string
+	if flag.NArg() > 0 {
+		cmd = flag.Arg(0)
+		args := flag.Args()[1:]
+		if cmd == "ctl" && len(args) > 0 {
+			action = args[0]
+			args = args[1:]
+		}
+		flag.CommandLine.Parse(args)
+	}
+
+	if flag.NArg() > 0 || opts.help || !validCommand(cmd) || (cmd == "ctl" && action == "") {
+		fmt.Fprintf(os.Stderr, "Usage: %q [OPTION]... [COMMAND]\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "\nCommands:")
+		fmt.Fprintln(os.Stderr, "  release\tunmount, detach and release the pair of this instance")
+		fmt.Fprintln(os.Stderr, "  drain\t\trelease the pair and stay paused until resumed")
+		fmt.Fprintln(os.Stderr, "  resume\tresume after drain")
+		fmt.Fprintln(os.Stderr, "  ctl ACTION\tsend an action to the running daemon: status, reconcile,")
+		fmt.Fprintln(os.Stderr, "\t\tpause, resume, release, drain or reload")
+		fmt.Fprintln(os.Stderr, "\nOptions:")
 		flag.PrintDefaults()
 		os.Exit(0)
 	}
@@ -61,88 +233,205 @@ func main() {
 		os.Exit(0)
 	}
 
-	var i instance
-	err := i.getMetadata()
+	flag.Visit(func(f *flag.Flag) {
+		cmdLineFlags[f.Name] = true
+	})
+	if opts.config != "" {
+		if err := loadConfigFile(opts.config); err != nil {
+			logger.Fatal("Failed to load config file", "path", opts.config, "error", err)
+		}
+	}
+
+	if cmd == "ctl" {
+		if err := ctl(opts.controlSocket, action); err != nil {
+			logger.Fatal("Control request failed", "action", action, "error", err)
+		}
+		os.Exit(0)
+	}
+
+	if err := parseOptions(); err != nil {
+		logger.Fatal("Invalid options", "error", err)
+	}
+
+	// A running daemon owns the pair, so it is asked to release it. Only
+	// without a daemon is the pair released by this process.
+	if (cmd == "release" || cmd == "drain") && opts.controlSocket != "" {
+		listening, err := controlListening(opts.controlSocket)
+		if err != nil {
+			logger.Fatal("Failed to connect to the control API", "path", opts.controlSocket, "error", err)
+		}
+		if listening {
+			if err := ctl(opts.controlSocket, cmd); err != nil {
+				logger.Fatal("Failed to release the pair", "error", err)
+			}
+			os.Exit(0)
+		}
+	}
+
+	if cmd == "resume" {
+		if err := resume(); err != nil {
+			logger.Fatal("Failed to remove pause file", "path", opts.pauseFile, "error", err)
+		}
+		logger.Info("Resumed")
+		os.Exit(0)
+	}
+
+	metadata = newMetadataClient(opts.metadataEndpoint, opts.metadataTimeout)
+	s, err := newAWSSession()
 	if err != nil {
-		log.Fatalf("Issues getting instance metadata properties. Exiting..")
+		logger.Fatal("Failed to create AWS session", "error", err)
+	}
+	awsSession = s
+	var i instance
+	if err := i.getMetadata(); err != nil {
+		logger.Fatal("Failed to get instance metadata properties, exiting")
+	}
+	restoreState(&i)
+	logger.setInstance(i)
+	if err := applyInstanceOptions(i); err != nil {
+		logger.Fatal("Invalid options", "error", err)
 	}
-	ec2c = ec2.New(session.New(), aws.NewConfig().WithRegion(i.region))
 	disableSourceDestCheck(i.id, ec2c)
-	filters = buildFilters(i)
+
+	if cmd == "release" || cmd == "drain" {
+		if err := release(&i, cmd == "drain"); err != nil {
+			logger.Fatal("Failed to release the pair", "error", err)
+		}
+		os.Exit(0)
+	}
 
 	if opts.daemon {
-		log.Println("Running as daemon")
+		logger.Info("Running as daemon")
+		signal.Notify(shutdown, syscall.SIGINT, syscall.SIGTERM)
+		go handleShutdown()
+		if opts.controlSocket != "" {
+			if err := serveControl(opts.controlSocket, opts.controlGroup); err != nil {
+				logger.Error("Failed to serve the control API", "path", opts.controlSocket, "error", err)
+			}
+		}
 	}
 
 	for {
 		run(&i)
-		time.Sleep(120 * time.Second)
+		logger.setInstance(i)
+		reportRun(i)
+		wait(&i, runInterval)
 	}
 }
 
-func run(i *instance) {
-	// Iterate over found volumes and check if one of them is attached to the
-	// instance, then update i.volume accordingly.
-	volumes, err := findVolumes(i, ec2c, filters)
-	if err != nil {
-		log.Println(err)
-	} else {
-		for _, v := range volumes {
-			if i.volume == nil && v.attachedTo == i.id && !v.available {
-				log.Printf("Found attached volume: %q.\n", v.id)
-				i.volume = &v
-				break
-			}
-			if i.volume != nil && i.volume.id == v.id && v.available {
-				i.volume = nil
-				break
-			}
+// runInterval is the interval between runs.
+const runInterval = 120 * time.Second
+
+// shutdown receives signals to shut down on.
+var shutdown = make(chan os.Signal, 1)
+
+// handleShutdown waits for a signal to shut down on, then deregisters the
+// Consul service and exits. It does not wait for a run in progress, which
+// can take several minutes while a volume attaches.
+func handleShutdown() {
+	sig := <-shutdown
+	logger.Info("Shutting down", "signal", sig)
+	stopConsul()
+	os.Exit(0)
+}
+
+// wait waits for interval d before the next run of instance i. Control
+// requests are serviced meanwhile and a reconcile request ends the wait early.
+func wait(i *instance, d time.Duration) {
+	next := time.Now().Add(d)
+	publishStatus(*i, next)
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			return
+		case <-reconcileNow:
+			logger.Info("Reconciling on request")
+			return
+		case req := <-controlRequests:
+			req.reply <- handleControlRequest(i, req.action)
+			logger.setInstance(*i)
+			publishStatus(*i, next)
 		}
 	}
+}
 
-	// Iterate over found network interfaces and see if one of them is attached
-	// to the instance, then update i.networkInterface accordingly.
-	networkInterfaces, err := findNetworkInterfaces(i, ec2c, filters)
-	if err != nil {
-		log.Println(err)
-	} else {
-		for _, n := range networkInterfaces {
-			if i.networkInterface == nil && n.attachedTo == i.id && !n.available {
-				log.Printf("Found attached network interface: %q.\n", n.id)
-				i.networkInterface = &n
-				break
-			}
-			if i.networkInterface != nil && i.networkInterface.id == n.id && n.available {
-				i.networkInterface = nil
-				break
-			}
+// envOr returns the value of environment variable name, or def if it is not
+// set.
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// validCommand reports whether cmd is a known command. No command runs the
+// main loop.
+func validCommand(cmd string) bool {
+	switch cmd {
+	case "", "release", "drain", "resume", "ctl":
+		return true
+	}
+	return false
+}
+
+func run(i *instance) {
+	logger.nextCycle()
+	if paused() {
+		logger.Info("Paused, not touching any pairs until the pause file is removed", "path", opts.pauseFile)
+		// Keep telling other AZs that the attached volume is in use.
+		heartbeat(i)
+		return
+	}
+
+	volumes, networkInterfaces, discoverErr := discover(i)
+	logger.setInstance(*i)
+	// A pair attached before the run started, as after a restart, has not
+	// been acquired by this run.
+	discovered := i.volume != nil && i.networkInterface != nil
+
+	// If either the volume or the network interface of a pair has gone, then
+	// the pair has been released. The volume group is only deactivated along
+	// with its volume, as it is still in use while the volume stays attached.
+	// A volume group left active is not in the way of reattaching the
+	// surviving resource, so failing to deactivate it is only logged.
+	if i.nodeID != "" && (i.volume == nil || i.networkInterface == nil) {
+		if i.volume == nil {
+			deactivateVolumeGroup(i.nodeID)
 		}
+		p := *i
+		releasePair(i)
+		pairGone(eventLost, p)
 	}
 
 	// If nothing is attached, then pick an available volume. We never want to
 	// attach a network interface if there is no volume attached first.
 	if i.volume == nil && i.networkInterface == nil {
-		log.Println("Neither a volume, nor a network interface are attached.")
-		for _, v := range volumes {
-			if v.available {
-				i.attachVolume(v, ec2c)
+		logger.Info("Neither a volume, nor a network interface are attached")
+		// Try candidates one by one, as another instance may attach the same
+		// volume at the same time.
+		for _, v := range candidateVolumes(volumes, networkInterfaces, i.id) {
+			if err := i.attachVolume(v, ec2c); err == nil {
 				break
 			}
 		}
 		if i.volume == nil {
-			log.Println("No available volumes found.")
+			logger.Info("No available volumes found")
+			if opts.crossAZFailover && needsFailover(volumes, discoverErr) {
+				i.failover()
+			}
 		}
 		if i.volume != nil {
 			for _, n := range networkInterfaces {
 				if n.available && i.volume.nodeID == n.nodeID {
-					_ = i.attachNetworkInterface(n, ec2c)
-					waitAndSetupIface(n.IPAddress)
+					i.attachPairInterface(n)
 					break
 				}
-				log.Println("No available network interfaces found.")
+				logger.Info("No available network interfaces found")
 			}
 		} else {
-			log.Println("No volumes appear to be attached, skipping network interface attachment.")
+			logger.Info("No volumes appear to be attached, skipping network interface attachment")
 		}
 	}
 
@@ -151,8 +440,7 @@ func run(i *instance) {
 	if i.volume != nil && i.networkInterface == nil {
 		for _, n := range networkInterfaces {
 			if n.available && n.nodeID == i.volume.nodeID {
-				_ = i.attachNetworkInterface(n, ec2c)
-				waitAndSetupIface(n.IPAddress)
+				i.attachPairInterface(n)
 				break
 			}
 		}
@@ -163,14 +451,14 @@ func run(i *instance) {
 	// volume after 3 tries, we release the network interface.
 	if i.networkInterface != nil && i.volume == nil {
 		if volumeAttachTries > 2 {
-			log.Println("Unable to attach a matching volume after 3 retries.")
-			if err := i.dettachNetworkInterface(); err == nil {
+			logger.Error("Unable to attach a matching volume after 3 retries")
+			if err := i.dettachPairInterface(); err == nil {
 				volumeAttachTries = 0
 			}
 		}
 		for _, v := range volumes {
 			if v.available && v.nodeID == i.networkInterface.nodeID {
-				log.Printf("Found a matching volume %q with NodeID %q.\n", v.id, v.nodeID)
+				logger.Info("Found a matching volume", "volume_id", v.id, "node_id", v.nodeID)
 				if err := i.attachVolume(v, ec2c); err == nil {
 					volumeAttachTries = 0
 					break
@@ -187,55 +475,263 @@ func run(i *instance) {
 	if i.volume != nil && i.networkInterface != nil {
 		if i.volume.nodeID == i.networkInterface.nodeID {
 			if i.nodeID != i.volume.nodeID {
-				i.nodeID = i.volume.nodeID
-				log.Printf("Node ID is %q.\n", i.nodeID)
-				writeEnvFile(opts.envFile, *i)
+				setNodeID(i, discovered)
 			}
 		}
 		// Set nodeID only when both volume and network interface are attached and their node IDs match.
 		if i.volume.nodeID != i.networkInterface.nodeID {
-			log.Printf("Something has gone wrong, volume and network interface node IDs do not match.")
+			logger.Error("Something has gone wrong, volume and network interface node IDs do not match", "volume_node_id", i.volume.nodeID, "eni_node_id", i.networkInterface.nodeID)
+		}
+		if i.nodeID != "" {
+			setupLocalNetwork(i)
+			heartbeat(i)
+			snapshotIfDue(i)
 		}
-		if opts.createFs {
-			if !hasFs(opts.blockDevice, opts.fsType) {
-				mkfs(opts.blockDevice, opts.fsType)
+		// Peers are looked up on every run, as they may come and go. Without
+		// them, the SRV record is left alone and templates are not rendered.
+		var peers []networkInterface
+		var peersFound bool
+		if i.nodeID != "" && ((dns != nil && dns.srvName != "") || len(templates) > 0) {
+			if ps, err := findPeers(i, ec2c); err != nil {
+				logger.Error("Failed to find peers", "error", err)
+			} else {
+				peers, peersFound = ps, true
 			}
 		}
-		if opts.mountFs {
-			if hasFs(opts.blockDevice, opts.fsType) && !isMounted(opts.blockDevice) {
-				mount(opts.blockDevice, opts.mountPoint, opts.fsType)
+		if i.nodeID != "" && dns != nil {
+			dns.upsert(*i, peers)
+		}
+		if i.nodeID != "" && len(templates) > 0 && peersFound {
+			renderTemplates(templates, newTemplateData(*i, peers), opts.reloadCmd)
+		}
+		// Only a device verified to be empty is ever formatted and only one
+		// verified to hold the expected file system is mounted.
+		d, err := mountDevice(i.nodeID)
+		if err != nil {
+			logger.Error("Failed to find the device to mount", "error", err)
+		}
+		if d != "" && (opts.createFs || opts.mountFs) && !isMounted(d) {
+			state, err := probeDevice(d, opts.fsType)
+			if err != nil {
+				logger.Warn("Not touching device", "device", d, "error", err)
+			}
+			if opts.createFs && state == deviceEmpty && i.bootstrap(d) == nil {
+				state, _ = probeDevice(d, opts.fsType)
+			}
+			if opts.mountFs && state == deviceFormatted {
+				if !opts.checkFs || checkFs(d, opts.fsType) == nil {
+					if mount(d, opts.mountPoint, opts.fsType) == nil && opts.growFs {
+						growFs(d, opts.mountPoint, opts.fsType)
+					}
+				}
 			}
 		}
+		writePairFile(*i)
 		if !opts.daemon {
-			log.Println("All done, exiting...")
+			updateKubeNode(*i)
+			persistState(*i)
+			reportRun(*i)
+			logger.Info("All done, exiting")
 			os.Exit(0)
 		}
 	}
+
+	updateKubeNode(*i)
+	updateConsul(*i)
+	persistState(*i)
+}
+
+// discover finds volumes and network interfaces matching filters and updates
+// the volume and the network interface attached to instance i accordingly. It
+// returns the first error, if either could not be found.
+func discover(i *instance) ([]volume, []networkInterface, error) {
+	// Iterate over found volumes and check if one of them is attached to the
+	// instance, then update i.volume accordingly.
+	volumes, err := findVolumes(i, ec2c, filters)
+	discoverErr := err
+	if err != nil {
+		logger.Error("Failed to discover volumes", "error", err)
+	} else {
+		// Prefer the volume recorded in the state file, in case more than one
+		// volume appears to be attached to the instance.
+		if i.volume == nil && lastState != nil {
+			for _, v := range volumes {
+				if v.id == lastState.VolumeID && v.attachedTo == i.id && !v.available {
+					logger.Info("Found attached volume recorded in the state file", "volume_id", v.id)
+					i.volume = &v
+					break
+				}
+			}
+		}
+		for _, v := range volumes {
+			if i.volume == nil && v.attachedTo == i.id && !v.available {
+				logger.Info("Found attached volume", "volume_id", v.id)
+				i.volume = &v
+				break
+			}
+			if i.volume != nil && i.volume.id == v.id && v.available {
+				i.volume = nil
+				break
+			}
+		}
+	}
+
+	// Iterate over found network interfaces and see if one of them is attached
+	// to the instance, then update i.networkInterface accordingly.
+	var networkInterfaces []networkInterface
+	if opts.addressMode == addressModeNetworkInterface {
+		networkInterfaces, err = findNetworkInterfaces(i, ec2c, filters)
+	} else {
+		networkInterfaces, err = findAddresses(i, ec2c, volumes)
+	}
+	if err != nil {
+		logger.Error("Failed to discover network interfaces", "error", err)
+		if discoverErr == nil {
+			discoverErr = err
+		}
+	} else {
+		if i.networkInterface == nil && lastState != nil {
+			for _, n := range networkInterfaces {
+				if n.id == lastState.NetworkInterfaceID && n.attachedTo == i.id && !n.available {
+					logger.Info("Found attached network interface recorded in the state file", "eni_id", n.id)
+					i.networkInterface = &n
+					break
+				}
+			}
+		}
+		for _, n := range networkInterfaces {
+			if i.networkInterface == nil && n.attachedTo == i.id && !n.available {
+				logger.Info("Found attached network interface", "eni_id", n.id)
+				i.networkInterface = &n
+				break
+			}
+			if i.networkInterface != nil && i.networkInterface.id == n.id && n.available {
+				i.networkInterface = nil
+				break
+			}
+		}
+	}
+	return volumes, networkInterfaces, discoverErr
+}
+
+// attachPairInterface attaches a network interface n to an instance i, or
+// assigns an address n to it, depending on the address mode.
+func (i *instance) attachPairInterface(n networkInterface) {
+	if opts.addressMode != addressModeNetworkInterface {
+		if err := i.assignAddress(n, ec2c); err == nil {
+			setupLocalAddress(n.IPAddress, i)
+		}
+		return
+	}
+	_ = i.attachNetworkInterface(n, ec2c)
+	waitAndSetupIface(n)
+}
+
+// dettachPairInterface detaches a network interface of an instance i, or
+// unassigns its address, depending on the address mode.
+func (i *instance) dettachPairInterface() error {
+	if opts.addressMode != addressModeNetworkInterface {
+		return i.unassignAddress()
+	}
+	return i.dettachNetworkInterface()
+}
+
+// setNodeID sets the NodeID and IP of instance i from its attached pair. A
+// discovered pair, which was attached before the run, is taken over without
+// a pairing event or time to pair, as this process did not acquire it.
+func setNodeID(i *instance, discovered bool) {
+	i.nodeID = i.volume.nodeID
+	i.nodeIP = i.networkInterface.IPAddress
+	if opts.addressMode == addressModeNetworkInterface {
+		i.networkInterface.ipv6Addresses = getIPv6AddressesFromMetadata(i.networkInterface.mac)
+	}
+	if discovered {
+		logger.Info("Found node ID of the attached pair")
+	} else {
+		logger.Info("Acquired node ID")
+		pairAcquired(*i)
+	}
+	logger.setInstance(*i)
+	writeEnvFiles(envFiles, *i)
+}
+
+// releasePair cleans up after a pair of instance i that is no longer
+// attached. The volume group of the pair is left to the caller.
+func releasePair(i *instance) {
+	logger.Info("Pair has been released")
+	if dns != nil {
+		dns.remove(i.nodeID, i.nodeIP)
+	}
+	removePairFile()
+	nodeID := i.nodeID
+	i.nodeID = ""
+	i.nodeIP = ""
+	logger.setInstance(*i)
+	updateKubeNode(*i)
+	deregisterConsul(nodeID)
 }
 
-// waitAndSetupIface blocks until network interface becomes ready and gets an
-// IP, then set needed sysctl settings.
-func waitAndSetupIface(ip string) {
+// waitAndSetupIface blocks until network interface n becomes ready and gets
+// an IP, then set needed sysctl settings. If interface configuration is
+// enabled, the interface is looked up by its MAC address and configured
+// instead of waiting for an IP.
+func waitAndSetupIface(n networkInterface) {
 	for tries := 0; tries < 5; tries++ {
 		time.Sleep(5 * time.Second)
 
-		iface, err := getIfaceNameByIP(ip)
+		n.ipv6Addresses = getIPv6AddressesFromMetadata(n.mac)
+		var iface string
+		var err error
+		if opts.configIface {
+			iface, err = getIfaceNameByMAC(n.mac)
+		} else {
+			iface, err = getIfaceNameByIP(append([]string{n.IPAddress}, n.ipv6Addresses...)...)
+		}
 		if err != nil {
-			log.Printf("failed to get interface name: %v", err)
+			logger.Error("Failed to get interface name", "error", err)
 		}
 		if iface == "" {
 			continue
 		}
+		if len(n.ipv6Addresses) > 0 {
+			if err := setNetIPv6(iface); err != nil {
+				logger.Error("Failed to set IPv6 sysctls", "iface", iface, "error", err)
+			}
+		}
+		if opts.configIface {
+			if err := configureIface(iface, n, opts.routeTable); err != nil {
+				logger.Error("Failed to configure interface", "iface", iface, "error", err)
+				continue
+			}
+		}
 		if err := setNetRPFilter(iface); err != nil {
-			log.Printf("failed to set rp_filter: %v", err)
+			logger.Error("Failed to set rp_filter", "iface", iface, "error", err)
 		} else {
 			break
 		}
 	}
 }
 
-// getIfaceNameByIP returns network interface name by IP address.
-func getIfaceNameByIP(ip string) (string, error) {
+// setupLocalNetwork makes sure the stable IP address of an instance i is
+// configured locally, for example after a reboot, when the network interface
+// stays attached but its configuration is gone.
+func setupLocalNetwork(i *instance) {
+	if opts.addressMode != addressModeNetworkInterface {
+		setupLocalAddress(i.networkInterface.IPAddress, i)
+		return
+	}
+	if !opts.configIface {
+		return
+	}
+	if iface, err := getIfaceNameByIP(i.networkInterface.IPAddress); err == nil && iface != "" {
+		return
+	}
+	waitAndSetupIface(*i.networkInterface)
+}
+
+// getIfaceNameByIP returns network interface name by any of IP addresses ips.
+// IPv4 and IPv6 addresses can be mixed.
+func getIfaceNameByIP(ips ...string) (string, error) {
 	var name string
 	ifaces, err := net.Interfaces()
 	if err != nil {
@@ -251,8 +747,10 @@ func getIfaceNameByIP(ip string) (string, error) {
 			if err != nil {
 				return name, err
 			}
-			if netIP.Equal(net.ParseIP(ip)) {
-				name = iface.Name
+			for _, ip := range ips {
+				if netIP.Equal(net.ParseIP(ip)) {
+					name = iface.Name
+				}
 			}
 		}
 	}
@@ -263,15 +761,29 @@ func getIfaceNameByIP(ip string) (string, error) {
 // This is needed to accept asymmetrically routed (outgoing routes and incoming
 // routes are different) packets on iface interface.
 func setNetRPFilter(iface string) error {
-	key := fmt.Sprintf("/proc/sys/net/ipv4/conf/%s/rp_filter", iface)
+	return writeSysctl(fmt.Sprintf("/proc/sys/net/ipv4/conf/%s/rp_filter", iface), "2")
+}
+
+// setNetIPv6 enables IPv6 on iface interface and makes it accept router
+// advertisements, which is how the VPC router announces the IPv6 gateway.
+// There is no IPv6 equivalent of rp_filter, so nothing else is needed to
+// accept asymmetrically routed packets.
+func setNetIPv6(iface string) error {
+	if err := writeSysctl(fmt.Sprintf("/proc/sys/net/ipv6/conf/%s/disable_ipv6", iface), "0"); err != nil {
+		return err
+	}
+	return writeSysctl(fmt.Sprintf("/proc/sys/net/ipv6/conf/%s/accept_ra", iface), "1")
+}
 
-	f, err := os.OpenFile(key, os.O_WRONLY, 0644)
+// writeSysctl writes value to a sysctl key path.
+func writeSysctl(key, value string) error {
+	f, err := os.OpenFile(hostPath(key), os.O_WRONLY, 0644)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
-	if _, err := f.WriteString("2\n"); err != nil {
+	if _, err := f.WriteString(value + "\n"); err != nil {
 		return err
 	}
 	return nil
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRunLostPair(t *testing.T) {
+	tests := []struct {
+		name string
+		// setup adds what is left of the pair of NodeID 2 to the fake EC2 API.
+		setup func(f *fakeEC2)
+		// deactivated records whether the volume group is deactivated.
+		deactivated bool
+	}{
+		{"network interface lost", func(f *fakeEC2) {
+			f.addVolume("vol-2", "eu-west-1b", map[string]string{"NodeID": "2", "Service": "etcd"})
+			f.attach("vol-2", "i-local")
+		}, false},
+		{"volume lost", func(f *fakeEC2) {
+			f.addENI("eni-2", "subnet-b", "10.0.2.10", map[string]string{"NodeID": "2", "Service": "etcd"})
+			f.attach("eni-2", "i-local")
+			f.addVolume("vol-2", "eu-west-1b", map[string]string{"NodeID": "2", "Service": "etcd"})
+		}, true},
+	}
+	for _, tt := range tests {
+		f, i, restore := stubFailover(t)
+		opts.crossAZFailover = false
+		opts.stateFile = ""
+		opts.daemon = true
+		root, err := ioutil.TempDir("", "smilodon")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Deactivating the volume group always fails.
+		opts.volumeGroup = "vg-%s"
+		opts.logicalVolume = "data"
+		stubCommands(t, root, map[string]map[string]fakeCmd{"vgchange": {"*": {exit: 5}}})
+		tt.setup(f)
+		i.nodeID, i.nodeIP = "2", "10.0.2.10"
+
+		run(i)
+		calls := strings.Join(stubCalls(root), "\n")
+		if got := strings.Contains(calls, "vgchange -an vg-2"); got != tt.deactivated {
+			t.Errorf("%s: got volume group deactivated %v, want %v", tt.name, got, tt.deactivated)
+		}
+		if n := f.count("DetachVolume"); n != 0 {
+			t.Errorf("%s: got %d volumes detached, want none", tt.name, n)
+		}
+		// A failed deactivation does not keep the volume from being reattached.
+		if v := f.volumes["vol-2"]; v.attachedTo != "i-local" {
+			t.Errorf("%s: got vol-2 attached to %q, want i-local", tt.name, v.attachedTo)
+		}
+		restore()
+		os.RemoveAll(root)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+// metadataTokenTTL is how long IMDSv2 session tokens are valid for.
+const metadataTokenTTL = 6 * time.Hour
+
+// metadata is the client of the instance metadata service.
+var metadata *metadataClient
+
+// metadataClient reads the EC2 instance metadata service. It uses IMDSv2
+// session tokens, which work with a hop limit of 1 from containers too, and
+// only falls back to IMDSv1 if the service does not issue tokens.
+type metadataClient struct {
+	endpoint string
+	client   *http.Client
+
+	mu          sync.Mutex
+	token       string
+	tokenExpiry time.Time
+	// v1 is set if the service does not issue tokens.
+	v1 bool
+}
+
+// newMetadataClient returns a client of the metadata service at endpoint,
+// which gives up on requests not completed within timeout.
+func newMetadataClient(endpoint string, timeout time.Duration) *metadataClient {
+	return &metadataClient{
+		endpoint: strings.TrimRight(endpoint, "/"),
+		// The metadata service must never be reached through a proxy.
+		client: &http.Client{
+			Timeout:   timeout,
+			Transport: &http.Transport{Proxy: nil},
+		},
+	}
+}
+
+// sessionToken returns a valid IMDSv2 session token, or an empty token if the
+// service only supports IMDSv1.
+func (c *metadataClient) sessionToken() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.v1 {
+		return "", nil
+	}
+	// Renew tokens a minute early, so that they do not expire in flight.
+	if c.token != "" && time.Now().Add(time.Minute).Before(c.tokenExpiry) {
+		return c.token, nil
+	}
+	req, err := http.NewRequest("PUT", c.endpoint+"/latest/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", strconv.Itoa(int(metadataTokenTTL/time.Second)))
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		c.token = string(body)
+		c.tokenExpiry = time.Now().Add(metadataTokenTTL)
+		return c.token, nil
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		logger.Warn("The metadata service does not issue session tokens, falling back to IMDSv1", "endpoint", c.endpoint)
+		c.v1 = true
+		return "", nil
+	}
+	return "", fmt.Errorf("failed to get a metadata session token: %s", resp.Status)
+}
+
+// get returns the value of metadata path p relative to /latest/.
+func (c *metadataClient) get(p string) (string, error) {
+	for attempt := 0; ; attempt++ {
+		token, err := c.sessionToken()
+		if err != nil {
+			return "", err
+		}
+		req, err := http.NewRequest("GET", c.endpoint+"/latest/"+p, nil)
+		if err != nil {
+			return "", err
+		}
+		if token != "" {
+			req.Header.Set("X-aws-ec2-metadata-token", token)
+		}
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return "", err
+		}
+		switch {
+		case resp.StatusCode == http.StatusOK:
+			return string(body), nil
+		case resp.StatusCode == http.StatusUnauthorized && attempt == 0:
+			// The token has expired or been revoked, get a new one.
+			c.mu.Lock()
+			c.token = ""
+			c.mu.Unlock()
+			continue
+		}
+		return "", fmt.Errorf("failed to get metadata %q: %s", p, resp.Status)
+	}
+}
+
+// getMetadata returns the value of instance metadata path p relative to
+// /latest/meta-data/.
+func (c *metadataClient) getMetadata(p string) (string, error) {
+	return c.get("meta-data/" + p)
+}
+
+// region returns the region of the instance from its identity document.
+func (c *metadataClient) region() (string, error) {
+	doc, err := c.get("dynamic/instance-identity/document")
+	if err != nil {
+		return "", err
+	}
+	var d struct {
+		Region string `json:"region"`
+	}
+	if err := json.Unmarshal([]byte(doc), &d); err != nil {
+		return "", err
+	}
+	if d.Region == "" {
+		return "", fmt.Errorf("no region in the instance identity document")
+	}
+	return d.Region, nil
+}
+
+// metadataRoleProvider retrieves credentials of the instance role from the
+// metadata service. It replaces the provider of the AWS SDK, which predates
+// IMDSv2.
+type metadataRoleProvider struct {
+	credentials.Expiry
+}
+
+func (p *metadataRoleProvider) Retrieve() (credentials.Value, error) {
+	roles, err := metadata.getMetadata("iam/security-credentials/")
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	role := strings.TrimSpace(strings.SplitN(roles, "\n", 2)[0])
+	if role == "" {
+		return credentials.Value{}, fmt.Errorf("no instance role found")
+	}
+	data, err := metadata.getMetadata("iam/security-credentials/" + role)
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	var c struct {
+		Code            string
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string
+		Token           string
+		Expiration      time.Time
+	}
+	if err := json.Unmarshal([]byte(data), &c); err != nil {
+		return credentials.Value{}, err
+	}
+	if c.Code != "Success" {
+		return credentials.Value{}, fmt.Errorf("failed to get credentials of instance role %q: %s", role, c.Code)
+	}
+	// Refresh credentials before they expire.
+	p.SetExpiration(c.Expiration, 5*time.Minute)
+	return credentials.Value{
+		AccessKeyID:     c.AccessKeyID,
+		SecretAccessKey: c.SecretAccessKey,
+		SessionToken:    c.Token,
+		ProviderName:    "metadataRoleProvider",
+	}, nil
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeIMDS is an instance metadata service serving values by path relative
+// to /latest/.
+type fakeIMDS struct {
+	values map[string]string
+	// tokenStatus, if set, is returned for token requests, as by a service
+	// which only supports IMDSv1.
+	tokenStatus int
+
+	mu sync.Mutex
+	// token is the current session token. Requests with any other token are
+	// rejected.
+	token string
+	// tokens is the number of issued tokens.
+	tokens int
+	// requests lists requested paths.
+	requests []string
+}
+
+func (f *fakeIMDS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	if r.URL.Path == "/latest/api/token" {
+		if r.Method != "PUT" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if f.tokenStatus != 0 {
+			w.WriteHeader(f.tokenStatus)
+			return
+		}
+		if ttl := r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds"); ttl != "21600" {
+			http.Error(w, "invalid TTL "+ttl, http.StatusBadRequest)
+			return
+		}
+		f.tokens++
+		f.token = fmt.Sprintf("token-%d", f.tokens)
+		fmt.Fprint(w, f.token)
+		return
+	}
+	if f.tokenStatus == 0 && r.Header.Get("X-aws-ec2-metadata-token") != f.token {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	v, ok := f.values[strings.TrimPrefix(r.URL.Path, "/latest/")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	fmt.Fprint(w, v)
+}
+
+// revoke revokes the current session token.
+func (f *fakeIMDS) revoke() {
+	f.mu.Lock()
+	f.token = "revoked"
+	f.mu.Unlock()
+}
+
+// stubMetadata serves f as the metadata service.
+func stubMetadata(f *fakeIMDS) func() {
+	s := httptest.NewServer(f)
+	saved := metadata
+	metadata = newMetadataClient(s.URL+"/", time.Second)
+	return func() {
+		metadata = saved
+		s.Close()
+	}
+}
+
+func TestMetadataSessionToken(t *testing.T) {
+	f := &fakeIMDS{values: map[string]string{"meta-data/instance-id": "i-1234"}}
+	defer stubMetadata(f)()
+
+	for n := 0; n < 2; n++ {
+		if id, err := metadata.getMetadata("instance-id"); err != nil || id != "i-1234" {
+			t.Fatalf("getMetadata = %q, %v, want i-1234", id, err)
+		}
+	}
+	if f.tokens != 1 {
+		t.Errorf("got %d tokens, want 1 reused token", f.tokens)
+	}
+
+	// A revoked token is renewed once.
+	f.revoke()
+	if id, err := metadata.getMetadata("instance-id"); err != nil || id != "i-1234" {
+		t.Fatalf("getMetadata after 401 = %q, %v, want i-1234", id, err)
+	}
+	if f.tokens != 2 {
+		t.Errorf("got %d tokens, want 2", f.tokens)
+	}
+
+	if _, err := metadata.getMetadata("missing"); err == nil {
+		t.Error("getMetadata of a missing path succeeded")
+	}
+}
+
+func TestMetadataIMDSv1(t *testing.T) {
+	for _, status := range []int{http.StatusNotFound, http.StatusMethodNotAllowed} {
+		f := &fakeIMDS{values: map[string]string{"meta-data/instance-id": "i-1234"}, tokenStatus: status}
+		restore := stubMetadata(f)
+		for n := 0; n < 2; n++ {
+			if id, err := metadata.getMetadata("instance-id"); err != nil || id != "i-1234" {
+				t.Errorf("%d: getMetadata = %q, %v, want i-1234", status, id, err)
+			}
+		}
+		want := []string{"PUT /latest/api/token", "GET /latest/meta-data/instance-id", "GET /latest/meta-data/instance-id"}
+		if strings.Join(f.requests, ",") != strings.Join(want, ",") {
+			t.Errorf("%d: got requests %v, want %v", status, f.requests, want)
+		}
+		restore()
+	}
+
+	// Any other failure is not mistaken for IMDSv1.
+	f := &fakeIMDS{tokenStatus: http.StatusForbidden}
+	defer stubMetadata(f)()
+	if _, err := metadata.getMetadata("instance-id"); err == nil {
+		t.Error("getMetadata succeeded without a token")
+	}
+}
+
+func TestMetadataRegion(t *testing.T) {
+	tests := []struct {
+		doc  string
+		want string
+	}{
+		{`{"region": "eu-west-1", "availabilityZone": "eu-west-1a"}`, "eu-west-1"},
+		{`{"availabilityZone": "eu-west-1a"}`, ""},
+		{`not json`, ""},
+	}
+	for _, tt := range tests {
+		f := &fakeIMDS{values: map[string]string{"dynamic/instance-identity/document": tt.doc}}
+		restore := stubMetadata(f)
+		region, err := metadata.region()
+		if region != tt.want || (err == nil) != (tt.want != "") {
+			t.Errorf("region of %s = %q, %v, want %q", tt.doc, region, err, tt.want)
+		}
+		restore()
+	}
+}
+
+func TestMetadataRoleProvider(t *testing.T) {
+	creds := func(code string, expiration time.Time) string {
+		data, _ := json.Marshal(map[string]interface{}{
+			"Code":            code,
+			"AccessKeyId":     "AKID",
+			"SecretAccessKey": "SECRET",
+			"Token":           "TOKEN",
+			"Expiration":      expiration,
+		})
+		return string(data)
+	}
+	f := &fakeIMDS{values: map[string]string{
+		"meta-data/iam/security-credentials/":     "etcd\n",
+		"meta-data/iam/security-credentials/etcd": creds("Success", time.Now().Add(time.Hour)),
+	}}
+	defer stubMetadata(f)()
+
+	p := &metadataRoleProvider{}
+	v, err := p.Retrieve()
+	if err != nil {
+		t.Fatalf("Retrieve: %v", err)
+	}
+	if v.AccessKeyID != "AKID" || v.SecretAccessKey != "SECRET" || v.SessionToken != "TOKEN" {
+		t.Errorf("got credentials %+v", v)
+	}
+	if p.IsExpired() {
+		t.Error("credentials valid for an hour have expired")
+	}
+
+	// Credentials are refreshed 5 minutes before they expire.
+	f.values["meta-data/iam/security-credentials/etcd"] = creds("Success", time.Now().Add(4*time.Minute))
+	if _, err := p.Retrieve(); err != nil {
+		t.Fatalf("Retrieve: %v", err)
+	}
+	if !p.IsExpired() {
+		t.Error("credentials expiring in 4 minutes have not expired")
+	}
+
+	f.values["meta-data/iam/security-credentials/etcd"] = creds("AssumeRoleUnauthorizedAccess", time.Time{})
+	if _, err := p.Retrieve(); err == nil {
+		t.Error("Retrieve succeeded with a failure code")
+	}
+	f.values["meta-data/iam/security-credentials/"] = ""
+	if _, err := p.Retrieve(); err == nil {
+		t.Error("Retrieve succeeded without a role")
+	}
+}
+
+func TestIdentify(t *testing.T) {
+	f := &fakeIMDS{values: map[string]string{
+		"meta-data/instance-id":                 "i-1234",
+		"meta-data/placement/availability-zone": "eu-west-1a",
+		"dynamic/instance-identity/document":    `{"region": "eu-west-1"}`,
+	}}
+	defer stubMetadata(f)()
+	saved := opts
+	defer func() { opts = saved }()
+
+	tests := []struct {
+		instanceID, region, az string
+		want                   instance
+		requests               int
+	}{
+		{"", "", "", instance{id: "i-1234", region: "eu-west-1", az: "eu-west-1a"}, 4},
+		// The session token above is reused.
+		{"", "us-east-1", "", instance{id: "i-1234", region: "us-east-1", az: "eu-west-1a"}, 2},
+		// The metadata service is not needed at all.
+		{"i-5678", "us-east-1", "us-east-1b", instance{id: "i-5678", region: "us-east-1", az: "us-east-1b"}, 0},
+	}
+	for _, tt := range tests {
+		f.requests = nil
+		opts.instanceID, opts.region, opts.az = tt.instanceID, tt.region, tt.az
+		var i instance
+		if err := i.identify(); err != nil {
+			t.Errorf("identify: %v", err)
+			continue
+		}
+		if i.id != tt.want.id || i.region != tt.want.region || i.az != tt.want.az {
+			t.Errorf("got %s, %s, %s, want %s, %s, %s", i.id, i.region, i.az, tt.want.id, tt.want.region, tt.want.az)
+		}
+		if len(f.requests) != tt.requests {
+			t.Errorf("got metadata requests %v, want %d", f.requests, tt.requests)
+		}
+	}
+}
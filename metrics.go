@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/cloudwatchevents"
+	"github.com/aws/aws-sdk-go/service/cloudwatchevents/cloudwatcheventsiface"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+)
+
+// Metrics published after every run.
+const (
+	// metricPaired is 1 if the instance has a pair, 0 otherwise.
+	metricPaired = "Paired"
+	// metricTimeToPair is how long it took to acquire a pair, in seconds. It
+	// is only published by the run, which acquired the pair.
+	metricTimeToPair = "TimeToPair"
+	// metricAttachFailures is the number of failed attachments in a run.
+	metricAttachFailures = "AttachFailures"
+	// metricReconcileErrors is the number of errors logged in a run.
+	metricReconcileErrors = "ReconcileErrors"
+	// metricThrottles is the number of throttled AWS API calls in a run.
+	metricThrottles = "Throttles"
+)
+
+// Types of pairing events.
+const (
+	eventAcquired = "acquired"
+	eventLost     = "lost"
+	eventReleased = "released"
+)
+
+// metric is a data point of a metric.
+type metric struct {
+	name  string
+	unit  string
+	value float64
+}
+
+// metricsSink publishes metrics of an instance.
+type metricsSink interface {
+	// put publishes data points ms of instance i.
+	put(i instance, ms []metric) error
+}
+
+// pairEvent records a pair being acquired, lost or released by an instance.
+type pairEvent struct {
+	Type               string    `json:"type"`
+	Time               time.Time `json:"time"`
+	InstanceID         string    `json:"instance_id"`
+	AvailabilityZone   string    `json:"availability_zone"`
+	AutoScalingGroup   string    `json:"auto_scaling_group,omitempty"`
+	NodeID             string    `json:"node_id"`
+	NodeIP             string    `json:"node_ip,omitempty"`
+	VolumeID           string    `json:"volume_id,omitempty"`
+	NetworkInterfaceID string    `json:"network_interface_id,omitempty"`
+}
+
+// eventSink sends pairing events.
+type eventSink interface {
+	send(e pairEvent) error
+}
+
+var (
+	metrics metricsSink
+	events  eventSink
+
+	// unpairedSince is when the instance was last left without a pair.
+	unpairedSince = time.Now()
+	// timeToPair is how long acquiring the current pair took, until it is
+	// published.
+	timeToPair time.Duration
+	// attachFailures is the number of failed attachments in the current run.
+	attachFailures int
+)
+
+// validMetricsSink reports whether name is a known metrics sink. An empty
+// name disables metrics.
+func validMetricsSink(name string) bool {
+	switch name {
+	case "", "cloudwatch", "log":
+		return true
+	}
+	return false
+}
+
+// validEventSink reports whether name is a known event sink. An empty name
+// disables events.
+func validEventSink(name string) bool {
+	switch name {
+	case "", "eventbridge", "sns", "log":
+		return true
+	}
+	return false
+}
+
+// newMetricsSink returns a metrics sink by name. CloudWatch metrics are
+// published to namespace in region.
+func newMetricsSink(name, namespace, region string) metricsSink {
+	switch name {
+	case "cloudwatch":
+		return &cloudWatchMetrics{
+			cwc:       cloudwatch.New(awsSession, awsConfig("cloudwatch", region)),
+			namespace: namespace,
+		}
+	case "log":
+		return logMetrics{}
+	}
+	return nil
+}
+
+// newEventSink returns an event sink by name. SNS events are published to
+// topicARN in region.
+func newEventSink(name, topicARN, region string) eventSink {
+	switch name {
+	case "eventbridge":
+		return &eventBridgeEvents{
+			cwec: cloudwatchevents.New(awsSession, awsConfig("events", region)),
+		}
+	case "sns":
+		return &snsEvents{
+			snsc:     sns.New(awsSession, awsConfig("sns", region)),
+			topicARN: topicARN,
+		}
+	case "log":
+		return logEvents{}
+	}
+	return nil
+}
+
+// cloudWatchMetrics publishes metrics to CloudWatch with two dimension sets:
+// one of the instance and one of its NodeID, so that a NodeID can be followed
+// across instances. Both hold the Auto Scaling group, if any.
+type cloudWatchMetrics struct {
+	cwc       cloudwatchiface.CloudWatchAPI
+	namespace string
+}
+
+func (c *cloudWatchMetrics) put(i instance, ms []metric) error {
+	dimensions := func(name, value string) []*cloudwatch.Dimension {
+		var dims []*cloudwatch.Dimension
+		if i.asg != "" {
+			dims = append(dims, &cloudwatch.Dimension{Name: aws.String("AutoScalingGroupName"), Value: aws.String(i.asg)})
+		}
+		return append(dims, &cloudwatch.Dimension{Name: aws.String(name), Value: aws.String(value)})
+	}
+	dimSets := [][]*cloudwatch.Dimension{dimensions("InstanceId", i.id)}
+	// An unpaired instance has no NodeID to publish metrics of.
+	if i.nodeID != "" {
+		dimSets = append(dimSets, dimensions("NodeID", i.nodeID))
+	}
+
+	now := time.Now()
+	data := make([]*cloudwatch.MetricDatum, 0, len(dimSets)*len(ms))
+	for _, dims := range dimSets {
+		for _, m := range ms {
+			data = append(data, &cloudwatch.MetricDatum{
+				MetricName: aws.String(m.name),
+				Dimensions: dims,
+				Timestamp:  aws.Time(now),
+				Unit:       aws.String(m.unit),
+				Value:      aws.Float64(m.value),
+			})
+		}
+	}
+	_, err := c.cwc.PutMetricData(&cloudwatch.PutMetricDataInput{
+		Namespace:  aws.String(c.namespace),
+		MetricData: data,
+	})
+	return err
+}
+
+// logMetrics logs metrics instead of publishing them.
+type logMetrics struct{}
+
+func (logMetrics) put(i instance, ms []metric) error {
+	var kv []interface{}
+	for _, m := range ms {
+		kv = append(kv, m.name, m.value)
+	}
+	logger.Info("Metrics", kv...)
+	return nil
+}
+
+// eventBridgeEvents sends events to the default event bus of CloudWatch
+// Events (EventBridge).
+type eventBridgeEvents struct {
+	cwec cloudwatcheventsiface.CloudWatchEventsAPI
+}
+
+func (c *eventBridgeEvents) send(e pairEvent) error {
+	detail, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	r, err := c.cwec.PutEvents(&cloudwatchevents.PutEventsInput{
+		Entries: []*cloudwatchevents.PutEventsRequestEntry{
+			{
+				Source:     aws.String("smilodon"),
+				DetailType: aws.String("Pair " + strings.Title(e.Type)),
+				Detail:     aws.String(string(detail)),
+				Time:       aws.Time(e.Time),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if aws.Int64Value(r.FailedEntryCount) > 0 {
+		return fmt.Errorf("event rejected: %s", aws.StringValue(r.Entries[0].ErrorMessage))
+	}
+	return nil
+}
+
+// snsEvents publishes events to an SNS topic.
+type snsEvents struct {
+	snsc     snsiface.SNSAPI
+	topicARN string
+}
+
+func (c *snsEvents) send(e pairEvent) error {
+	msg, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = c.snsc.Publish(&sns.PublishInput{
+		TopicArn: aws.String(c.topicARN),
+		Subject:  aws.String(fmt.Sprintf("smilodon: pair %s %s", e.NodeID, e.Type)),
+		Message:  aws.String(string(msg)),
+	})
+	return err
+}
+
+// logEvents logs events instead of sending them.
+type logEvents struct{}
+
+func (logEvents) send(e pairEvent) error {
+	logger.Info("Pair event", "type", e.Type, "node_id", e.NodeID, "node_ip", e.NodeIP, "volume_id", e.VolumeID, "eni_id", e.NetworkInterfaceID)
+	return nil
+}
+
+// pairAcquired records instance i acquiring a pair.
+func pairAcquired(i instance) {
+	timeToPair = time.Since(unpairedSince)
+	sendPairEvent(eventAcquired, i)
+}
+
+// pairGone records instance i losing or releasing its pair, depending on
+// event type t.
+func pairGone(t string, i instance) {
+	unpairedSince = time.Now()
+	timeToPair = 0
+	sendPairEvent(t, i)
+}
+
+// sendPairEvent sends a pairing event of type t of instance i.
+func sendPairEvent(t string, i instance) {
+	if events == nil {
+		return
+	}
+	e := pairEvent{
+		Type:             t,
+		Time:             time.Now().UTC(),
+		InstanceID:       i.id,
+		AvailabilityZone: i.az,
+		AutoScalingGroup: i.asg,
+		NodeID:           i.nodeID,
+		NodeIP:           i.nodeIP,
+	}
+	if i.volume != nil {
+		e.VolumeID = i.volume.id
+	}
+	if i.networkInterface != nil {
+		e.NetworkInterfaceID = i.networkInterfaceID()
+	}
+	if err := events.send(e); err != nil {
+		logger.Error("Failed to send pair event", "type", t, "error", err)
+	}
+}
+
+// reportRun publishes metrics of instance i after a run.
+func reportRun(i instance) {
+	ms := []metric{
+		{metricPaired, cloudwatch.StandardUnitCount, 0},
+		{metricAttachFailures, cloudwatch.StandardUnitCount, float64(attachFailures)},
+		{metricReconcileErrors, cloudwatch.StandardUnitCount, float64(logger.cycleErrors())},
+		{metricThrottles, cloudwatch.StandardUnitCount, float64(throttles)},
+	}
+	if i.nodeID != "" {
+		ms[0].value = 1
+	}
+	if timeToPair > 0 {
+		ms = append(ms, metric{metricTimeToPair, cloudwatch.StandardUnitSeconds, timeToPair.Seconds()})
+	}
+	attachFailures = 0
+	throttles = 0
+	if metrics == nil {
+		timeToPair = 0
+		return
+	}
+	if err := metrics.put(i, ms); err != nil {
+		logger.Error("Failed to publish metrics", "error", err)
+		return
+	}
+	timeToPair = 0
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/cloudwatchevents"
+	"github.com/aws/aws-sdk-go/service/cloudwatchevents/cloudwatcheventsiface"
+)
+
+// recordingMetrics records published metrics by name.
+type recordingMetrics struct {
+	puts []map[string]float64
+}
+
+func (r *recordingMetrics) put(i instance, ms []metric) error {
+	p := make(map[string]float64)
+	for _, m := range ms {
+		p[m.name] = m.value
+	}
+	r.puts = append(r.puts, p)
+	return nil
+}
+
+// recordingEvents records sent events.
+type recordingEvents struct {
+	events []pairEvent
+}
+
+func (r *recordingEvents) send(e pairEvent) error {
+	r.events = append(r.events, e)
+	return nil
+}
+
+// stubMetrics replaces the metrics and event sinks with recording ones.
+func stubMetrics() (*recordingMetrics, *recordingEvents, func()) {
+	savedOpts, savedMetrics, savedEvents := opts, metrics, events
+	savedSince, savedTimeToPair := unpairedSince, timeToPair
+	rm, re := &recordingMetrics{}, &recordingEvents{}
+	metrics, events = rm, re
+	opts.addressMode = addressModeSecondaryIP
+	timeToPair = 0
+	attachFailures, throttles = 0, 0
+	logger.nextCycle()
+	return rm, re, func() {
+		opts, metrics, events = savedOpts, savedMetrics, savedEvents
+		unpairedSince, timeToPair = savedSince, savedTimeToPair
+	}
+}
+
+// attachedPair returns an instance with an attached pair of NodeID 1,
+// which has no NodeID set yet.
+func attachedPair() *instance {
+	return &instance{
+		id:                      "i-1234",
+		az:                      "eu-west-1a",
+		primaryNetworkInterface: "eni-primary",
+		volume:                  &volume{id: "vol-1", nodeID: "1"},
+		networkInterface:        &networkInterface{id: "eni-1", nodeID: "1", IPAddress: "10.0.1.10"},
+	}
+}
+
+func TestReportRun(t *testing.T) {
+	rm, _, restore := stubMetrics()
+	defer restore()
+
+	i := attachedPair()
+	reportRun(*i)
+	unpairedSince = time.Now().Add(-time.Minute)
+	setNodeID(i, false)
+	attachFailures, throttles = 2, 3
+	reportRun(*i)
+	reportRun(*i)
+
+	want := []map[string]float64{
+		{metricPaired: 0, metricAttachFailures: 0, metricReconcileErrors: 0, metricThrottles: 0},
+		{metricPaired: 1, metricAttachFailures: 2, metricReconcileErrors: 0, metricThrottles: 3},
+		// The time to pair is only published once and counters are reset.
+		{metricPaired: 1, metricAttachFailures: 0, metricReconcileErrors: 0, metricThrottles: 0},
+	}
+	if len(rm.puts) != len(want) {
+		t.Fatalf("got %d puts, want %d", len(rm.puts), len(want))
+	}
+	if ttp := rm.puts[1][metricTimeToPair]; ttp < 60 || ttp > 120 {
+		t.Errorf("got time to pair %v, want about 60 seconds", ttp)
+	}
+	delete(rm.puts[1], metricTimeToPair)
+	if !reflect.DeepEqual(rm.puts, want) {
+		t.Errorf("got metrics %v, want %v", rm.puts, want)
+	}
+}
+
+func TestPairEvents(t *testing.T) {
+	rm, re, restore := stubMetrics()
+	defer restore()
+
+	i := attachedPair()
+	setNodeID(i, false)
+	p := *i
+	i.nodeID, i.nodeIP = "", ""
+	pairGone(eventReleased, p)
+	if timeToPair != 0 {
+		t.Errorf("time to pair %v has not been reset when the pair was released", timeToPair)
+	}
+
+	want := []pairEvent{
+		{Type: eventAcquired, InstanceID: "i-1234", AvailabilityZone: "eu-west-1a", NodeID: "1", NodeIP: "10.0.1.10", VolumeID: "vol-1", NetworkInterfaceID: "eni-primary"},
+		{Type: eventReleased, InstanceID: "i-1234", AvailabilityZone: "eu-west-1a", NodeID: "1", NodeIP: "10.0.1.10", VolumeID: "vol-1", NetworkInterfaceID: "eni-primary"},
+	}
+	for n := range re.events {
+		if re.events[n].Time.IsZero() {
+			t.Errorf("event %d has no time", n)
+		}
+		re.events[n].Time = time.Time{}
+	}
+	if !reflect.DeepEqual(re.events, want) {
+		t.Errorf("got events %+v, want %+v", re.events, want)
+	}
+
+	// A pair found attached after a restart has not been acquired.
+	re.events = nil
+	i = attachedPair()
+	setNodeID(i, true)
+	if i.nodeID != "1" || i.nodeIP != "10.0.1.10" {
+		t.Errorf("got NodeID %q and IP %q, want 1 and 10.0.1.10", i.nodeID, i.nodeIP)
+	}
+	if len(re.events) != 0 {
+		t.Errorf("got events %+v for a discovered pair, want none", re.events)
+	}
+	reportRun(*i)
+	if _, ok := rm.puts[len(rm.puts)-1][metricTimeToPair]; ok {
+		t.Error("time to pair has been published for a discovered pair")
+	}
+}
+
+// fakeCloudWatch records PutMetricData calls.
+type fakeCloudWatch struct {
+	cloudwatchiface.CloudWatchAPI
+	inputs []*cloudwatch.PutMetricDataInput
+}
+
+func (f *fakeCloudWatch) PutMetricData(in *cloudwatch.PutMetricDataInput) (*cloudwatch.PutMetricDataOutput, error) {
+	f.inputs = append(f.inputs, in)
+	return &cloudwatch.PutMetricDataOutput{}, nil
+}
+
+func TestCloudWatchMetrics(t *testing.T) {
+	f := &fakeCloudWatch{}
+	c := &cloudWatchMetrics{cwc: f, namespace: "Smilodon"}
+	ms := []metric{
+		{metricPaired, cloudwatch.StandardUnitCount, 1},
+		{metricTimeToPair, cloudwatch.StandardUnitSeconds, 42},
+	}
+	tests := []struct {
+		i instance
+		// dimSets are dimensions of the data points of each metric.
+		dimSets []map[string]string
+	}{
+		{
+			instance{id: "i-1234", asg: "etcd", nodeID: "1"},
+			[]map[string]string{
+				{"AutoScalingGroupName": "etcd", "InstanceId": "i-1234"},
+				{"AutoScalingGroupName": "etcd", "NodeID": "1"},
+			},
+		},
+		{
+			instance{id: "i-1234", nodeID: "1"},
+			[]map[string]string{{"InstanceId": "i-1234"}, {"NodeID": "1"}},
+		},
+		// Without a pair, only the instance data points are published.
+		{
+			instance{id: "i-1234", asg: "etcd"},
+			[]map[string]string{{"AutoScalingGroupName": "etcd", "InstanceId": "i-1234"}},
+		},
+	}
+	for _, tt := range tests {
+		f.inputs = nil
+		if err := c.put(tt.i, ms); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+		if len(f.inputs) != 1 {
+			t.Fatalf("got %d PutMetricData calls, want 1", len(f.inputs))
+		}
+		in := f.inputs[0]
+		if aws.StringValue(in.Namespace) != "Smilodon" {
+			t.Errorf("got namespace %q, want Smilodon", aws.StringValue(in.Namespace))
+		}
+		if len(in.MetricData) != len(tt.dimSets)*len(ms) {
+			t.Fatalf("got %d data points, want %d", len(in.MetricData), len(tt.dimSets)*len(ms))
+		}
+		for n, d := range in.MetricData {
+			want := ms[n%len(ms)]
+			if aws.StringValue(d.MetricName) != want.name || aws.StringValue(d.Unit) != want.unit || aws.Float64Value(d.Value) != want.value {
+				t.Errorf("got data point %s, want %+v", d, want)
+			}
+			dims := make(map[string]string)
+			for _, dim := range d.Dimensions {
+				dims[aws.StringValue(dim.Name)] = aws.StringValue(dim.Value)
+			}
+			if wantDims := tt.dimSets[n/len(ms)]; !reflect.DeepEqual(dims, wantDims) {
+				t.Errorf("got dimensions %v, want %v", dims, wantDims)
+			}
+		}
+	}
+}
+
+// fakeEventBridge records PutEvents calls.
+type fakeEventBridge struct {
+	cloudwatcheventsiface.CloudWatchEventsAPI
+	entries []*cloudwatchevents.PutEventsRequestEntry
+}
+
+func (f *fakeEventBridge) PutEvents(in *cloudwatchevents.PutEventsInput) (*cloudwatchevents.PutEventsOutput, error) {
+	f.entries = append(f.entries, in.Entries...)
+	return &cloudwatchevents.PutEventsOutput{FailedEntryCount: aws.Int64(0)}, nil
+}
+
+func TestEventBridgeEvents(t *testing.T) {
+	f := &fakeEventBridge{}
+	c := &eventBridgeEvents{cwec: f}
+	e := pairEvent{Type: eventLost, Time: time.Date(2016, 6, 1, 10, 0, 0, 0, time.UTC), InstanceID: "i-1234", NodeID: "1"}
+	if err := c.send(e); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if len(f.entries) != 1 {
+		t.Fatalf("got %d entries, want 1", len(f.entries))
+	}
+	entry := f.entries[0]
+	if aws.StringValue(entry.Source) != "smilodon" || aws.StringValue(entry.DetailType) != "Pair Lost" {
+		t.Errorf("got source %q and detail type %q, want smilodon and Pair Lost", aws.StringValue(entry.Source), aws.StringValue(entry.DetailType))
+	}
+	var detail pairEvent
+	if err := json.Unmarshal([]byte(aws.StringValue(entry.Detail)), &detail); err != nil {
+		t.Fatalf("invalid detail: %v", err)
+	}
+	if !reflect.DeepEqual(detail, e) {
+		t.Errorf("got detail %+v, want %+v", detail, e)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// Routing policy rule constants missing from the syscall package.
+const (
+	fraSrc       = 2
+	fraPriority  = 6
+	fraTable     = 15
+	frActToTable = 1
+	sizeofRule   = 12
+)
+
+var nativeEndian binary.ByteOrder = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// netlinkHandle is a minimal rtnetlink client, which configures links,
+// addresses, routes and routing policy rules. It operates in the network
+// namespace of the calling process, so it can be exercised in a throwaway
+// namespace, for example with `ip netns exec`.
+type netlinkHandle struct {
+	fd  int
+	seq uint32
+}
+
+// newNetlinkHandle opens a rtnetlink socket.
+func newNetlinkHandle() (*netlinkHandle, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return &netlinkHandle{fd: fd}, nil
+}
+
+// Close closes the rtnetlink socket.
+func (h *netlinkHandle) Close() error {
+	return syscall.Close(h.fd)
+}
+
+// linkUp brings a link with index up.
+func (h *netlinkHandle) linkUp(index int) error {
+	b := make([]byte, syscall.SizeofIfInfomsg)
+	b[0] = syscall.AF_UNSPEC
+	nativeEndian.PutUint32(b[4:], uint32(index))
+	nativeEndian.PutUint32(b[8:], syscall.IFF_UP)
+	nativeEndian.PutUint32(b[12:], syscall.IFF_UP)
+	return h.request(syscall.RTM_NEWLINK, 0, b)
+}
+
+// addrDel removes an address ip with a prefix length from a link with index.
+func (h *netlinkHandle) addrDel(index int, ip net.IP, prefix int) error {
+	return h.request(syscall.RTM_DELADDR, 0, addrMsg(index, ip, prefix))
+}
+
+// addrReplace assigns an address ip with a prefix length to a link with
+// index, replacing an existing one.
+func (h *netlinkHandle) addrReplace(index int, ip net.IP, prefix int) error {
+	return h.request(syscall.RTM_NEWADDR, syscall.NLM_F_CREATE|syscall.NLM_F_REPLACE, addrMsg(index, ip, prefix))
+}
+
+// addrMsg returns an address message of ip with a prefix length on a link
+// with index.
+func addrMsg(index int, ip net.IP, prefix int) []byte {
+	family, addr := ipFamily(ip)
+	b := make([]byte, syscall.SizeofIfAddrmsg)
+	b[0] = family
+	b[1] = byte(prefix)
+	b[3] = syscall.RT_SCOPE_UNIVERSE
+	nativeEndian.PutUint32(b[4:], uint32(index))
+	b = appendAttr(b, syscall.IFA_LOCAL, addr)
+	b = appendAttr(b, syscall.IFA_ADDRESS, addr)
+	return b
+}
+
+// route is a route in a routing table.
+type route struct {
+	table int
+	index int
+	// dst is nil for a default route.
+	dst *net.IPNet
+	// gw is nil for a link scope route.
+	gw  net.IP
+	src net.IP
+}
+
+// routeReplace adds a route r, replacing an existing one.
+func (h *netlinkHandle) routeReplace(r route) error {
+	b := make([]byte, syscall.SizeofRtMsg)
+	b[4] = syscall.RT_TABLE_UNSPEC
+	b[5] = syscall.RTPROT_STATIC
+	b[6] = syscall.RT_SCOPE_UNIVERSE
+	b[7] = syscall.RTN_UNICAST
+	if r.gw == nil {
+		b[6] = syscall.RT_SCOPE_LINK
+	}
+	if r.dst != nil {
+		family, addr := ipFamily(r.dst.IP)
+		ones, _ := r.dst.Mask.Size()
+		b[0] = family
+		b[1] = byte(ones)
+		b = appendAttr(b, syscall.RTA_DST, addr)
+	}
+	if r.gw != nil {
+		family, addr := ipFamily(r.gw)
+		b[0] = family
+		b = appendAttr(b, syscall.RTA_GATEWAY, addr)
+	}
+	if r.src != nil {
+		_, addr := ipFamily(r.src)
+		b = appendAttr(b, syscall.RTA_PREFSRC, addr)
+	}
+	b = appendAttr(b, syscall.RTA_OIF, uint32Attr(uint32(r.index)))
+	b = appendAttr(b, syscall.RTA_TABLE, uint32Attr(uint32(r.table)))
+	return h.request(syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_REPLACE, b)
+}
+
+// ruleReplace adds a routing policy rule, which looks up table for packets
+// sourced from src. Existing rules for src with the same priority are removed
+// first, so that rules do not pile up.
+func (h *netlinkHandle) ruleReplace(src net.IP, table, priority int) error {
+	family, addr := ipFamily(src)
+	b := make([]byte, sizeofRule)
+	b[0] = family
+	b[2] = byte(len(addr) * 8)
+	b[7] = frActToTable
+	b = appendAttr(b, fraSrc, addr)
+	b = appendAttr(b, fraTable, uint32Attr(uint32(table)))
+	b = appendAttr(b, fraPriority, uint32Attr(uint32(priority)))
+	for {
+		err := h.request(syscall.RTM_DELRULE, 0, b)
+		if err == syscall.ENOENT {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return h.request(syscall.RTM_NEWRULE, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, b)
+}
+
+// defaultGateway returns the gateway of a default route via a link with index
+// in the main routing table, or nil if there is none. If ipv6 is true, IPv6
+// routes are looked up, otherwise IPv4 routes.
+func (h *netlinkHandle) defaultGateway(index int, ipv6 bool) (net.IP, error) {
+	family := syscall.AF_INET
+	if ipv6 {
+		family = syscall.AF_INET6
+	}
+	rib, err := syscall.NetlinkRIB(syscall.RTM_GETROUTE, family)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range msgs {
+		if m.Header.Type != syscall.RTM_NEWROUTE || len(m.Data) < syscall.SizeofRtMsg {
+			continue
+		}
+		// Skip non-default routes and routes outside of the main table.
+		if m.Data[1] != 0 || m.Data[4] != syscall.RT_TABLE_MAIN {
+			continue
+		}
+		attrs, err := syscall.ParseNetlinkRouteAttr(&m)
+		if err != nil {
+			return nil, err
+		}
+		var gw net.IP
+		var oif int
+		for _, a := range attrs {
+			switch a.Attr.Type {
+			case syscall.RTA_GATEWAY:
+				gw = net.IP(a.Value)
+			case syscall.RTA_OIF:
+				oif = int(nativeEndian.Uint32(a.Value))
+			}
+		}
+		if oif == index && gw != nil {
+			return gw, nil
+		}
+	}
+	return nil, nil
+}
+
+// request sends a netlink message of type typ with data and waits for an
+// acknowledgement.
+func (h *netlinkHandle) request(typ, flags uint16, data []byte) error {
+	seq := atomic.AddUint32(&h.seq, 1)
+	msg := make([]byte, syscall.NLMSG_HDRLEN, syscall.NLMSG_HDRLEN+len(data))
+	nativeEndian.PutUint32(msg[0:], uint32(syscall.NLMSG_HDRLEN+len(data)))
+	nativeEndian.PutUint16(msg[4:], typ)
+	nativeEndian.PutUint16(msg[6:], flags|syscall.NLM_F_REQUEST|syscall.NLM_F_ACK)
+	nativeEndian.PutUint32(msg[8:], seq)
+	msg = append(msg, data...)
+	if err := syscall.Sendto(h.fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, syscall.Getpagesize())
+	for {
+		n, _, err := syscall.Recvfrom(h.fd, buf, 0)
+		if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != seq || m.Header.Type != syscall.NLMSG_ERROR {
+				continue
+			}
+			if len(m.Data) < 4 {
+				return fmt.Errorf("short netlink error message")
+			}
+			if errno := int32(nativeEndian.Uint32(m.Data[0:4])); errno != 0 {
+				return syscall.Errno(-errno)
+			}
+			return nil
+		}
+	}
+}
+
+// appendAttr appends a netlink attribute of type typ with data to b.
+func appendAttr(b []byte, typ uint16, data []byte) []byte {
+	l := syscall.SizeofRtAttr + len(data)
+	attr := make([]byte, (l+syscall.RTA_ALIGNTO-1) & ^(syscall.RTA_ALIGNTO-1))
+	nativeEndian.PutUint16(attr[0:], uint16(l))
+	nativeEndian.PutUint16(attr[2:], typ)
+	copy(attr[syscall.SizeofRtAttr:], data)
+	return append(b, attr...)
+}
+
+// uint32Attr returns v encoded as netlink attribute data.
+func uint32Attr(v uint32) []byte {
+	b := make([]byte, 4)
+	nativeEndian.PutUint32(b, v)
+	return b
+}
+
+// ipFamily returns the address family of ip and its raw address bytes.
+func ipFamily(ip net.IP) (byte, []byte) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return syscall.AF_INET, ip4
+	}
+	return syscall.AF_INET6, ip.To16()
+}
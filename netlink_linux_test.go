@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// roundTripFunc serves HTTP requests with a function.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// enterNetns moves the calling test into a new network namespace. The locked
+// thread is never unlocked, so it is discarded together with the namespace
+// when the test ends.
+func enterNetns(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("creating a network namespace needs root")
+	}
+	if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("ip from iproute2 is not installed")
+	}
+	runtime.LockOSThread()
+	if err := syscall.Unshare(syscall.CLONE_NEWNET); err != nil {
+		t.Skipf("failed to create a network namespace: %v", err)
+	}
+}
+
+// ip runs ip with args in the network namespace of the test.
+func ip(t *testing.T, args ...string) string {
+	o, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("ip %s: %v: %s", strings.Join(args, " "), err, o)
+	}
+	return string(o)
+}
+
+func TestConfigureIface(t *testing.T) {
+	enterNetns(t)
+	ip(t, "link", "add", "veth0", "type", "veth", "peer", "name", "veth1")
+	ip(t, "link", "set", "veth1", "up")
+
+	// The metadata service does not know the interface, so the subnet CIDR
+	// found by the EC2 API is used.
+	saved := metadata
+	defer func() { metadata = saved }()
+	metadata = &metadataClient{
+		endpoint: "http://metadata",
+		client: &http.Client{
+			Timeout: time.Second,
+			Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+				return &http.Response{StatusCode: http.StatusNotFound, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+			}),
+		},
+	}
+
+	n := networkInterface{
+		id:         "eni-1234",
+		IPAddress:  "10.1.2.10",
+		subnetCIDR: "10.1.2.0/24",
+		mac:        "02:00:00:00:00:01",
+	}
+	// Configuring twice must not duplicate anything.
+	for run := 0; run < 2; run++ {
+		if err := configureIface("veth0", n, 1001); err != nil {
+			t.Fatalf("configureIface: %v", err)
+		}
+	}
+
+	if addr := ip(t, "-4", "-o", "addr", "show", "dev", "veth0"); !strings.Contains(addr, "inet 10.1.2.10/24") {
+		t.Errorf("veth0 is missing address 10.1.2.10/24: %s", addr)
+	}
+	if link := ip(t, "-o", "link", "show", "dev", "veth0"); !strings.Contains(link, ",UP") {
+		t.Errorf("veth0 is not up: %s", link)
+	}
+
+	routes := ip(t, "-4", "route", "show", "table", "1001")
+	for _, want := range []string{
+		"default via 10.1.2.1 dev veth0 proto static src 10.1.2.10",
+		"10.1.2.0/24 dev veth0 proto static scope link src 10.1.2.10",
+	} {
+		if !strings.Contains(routes, want) {
+			t.Errorf("table 1001 is missing route %q: %s", want, routes)
+		}
+	}
+
+	rules := ip(t, "-4", "rule", "show")
+	if c := strings.Count(rules, "from 10.1.2.10 lookup 1001"); c != 1 {
+		t.Errorf("got %d rules for 10.1.2.10, want 1: %s", c, rules)
+	}
+	if !strings.Contains(rules, "1001:\tfrom 10.1.2.10 lookup 1001") {
+		t.Errorf("rule for 10.1.2.10 does not have priority 1001: %s", rules)
+	}
+}
@@ -0,0 +1,55 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+var errNetlinkUnsupported = errors.New("netlink is only supported on linux")
+
+// netlinkHandle is a stub on platforms without rtnetlink.
+type netlinkHandle struct{}
+
+// route is a route in a routing table.
+type route struct {
+	table int
+	index int
+	dst   *net.IPNet
+	gw    net.IP
+	src   net.IP
+}
+
+func newNetlinkHandle() (*netlinkHandle, error) {
+	return nil, errNetlinkUnsupported
+}
+
+func (h *netlinkHandle) Close() error {
+	return errNetlinkUnsupported
+}
+
+func (h *netlinkHandle) linkUp(index int) error {
+	return errNetlinkUnsupported
+}
+
+func (h *netlinkHandle) addrDel(index int, ip net.IP, prefix int) error {
+	return errNetlinkUnsupported
+}
+
+func (h *netlinkHandle) addrReplace(index int, ip net.IP, prefix int) error {
+	return errNetlinkUnsupported
+}
+
+func (h *netlinkHandle) routeReplace(r route) error {
+	return errNetlinkUnsupported
+}
+
+func (h *netlinkHandle) ruleReplace(src net.IP, table, priority int) error {
+	return errNetlinkUnsupported
+}
+
+func (h *netlinkHandle) defaultGateway(index int, ipv6 bool) (net.IP, error) {
+	return nil, errNetlinkUnsupported
+}
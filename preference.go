@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseNodeIDs parses a comma-delimited list of NodeIDs and NodeID ranges,
+// for example "3" or "1-3,7". Ranges are only supported for numeric NodeIDs.
+func parseNodeIDs(s string) ([]string, error) {
+	var ids []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.Split(item, "-")
+		if len(parts) != 2 {
+			ids = append(ids, item)
+			continue
+		}
+		from, errFrom := strconv.Atoi(parts[0])
+		to, errTo := strconv.Atoi(parts[1])
+		if errFrom != nil || errTo != nil {
+			// Not a numeric range, so a NodeID containing a dash.
+			ids = append(ids, item)
+			continue
+		}
+		if from > to {
+			return nil, fmt.Errorf("invalid node ID range %q", item)
+		}
+		for n := from; n <= to; n++ {
+			ids = append(ids, strconv.Itoa(n))
+		}
+	}
+	return uniqueStrings(ids), nil
+}
+
+// preferredNodeIDs returns NodeIDs in order of preference: the NodeID held
+// before a restart or a reboot first, then NodeIDs given by
+// --preferred-node-id.
+func preferredNodeIDs() []string {
+	var ids []string
+	if lastState != nil && lastState.LastNodeID != "" {
+		ids = append(ids, lastState.LastNodeID)
+	}
+	return uniqueStrings(append(ids, preferredIDs...))
+}
+
+// candidateVolumes returns available volumes vs in the order instance id
+// should try them. Volumes with preferred NodeIDs come first. Other volumes,
+// ordered by the selection strategy, are only returned once the preference
+// timeout since startup has passed, or if there are no preferred NodeIDs at
+// all. Volumes claimed by another instance are left out. Network interfaces ns
+// are passed to the selection strategy.
+func candidateVolumes(vs []volume, ns []networkInterface, id string) []volume {
+	var unclaimed []volume
+	for _, v := range vs {
+		if !claimedByOther(v.tags, id) {
+			unclaimed = append(unclaimed, v)
+		}
+	}
+	vs = unclaimed
+	preferred := preferredNodeIDs()
+	var candidates []volume
+	for _, id := range preferred {
+		for _, v := range vs {
+			if v.available && v.nodeID == id {
+				candidates = append(candidates, v)
+			}
+		}
+	}
+	if len(preferred) > 0 && time.Since(startTime) < opts.preferredTimeout {
+		if len(candidates) == 0 {
+			logger.Info("Waiting for a volume with a preferred node ID to become available", "preferred_node_id", preferred)
+		}
+		return candidates
+	}
+	var others []volume
+	for _, v := range vs {
+		if v.available && !containsString(preferred, v.nodeID) {
+			others = append(others, v)
+		}
+	}
+	return append(candidates, strategy.order(others, ns)...)
+}
+
+// containsString reports whether s contains v.
+func containsString(s []string, v string) bool {
+	for _, i := range s {
+		if i == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseNodeIDs(t *testing.T) {
+	tests := []struct {
+		s    string
+		want []string
+		err  bool
+	}{
+		{"", nil, false},
+		{"3", []string{"3"}, false},
+		{"1-3, 7", []string{"1", "2", "3", "7"}, false},
+		// Order is kept and duplicates are dropped.
+		{"7,1-3,2", []string{"7", "1", "2", "3"}, false},
+		{"etcd-a,db-1", []string{"etcd-a", "db-1"}, false},
+		{"3-3", []string{"3"}, false},
+		{"3-1", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseNodeIDs(tt.s)
+		if (err != nil) != tt.err {
+			t.Errorf("parseNodeIDs(%q) error = %v, want error %v", tt.s, err, tt.err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseNodeIDs(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
+
+// stubPreference sets the NodeID held before a restart, preferred NodeIDs
+// and how long ago smilodon started.
+func stubPreference(last string, preferred []string, started time.Duration) func() {
+	savedOpts, savedState, savedIDs := opts, lastState, preferredIDs
+	savedStart, savedStrategy := startTime, strategy
+	lastState = nil
+	if last != "" {
+		lastState = &state{InstanceID: "i-local", LastNodeID: last}
+	}
+	preferredIDs = preferred
+	opts.preferredTimeout = 5 * time.Minute
+	startTime = time.Now().Add(-started)
+	strategy = lowestStrategy{}
+	return func() {
+		opts, lastState, preferredIDs = savedOpts, savedState, savedIDs
+		startTime, strategy = savedStart, savedStrategy
+	}
+}
+
+func TestPreferredNodeIDs(t *testing.T) {
+	tests := []struct {
+		last      string
+		preferred []string
+		want      []string
+	}{
+		{"", nil, nil},
+		{"2", nil, []string{"2"}},
+		{"", []string{"3", "1"}, []string{"3", "1"}},
+		// The NodeID held before comes first and is not repeated.
+		{"1", []string{"3", "1"}, []string{"1", "3"}},
+	}
+	for _, tt := range tests {
+		restore := stubPreference(tt.last, tt.preferred, 0)
+		if got := preferredNodeIDs(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("preferredNodeIDs with %q and %v = %v, want %v", tt.last, tt.preferred, got, tt.want)
+		}
+		restore()
+	}
+}
+
+func TestCandidateVolumes(t *testing.T) {
+	claimed := map[string]string{tagClaim: claimValue("i-other", time.Now())}
+	expired := map[string]string{tagClaim: claimValue("i-other", time.Now().Add(-2*claimTTL))}
+	vs := []volume{
+		{id: "vol-4", nodeID: "4", available: true},
+		{id: "vol-3", nodeID: "3", available: true},
+		{id: "vol-2", nodeID: "2", available: false},
+		{id: "vol-1", nodeID: "1", available: true},
+		{id: "vol-5", nodeID: "5", available: true, tags: claimed},
+		{id: "vol-6", nodeID: "6", available: true, tags: expired},
+	}
+	tests := []struct {
+		name      string
+		last      string
+		preferred []string
+		started   time.Duration
+		want      string
+	}{
+		{"no preference", "", nil, 0, "1,3,4,6"},
+		{"preferred NodeIDs in order", "", []string{"3", "1"}, 0, "3,1"},
+		{"held NodeID first", "4", []string{"3"}, 0, "4,3"},
+		{"wait for an attached preferred NodeID", "2", nil, time.Minute, ""},
+		{"wait for a claimed preferred NodeID", "", []string{"5"}, time.Minute, ""},
+		{"unknown preferred NodeID", "", []string{"9"}, time.Minute, ""},
+		{"fall back after the timeout", "2", []string{"3"}, 10 * time.Minute, "3,1,4,6"},
+		{"expired claim", "", []string{"6"}, 0, "6"},
+	}
+	for _, tt := range tests {
+		restore := stubPreference(tt.last, tt.preferred, tt.started)
+		var ids []string
+		for _, v := range candidateVolumes(vs, nil, "i-local") {
+			ids = append(ids, v.nodeID)
+		}
+		if got := strings.Join(ids, ","); got != tt.want {
+			t.Errorf("%s: got candidates %q, want %q", tt.name, got, tt.want)
+		}
+		restore()
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// paused reports whether the pause file exists. A paused smilodon does not
+// attach or reclaim any pairs.
+func paused() bool {
+	f := currentOpts().pauseFile
+	if f == "" {
+		return false
+	}
+	_, err := os.Stat(f)
+	return err == nil
+}
+
+// pause creates the pause file recording why smilodon has been paused.
+func pause(reason string) error {
+	f := currentOpts().pauseFile
+	if f == "" {
+		return fmt.Errorf("no pause file configured")
+	}
+	if err := os.MkdirAll(path.Dir(f), 0755); err != nil {
+		return err
+	}
+	data := fmt.Sprintf("%s at %s\n", reason, time.Now().UTC().Format(time.RFC3339))
+	return ioutil.WriteFile(f, []byte(data), 0644)
+}
+
+// resume removes the pause file.
+func resume() error {
+	f := currentOpts().pauseFile
+	if f == "" {
+		return nil
+	}
+	err := os.Remove(f)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// release gives up the pair of instance i: it runs the pre-release hook,
+// unmounts the mount point, detaches the network interface and the volume
+// and waits until both are available. smilodon is paused while releasing,
+// so that a running daemon does not reclaim the pair halfway. If keepPaused
+// is set, it stays paused afterwards, which drains the instance.
+func release(i *instance, keepPaused bool) (err error) {
+	if err := pause("Releasing"); err != nil {
+		logger.Error("Failed to create pause file", "path", opts.pauseFile, "error", err)
+		return err
+	}
+	defer func() {
+		if keepPaused {
+			if e := pause("Drained"); e != nil && err == nil {
+				err = e
+			}
+		} else if e := resume(); e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	discover(i)
+	if i.volume == nil && i.networkInterface == nil {
+		logger.Info("Neither a volume, nor a network interface are attached, nothing to release")
+		return nil
+	}
+	if i.nodeID == "" && i.volume != nil {
+		i.nodeID = i.volume.nodeID
+	}
+	if i.nodeIP == "" && i.networkInterface != nil {
+		i.nodeIP = i.networkInterface.IPAddress
+	}
+	logger.Info("Releasing pair")
+
+	env := os.Environ()
+	if i.volume != nil && i.networkInterface != nil {
+		for _, v := range envVars(*i) {
+			env = append(env, v.key+"="+v.value)
+		}
+	}
+	if err := runHook("Pre-release", opts.preReleaseHook, env); err != nil {
+		return err
+	}
+	if opts.mountFs && isMountPoint(opts.mountPoint) {
+		if err := unmount(opts.mountPoint); err != nil {
+			return err
+		}
+		logger.Info("Unmounted file system", "mount_point", opts.mountPoint)
+	}
+	// The volume must not be detached while its volume group is active.
+	if err := deactivateVolumeGroup(i.nodeID); err != nil {
+		return err
+	}
+	p := *i
+	releasePair(i)
+	pairGone(eventReleased, p)
+
+	if i.networkInterface != nil {
+		id := i.networkInterface.id
+		if err := i.dettachPairInterface(); err != nil {
+			return err
+		}
+		if opts.addressMode == addressModeNetworkInterface {
+			if err := ec2c.WaitUntilNetworkInterfaceAvailable(&ec2.DescribeNetworkInterfacesInput{
+				NetworkInterfaceIds: []*string{aws.String(id)},
+			}); err != nil {
+				logger.Error("Failed to wait for network interface to become available", "eni_id", id, "error", err)
+				return err
+			}
+		}
+	}
+	if i.volume != nil {
+		id := i.volume.id
+		if err := detachVolume(id); err != nil {
+			return err
+		}
+		if opts.strategy == "least-recently-used" || opts.crossAZFailover {
+			tagVolumeTimestamp(id, tagDetachedAt, ec2c)
+		}
+		i.volume = nil
+	}
+	volumeAttachTries = 0
+	persistState(*i)
+	logger.Info("Pair released")
+	return nil
+}
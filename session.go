@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// awsSession is the AWS session shared by all AWS clients. Clients set their
+// own region and endpoint with awsConfig.
+var awsSession *session.Session
+
+// awsEndpoints are custom endpoint URLs keyed by service name.
+var awsEndpoints map[string]string
+
+// awsServices are names of services, which endpoints can be set of.
+var awsServices = []string{"ec2", "route53", "s3", "sts", "cloudwatch", "events", "sns"}
+
+var (
+	// ec2Limiter paces EC2 Describe and Attach calls.
+	ec2Limiter = &rateLimiter{}
+	// throttles is the number of throttled AWS calls in the current run.
+	throttles int
+)
+
+// newAWSSession returns an AWS session, which retries calls with jittered
+// backoff, gives up on calls not completed within --aws-timeout and paces EC2
+// Describe and Attach calls to --aws-rate-limit. Credentials come from
+// --aws-profile if set, or the default credential chain otherwise. The
+// metadata client must have been created before.
+func newAWSSession() (*session.Session, error) {
+	// Seed jitter, so that instances do not retry in lockstep.
+	rand.Seed(time.Now().UnixNano())
+	cfg := aws.NewConfig()
+	if opts.awsProfile != "" {
+		cfg.WithCredentials(credentials.NewSharedCredentials("", opts.awsProfile))
+	} else {
+		// The default credential chain, with instance role credentials read
+		// using IMDSv2.
+		cfg.WithCredentials(credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvProvider{},
+			&credentials.SharedCredentialsProvider{},
+			&metadataRoleProvider{},
+		}))
+	}
+	if opts.awsCABundle != "" {
+		c, err := newHTTPClient(opts.awsCABundle)
+		if err != nil {
+			return nil, err
+		}
+		cfg.WithHTTPClient(c)
+	}
+	s := session.New(request.WithRetryer(cfg, throttleRetryer{}))
+	s.Handlers.Send.PushFrontNamed(rateLimitHandler)
+	s.Handlers.Send.PushFrontNamed(deadlineHandler)
+	s.Handlers.Retry.PushBackNamed(throttleLogHandler)
+	s.Handlers.AfterRetry.PushBackNamed(deadlineRetryHandler)
+	return s, nil
+}
+
+// newHTTPClient returns an HTTP client trusting certificate authorities in
+// PEM file caBundle.
+func newHTTPClient(caBundle string) (*http.Client, error) {
+	data, err := ioutil.ReadFile(caBundle)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %q", caBundle)
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSClientConfig:     &tls.Config{RootCAs: pool},
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}, nil
+}
+
+// assumeRole makes session s assume --aws-role-arn, if set. The role session
+// is named after instance id, so that calls can be traced back to the
+// instance. STS is called in region if --aws-sts-regional-endpoint is set.
+func assumeRole(s *session.Session, id, region string) {
+	if opts.awsRoleARN == "" {
+		return
+	}
+	stsc := sts.New(s, awsConfig("sts", region))
+	s.Config.Credentials = stscreds.NewCredentialsWithClient(stsc, opts.awsRoleARN, func(p *stscreds.AssumeRoleProvider) {
+		p.RoleSessionName = "smilodon-" + id
+		if opts.awsExternalID != "" {
+			p.ExternalID = aws.String(opts.awsExternalID)
+		}
+	})
+}
+
+// awsConfig returns the config of a client of service in region. It sets the
+// endpoint of the service given by --aws-endpoints.
+func awsConfig(service, region string) *aws.Config {
+	cfg := aws.NewConfig().WithRegion(region)
+	if e := awsEndpoints[service]; e != "" {
+		cfg.WithEndpoint(e)
+		// Custom S3 endpoints, such as LocalStack, rarely support virtual
+		// hosted buckets.
+		if service == "s3" {
+			cfg.WithS3ForcePathStyle(true)
+		}
+	} else if service == "sts" && opts.awsSTSRegional {
+		cfg.WithEndpoint("https://sts." + region + ".amazonaws.com")
+	}
+	return cfg
+}
+
+// parseEndpoints parses a comma separated list of service=url endpoints.
+func parseEndpoints(s string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, e := range strings.Split(s, ",") {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("expected service=url, got %q", e)
+		}
+		if !containsString(awsServices, kv[0]) {
+			return nil, fmt.Errorf("unknown service %q, expected one of %s", kv[0], strings.Join(awsServices, ", "))
+		}
+		m[kv[0]] = kv[1]
+	}
+	return m, nil
+}
+
+// throttleRetryer retries throttled calls with exponential backoff and full
+// jitter, so that many instances throttled at the same time spread their
+// retries out. Other errors are retried like by the default retryer.
+type throttleRetryer struct {
+	client.DefaultRetryer
+}
+
+// Backoff bounds of throttled calls.
+const (
+	throttleBaseDelay = 500 * time.Millisecond
+	throttleMaxDelay  = 30 * time.Second
+)
+
+func (r throttleRetryer) MaxRetries() int {
+	return opts.awsMaxRetries
+}
+
+func (r throttleRetryer) RetryRules(req *request.Request) time.Duration {
+	var d time.Duration
+	if req.IsErrorThrottle() {
+		max := throttleMaxDelay
+		if req.RetryCount < 16 && throttleBaseDelay<<uint(req.RetryCount) < max {
+			max = throttleBaseDelay << uint(req.RetryCount)
+		}
+		d = time.Duration(rand.Int63n(int64(max)))
+	} else {
+		d = r.DefaultRetryer.RetryRules(req)
+	}
+	// Do not sleep past the deadline of the call.
+	if left := callDeadline(req).Sub(time.Now()); opts.awsTimeout > 0 && d > left {
+		d = left
+	}
+	return d
+}
+
+// callDeadline returns the time by which call req must complete, retries
+// included.
+func callDeadline(req *request.Request) time.Time {
+	return req.Time.Add(opts.awsTimeout)
+}
+
+// deadlineHandler cancels an attempt still in flight when the deadline of the
+// call passes.
+var deadlineHandler = request.NamedHandler{Name: "smilodon.DeadlineHandler", Fn: func(r *request.Request) {
+	if opts.awsTimeout <= 0 {
+		return
+	}
+	cancel := make(chan struct{})
+	time.AfterFunc(callDeadline(r).Sub(time.Now()), func() { close(cancel) })
+	r.HTTPRequest.Cancel = cancel
+}}
+
+// deadlineRetryHandler fails a call, which would be retried past its deadline.
+var deadlineRetryHandler = request.NamedHandler{Name: "smilodon.DeadlineRetryHandler", Fn: func(r *request.Request) {
+	if opts.awsTimeout <= 0 || r.Error != nil || time.Now().Before(callDeadline(r)) {
+		return
+	}
+	r.Error = awserr.New("RequestDeadlineExceeded", fmt.Sprintf("%s %s did not complete within %v", r.ClientInfo.ServiceName, r.Operation.Name, opts.awsTimeout), nil)
+}}
+
+// rateLimitHandler paces EC2 Describe and Attach calls, which share EC2 API
+// rate limits with every other instance in the account.
+var rateLimitHandler = request.NamedHandler{Name: "smilodon.RateLimitHandler", Fn: func(r *request.Request) {
+	if r.ClientInfo.ServiceName != "ec2" {
+		return
+	}
+	if !strings.HasPrefix(r.Operation.Name, "Describe") && !strings.HasPrefix(r.Operation.Name, "Attach") {
+		return
+	}
+	if d := ec2Limiter.wait(opts.awsRateLimit); d > 0 {
+		logger.Debug("Delayed call to stay within the rate limit", "operation", r.Operation.Name, "delay", d)
+	}
+}}
+
+// throttleLogHandler logs and counts throttled calls.
+var throttleLogHandler = request.NamedHandler{Name: "smilodon.ThrottleLogHandler", Fn: func(r *request.Request) {
+	if !r.IsErrorThrottle() {
+		return
+	}
+	throttles++
+	logger.Warn("Throttled", "service", r.ClientInfo.ServiceName, "operation", r.Operation.Name, "attempt", r.RetryCount+1, "max_attempts", r.MaxRetries()+1)
+}}
+
+// rateLimiter spaces calls out evenly.
+type rateLimiter struct {
+	mu   sync.Mutex
+	next time.Time
+}
+
+// wait blocks until the next call may be made at rate calls per second and
+// returns how long it waited. A rate of 0 does not limit calls.
+func (l *rateLimiter) wait(rate float64) time.Duration {
+	if rate <= 0 {
+		return 0
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	d := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(float64(time.Second) / rate))
+	l.mu.Unlock()
+	time.Sleep(d)
+	return d
+}
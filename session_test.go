@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+func TestThrottleRetryer(t *testing.T) {
+	saved := opts
+	defer func() { opts = saved }()
+	opts.awsMaxRetries = 7
+	opts.awsTimeout = time.Minute
+
+	r := throttleRetryer{}
+	if n := r.MaxRetries(); n != 7 {
+		t.Errorf("got %d retries, want 7", n)
+	}
+	tests := []struct {
+		name       string
+		err        error
+		retryCount int
+		// started is how long ago the call started.
+		started  time.Duration
+		min, max time.Duration
+	}{
+		{"first throttled retry", awserr.New("Throttling", "Rate exceeded", nil), 0, 0, 0, throttleBaseDelay},
+		{"fourth throttled retry", awserr.New("RequestLimitExceeded", "Request limit exceeded", nil), 3, 0, 0, 8 * throttleBaseDelay},
+		{"throttled retry at the cap", awserr.New("Throttling", "Rate exceeded", nil), 20, 0, 0, throttleMaxDelay},
+		// Other errors back off like with the default retryer.
+		{"other error", awserr.New("InternalError", "", nil), 2, 0, 4 * 30 * time.Millisecond, 4 * 60 * time.Millisecond},
+		// No retry sleeps past the deadline of the call.
+		{"close to the deadline", awserr.New("Throttling", "Rate exceeded", nil), 20, 59 * time.Second, 0, time.Second},
+	}
+	for _, tt := range tests {
+		req := &request.Request{
+			Error:        tt.err,
+			RetryCount:   tt.retryCount,
+			Time:         time.Now().Add(-tt.started),
+			HTTPResponse: &http.Response{StatusCode: 400},
+		}
+		var jittered bool
+		for n := 0; n < 100; n++ {
+			d := r.RetryRules(req)
+			if d < tt.min || d > tt.max {
+				t.Errorf("%s: got delay %v, want between %v and %v", tt.name, d, tt.min, tt.max)
+				break
+			}
+			if d != r.RetryRules(req) {
+				jittered = true
+			}
+		}
+		if !jittered {
+			t.Errorf("%s: delays are not jittered", tt.name)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	var l rateLimiter
+	if d := l.wait(0); d != 0 {
+		t.Errorf("got a delay of %v without a rate limit", d)
+	}
+	// At 50 calls per second, calls made straight after each other are 20ms
+	// apart.
+	start := time.Now()
+	var delays []time.Duration
+	for n := 0; n < 3; n++ {
+		delays = append(delays, l.wait(50))
+	}
+	if delays[0] != 0 {
+		t.Errorf("got a delay of %v of the first call, want none", delays[0])
+	}
+	for n := 1; n < len(delays); n++ {
+		if delays[n] <= 10*time.Millisecond || delays[n] > 20*time.Millisecond {
+			t.Errorf("got a delay of %v of call %d, want about 20ms", delays[n], n+1)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("3 calls took %v, want at least 40ms", elapsed)
+	}
+	// A limiter idle for longer than the interval does not delay.
+	time.Sleep(30 * time.Millisecond)
+	if d := l.wait(50); d != 0 {
+		t.Errorf("got a delay of %v after being idle, want none", d)
+	}
+}
+
+func TestDeadlineHandler(t *testing.T) {
+	saved := opts
+	defer func() { opts = saved }()
+
+	opts.awsTimeout = 0
+	r := &request.Request{Time: time.Now(), HTTPRequest: &http.Request{}}
+	deadlineHandler.Fn(r)
+	if r.HTTPRequest.Cancel != nil {
+		t.Error("a call without a timeout can be cancelled")
+	}
+
+	opts.awsTimeout = 20 * time.Millisecond
+	r = &request.Request{Time: time.Now(), HTTPRequest: &http.Request{}}
+	deadlineHandler.Fn(r)
+	select {
+	case <-r.HTTPRequest.Cancel:
+	case <-time.After(time.Second):
+		t.Error("the call has not been cancelled at its deadline")
+	}
+}
+
+func TestDeadlineRetryHandler(t *testing.T) {
+	saved := opts
+	defer func() { opts = saved }()
+	opts.awsTimeout = time.Minute
+
+	tests := []struct {
+		name    string
+		started time.Duration
+		err     error
+		want    string
+	}{
+		{"within the deadline", time.Second, nil, ""},
+		{"past the deadline", 2 * time.Minute, nil, "RequestDeadlineExceeded"},
+		{"failed already", 2 * time.Minute, awserr.New("Throttling", "", nil), "Throttling"},
+	}
+	for _, tt := range tests {
+		r := &request.Request{Time: time.Now().Add(-tt.started), Error: tt.err, Operation: &request.Operation{Name: "DescribeVolumes"}}
+		r.ClientInfo.ServiceName = "ec2"
+		deadlineRetryHandler.Fn(r)
+		var got string
+		if aerr, ok := r.Error.(awserr.Error); ok {
+			got = aerr.Code()
+		}
+		if got != tt.want {
+			t.Errorf("%s: got error %v, want %q", tt.name, r.Error, tt.want)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// tagScheduledSnapshot is a snapshot tag holding the NodeID of a scheduled
+// snapshot. Only snapshots with this tag are ever pruned.
+const tagScheduledSnapshot = "smilodon:scheduled-snapshot"
+
+// snapshotRetention is how many of the most recent hourly, daily and weekly
+// snapshots to keep.
+type snapshotRetention struct {
+	hourly, daily, weekly int
+}
+
+// snapshotPeriods return the hourly, daily and weekly period of a time, in
+// the same order as retention counts.
+var snapshotPeriods = []func(time.Time) string{
+	func(t time.Time) string { return t.Format("2006-01-02T15") },
+	func(t time.Time) string { return t.Format("2006-01-02") },
+	func(t time.Time) string {
+		y, w := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", y, w)
+	},
+}
+
+// parseRetention parses a snapshot retention policy, for example
+// "hourly=24,daily=7,weekly=4". It returns nil retention if s is empty, which
+// means snapshots are never pruned.
+func parseRetention(s string) (*snapshotRetention, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var r snapshotRetention
+	for _, item := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("expected <period>=<count> in %q", item)
+		}
+		n, err := strconv.Atoi(parts[1])
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid count in %q", item)
+		}
+		switch parts[0] {
+		case "hourly":
+			r.hourly = n
+		case "daily":
+			r.daily = n
+		case "weekly":
+			r.weekly = n
+		default:
+			return nil, fmt.Errorf("unknown period %q", parts[0])
+		}
+	}
+	return &r, nil
+}
+
+// snapshotIfDue takes a snapshot of the volume attached to instance i, if the
+// snapshot schedule says one is due, then prunes old snapshots. The schedule
+// is only checked on every run, so snapshots may be taken a little late.
+func snapshotIfDue(i *instance) {
+	if snapshotSchedule == nil || i.volume == nil || i.nodeID == "" {
+		return
+	}
+	now := time.Now().UTC()
+	if nextSnapshot.IsZero() {
+		nextSnapshot = snapshotSchedule.next(now)
+		logger.Info("Scheduled next snapshot", "at", nextSnapshot.Format(time.RFC3339))
+		return
+	}
+	if now.Before(nextSnapshot) {
+		return
+	}
+	nextSnapshot = snapshotSchedule.next(now)
+	// A failed hook or tag call does not undo a snapshot, which has been
+	// created, so old snapshots are pruned all the same.
+	if id, _ := i.snapshot(); id == "" {
+		return
+	}
+	if snapshotRetain != nil {
+		pruneSnapshots(i.nodeID, *snapshotRetain)
+	}
+}
+
+// snapshot takes a snapshot of the volume attached to instance i, tagged with
+// the volume tags. The pre-snapshot hook runs first, for example to freeze
+// the file system, and the post-snapshot hook runs once the snapshot has been
+// started, even if it failed. It returns the ID of the snapshot, if one has
+// been created, even if the post-snapshot hook or tagging it failed.
+func (i *instance) snapshot() (string, error) {
+	env := os.Environ()
+	for _, v := range envVars(*i) {
+		env = append(env, v.key+"="+v.value)
+	}
+	if err := runHook("Pre-snapshot", opts.snapshotPreHook, env); err != nil {
+		return "", err
+	}
+	s, err := ec2c.CreateSnapshot(&ec2.CreateSnapshotInput{
+		VolumeId:    aws.String(i.volume.id),
+		Description: aws.String(fmt.Sprintf("smilodon scheduled snapshot of node ID %s", i.nodeID)),
+	})
+	if hookErr := runHook("Post-snapshot", opts.snapshotPostHook, env); err == nil {
+		err = hookErr
+	}
+	if s == nil || s.SnapshotId == nil {
+		logger.Error("Failed to snapshot volume", "error", err)
+		return "", err
+	}
+	logger.Info("Created snapshot", "snapshot_id", *s.SnapshotId)
+	tags := copyableTags(i.volume.tags)
+	tags[tagScheduledSnapshot] = i.nodeID
+	if tagErr := createTags(*s.SnapshotId, tags); err == nil {
+		err = tagErr
+	}
+	return *s.SnapshotId, err
+}
+
+// runHook runs a shell command cmd with environment env, unless it is empty.
+func runHook(name, cmd string, env []string) error {
+	if cmd == "" {
+		return nil
+	}
+	c := exec.Command("/bin/sh", "-c", cmd)
+	c.Env = env
+	o, err := c.CombinedOutput()
+	if err != nil {
+		logger.Error("Hook failed", "hook", name, "error", err, "output", strings.TrimSpace(string(o)))
+	}
+	return err
+}
+
+// pruneSnapshots deletes scheduled snapshots of NodeID nodeID, which are not
+// kept by retention r.
+func pruneSnapshots(nodeID string, r snapshotRetention) {
+	resp, err := ec2c.DescribeSnapshots(&ec2.DescribeSnapshotsInput{
+		OwnerIds: []*string{aws.String("self")},
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("tag:" + tagScheduledSnapshot),
+				Values: []*string{aws.String(nodeID)},
+			},
+		},
+	})
+	if err != nil {
+		logger.Error("Failed to list snapshots", "node_id", nodeID, "error", err)
+		return
+	}
+	for _, s := range expiredSnapshots(resp.Snapshots, r) {
+		logger.Info("Deleting expired snapshot", "snapshot_id", *s.SnapshotId)
+		if _, err := ec2c.DeleteSnapshot(&ec2.DeleteSnapshotInput{SnapshotId: s.SnapshotId}); err != nil {
+			logger.Error("Failed to delete snapshot", "snapshot_id", *s.SnapshotId, "error", err)
+		}
+	}
+}
+
+// expiredSnapshots returns completed snapshots ss, which are not kept by
+// retention r. For each period, the most recent snapshot of each of the last
+// hourly, daily or weekly periods with a snapshot is kept.
+func expiredSnapshots(ss []*ec2.Snapshot, r snapshotRetention) []*ec2.Snapshot {
+	sorted := make([]*ec2.Snapshot, len(ss))
+	copy(sorted, ss)
+	sort.Sort(byStartTimeDesc(sorted))
+
+	keep := make(map[string]bool)
+	for p, n := range []int{r.hourly, r.daily, r.weekly} {
+		periods := make(map[string]bool)
+		for _, s := range sorted {
+			if len(periods) >= n {
+				break
+			}
+			period := snapshotPeriods[p](s.StartTime.UTC())
+			if !periods[period] {
+				periods[period] = true
+				keep[*s.SnapshotId] = true
+			}
+		}
+	}
+	var expired []*ec2.Snapshot
+	for _, s := range sorted {
+		if !keep[*s.SnapshotId] && aws.StringValue(s.State) == ec2.SnapshotStateCompleted {
+			expired = append(expired, s)
+		}
+	}
+	return expired
+}
+
+type byStartTimeDesc []*ec2.Snapshot
+
+func (s byStartTimeDesc) Len() int           { return len(s) }
+func (s byStartTimeDesc) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byStartTimeDesc) Less(i, j int) bool { return s[i].StartTime.After(*s[j].StartTime) }
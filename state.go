@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+)
+
+// stateVersion is the current version of the state file format.
+const stateVersion = 2
+
+// stateMigrations migrate state of a version, which is the map key, to the
+// next version.
+var stateMigrations = map[int]func(json.RawMessage) (json.RawMessage, error){
+	1: migrateStateV1,
+}
+
+// migrateStateV1 migrates state version 1 to 2, which added last_node_id.
+func migrateStateV1(raw json.RawMessage) (json.RawMessage, error) {
+	var s map[string]interface{}
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, err
+	}
+	s["last_node_id"] = s["node_id"]
+	return json.Marshal(s)
+}
+
+// state is local pairing state, which is persisted, so that it survives
+// smilodon restarts.
+type state struct {
+	InstanceID string `json:"instance_id"`
+	NodeID     string `json:"node_id,omitempty"`
+	// LastNodeID is the NodeID held most recently. Unlike NodeID, it is kept
+	// when a pair is released, so that the same NodeID can be preferred.
+	LastNodeID         string `json:"last_node_id,omitempty"`
+	VolumeID           string `json:"volume_id,omitempty"`
+	NetworkInterfaceID string `json:"network_interface_id,omitempty"`
+	BlockDevice        string `json:"block_device,omitempty"`
+	MountPoint         string `json:"mount_point,omitempty"`
+	Mounted            bool   `json:"mounted"`
+	VolumeAttachTries  int    `json:"volume_attach_tries"`
+}
+
+// stateFile is the on-disk envelope of state. Checksum is a SHA-256 checksum
+// of State and is used to detect corruption.
+type stateFile struct {
+	Version   int             `json:"version"`
+	Checksum  string          `json:"checksum"`
+	UpdatedAt time.Time       `json:"updated_at"`
+	State     json.RawMessage `json:"state"`
+}
+
+// loadState loads state from file f. It returns nil state if the file does
+// not exist. A corrupt file, or one written by a newer smilodon version, is
+// moved aside and nil state is returned.
+func loadState(f string) (*state, error) {
+	data, err := ioutil.ReadFile(f)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s, err := decodeState(data)
+	if err != nil {
+		aside := f + ".corrupt"
+		logger.Warn("State file is unusable, moving it aside", "path", f, "moved_to", aside, "error", err)
+		if err := os.Rename(f, aside); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+	return s, nil
+}
+
+// decodeState verifies, migrates and decodes state file data.
+func decodeState(data []byte) (*state, error) {
+	var sf stateFile
+	if err := json.Unmarshal(data, &sf); err != nil {
+		return nil, err
+	}
+	if sf.Checksum != stateChecksum(sf.State) {
+		return nil, fmt.Errorf("checksum mismatch")
+	}
+	if sf.Version > stateVersion {
+		return nil, fmt.Errorf("unsupported state version %d", sf.Version)
+	}
+	raw := sf.State
+	for v := sf.Version; v < stateVersion; v++ {
+		migrate, ok := stateMigrations[v]
+		if !ok {
+			return nil, fmt.Errorf("no migration from state version %d", v)
+		}
+		var err error
+		if raw, err = migrate(raw); err != nil {
+			return nil, fmt.Errorf("failed to migrate state version %d: %v", v, err)
+		}
+		logger.Info("Migrated state", "from_version", v, "to_version", v+1)
+	}
+	var s state
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// saveState atomically writes state s to file f.
+func saveState(f string, s state) error {
+	raw, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(stateFile{
+		Version:   stateVersion,
+		Checksum:  stateChecksum(raw),
+		UpdatedAt: time.Now().UTC(),
+		State:     raw,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(f), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(f, append(data, '\n'), 0600)
+}
+
+// stateChecksum returns a hex encoded SHA-256 checksum of raw state. The state
+// is compacted first, as it gets indented when written to the state file.
+func stateChecksum(raw json.RawMessage) string {
+	var b bytes.Buffer
+	if err := json.Compact(&b, raw); err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(b.Bytes())
+	return hex.EncodeToString(sum[:])
+}
+
+// newState returns state of instance i.
+func newState(i instance) state {
+	s := state{
+		InstanceID:        i.id,
+		NodeID:            i.nodeID,
+		VolumeAttachTries: volumeAttachTries,
+	}
+	if i.nodeID != "" {
+		s.LastNodeID = i.nodeID
+	} else if lastState != nil {
+		s.LastNodeID = lastState.LastNodeID
+	}
+	if i.volume != nil {
+		s.VolumeID = i.volume.id
+		s.BlockDevice = opts.blockDevice
+		if opts.mountFs {
+			s.MountPoint = opts.mountPoint
+			s.Mounted = isMountPoint(opts.mountPoint)
+		}
+	}
+	if i.networkInterface != nil {
+		s.NetworkInterfaceID = i.networkInterface.id
+	}
+	return s
+}
+
+// persistState saves state of instance i to the state file, unless it has not
+// changed since it was last saved.
+func persistState(i instance) {
+	if opts.stateFile == "" {
+		return
+	}
+	s := newState(i)
+	if lastState != nil && *lastState == s {
+		return
+	}
+	if err := saveState(opts.stateFile, s); err != nil {
+		logger.Error("Failed to write state file", "path", opts.stateFile, "error", err)
+		return
+	}
+	lastState = &s
+}
+
+// restoreState restores volume attach tries and the IDs of resources, which
+// instance i owned before a restart. The IDs are only preferred when
+// reconciling against AWS, they are never trusted on their own.
+func restoreState(i *instance) {
+	if opts.stateFile == "" {
+		return
+	}
+	s, err := loadState(opts.stateFile)
+	if err != nil {
+		logger.Error("Failed to read state file", "path", opts.stateFile, "error", err)
+		return
+	}
+	if s == nil {
+		return
+	}
+	if s.InstanceID != i.id {
+		logger.Warn("Ignoring state file of another instance", "path", opts.stateFile, "state_instance_id", s.InstanceID)
+		return
+	}
+	logger.Info("Restored state", "node_id", s.NodeID, "last_node_id", s.LastNodeID, "volume_id", s.VolumeID, "eni_id", s.NetworkInterfaceID)
+	volumeAttachTries = s.VolumeAttachTries
+	lastState = s
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// encodeStateFile returns a state file of version holding raw state. An empty
+// checksum is replaced by the checksum of raw.
+func encodeStateFile(version int, raw, checksum string) []byte {
+	if checksum == "" {
+		checksum = stateChecksum(json.RawMessage(raw))
+	}
+	data, err := json.Marshal(stateFile{Version: version, Checksum: checksum, State: json.RawMessage(raw)})
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+func TestDecodeState(t *testing.T) {
+	current := `{"instance_id":"i-1234","node_id":"1","last_node_id":"1","volume_id":"vol-1","mounted":true,"volume_attach_tries":2}`
+	valid := encodeStateFile(stateVersion, current, "")
+	tests := []struct {
+		name string
+		data []byte
+		want *state
+	}{
+		{
+			"current version",
+			valid,
+			&state{InstanceID: "i-1234", NodeID: "1", LastNodeID: "1", VolumeID: "vol-1", Mounted: true, VolumeAttachTries: 2},
+		},
+		{
+			"version 1 without last NodeID",
+			encodeStateFile(1, `{"instance_id":"i-1234","node_id":"3","network_interface_id":"eni-3"}`, ""),
+			&state{InstanceID: "i-1234", NodeID: "3", LastNodeID: "3", NetworkInterfaceID: "eni-3"},
+		},
+		{
+			"version 1 of an unpaired instance",
+			encodeStateFile(1, `{"instance_id":"i-1234"}`, ""),
+			&state{InstanceID: "i-1234"},
+		},
+		{"checksum mismatch", encodeStateFile(stateVersion, current, stateChecksum(json.RawMessage(`{}`))), nil},
+		{"truncated", valid[:len(valid)/2], nil},
+		{"empty", nil, nil},
+		{"not JSON", []byte("node_id=1\n"), nil},
+		{"newer version", encodeStateFile(stateVersion+1, current, ""), nil},
+		{"unknown version", encodeStateFile(0, current, ""), nil},
+		{"invalid state", encodeStateFile(stateVersion, `{"instance_id":1}`, ""), nil},
+		{"invalid state to migrate", encodeStateFile(1, `[]`, ""), nil},
+	}
+	for _, tt := range tests {
+		got, err := decodeState(tt.data)
+		if (err != nil) != (tt.want == nil) {
+			t.Errorf("%s: got error %v, want error %v", tt.name, err, tt.want == nil)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLoadState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smilodon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f := filepath.Join(dir, "state.json")
+
+	if s, err := loadState(f); s != nil || err != nil {
+		t.Errorf("loadState of a missing file = %+v, %v, want nil state", s, err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"truncated", encodeStateFile(stateVersion, `{"instance_id":"i-1234"}`, "")[:20]},
+		{"corrupt", encodeStateFile(stateVersion, `{"instance_id":"i-1234"}`, "0000")},
+	}
+	for _, tt := range tests {
+		if err := ioutil.WriteFile(f, tt.data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		s, err := loadState(f)
+		if s != nil || err != nil {
+			t.Errorf("%s: loadState = %+v, %v, want nil state", tt.name, s, err)
+		}
+		// The unusable file is kept for inspection, but out of the way.
+		if _, err := os.Stat(f); !os.IsNotExist(err) {
+			t.Errorf("%s: state file has not been moved aside: %v", tt.name, err)
+		}
+		if data, err := ioutil.ReadFile(f + ".corrupt"); err != nil || string(data) != string(tt.data) {
+			t.Errorf("%s: got %q, %v moved aside, want %q", tt.name, data, err, tt.data)
+		}
+	}
+}
+
+func TestSaveState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smilodon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f := filepath.Join(dir, "lib/smilodon/state.json")
+
+	states := []state{
+		{InstanceID: "i-1234", NodeID: "1", LastNodeID: "1", VolumeID: "vol-1", BlockDevice: "/dev/xvdf", MountPoint: "/data", Mounted: true},
+		// Overwriting replaces the previous state entirely.
+		{InstanceID: "i-1234", LastNodeID: "1", VolumeAttachTries: 1},
+	}
+	for _, want := range states {
+		if err := saveState(f, want); err != nil {
+			t.Fatalf("saveState: %v", err)
+		}
+		got, err := loadState(f)
+		if err != nil || got == nil {
+			t.Fatalf("loadState = %+v, %v", got, err)
+		}
+		if !reflect.DeepEqual(*got, want) {
+			t.Errorf("got %+v, want %+v", *got, want)
+		}
+	}
+
+	fi, err := os.Stat(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("got state file mode %v, want 0600", fi.Mode())
+	}
+	// Nothing but the state file is left behind by the atomic writes.
+	files, _ := ioutil.ReadDir(filepath.Dir(f))
+	if len(files) != 1 {
+		var names []string
+		for _, fi := range files {
+			names = append(names, fi.Name())
+		}
+		t.Errorf("got files %v next to the state file, want only the state file", names)
+	}
+
+	// A write which cannot replace its target leaves nothing behind either.
+	target := filepath.Join(filepath.Dir(f), "dir")
+	if err := os.MkdirAll(filepath.Join(target, "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveState(target, states[0]); err == nil {
+		t.Error("saveState replaced a directory")
+	}
+	if files, _ := ioutil.ReadDir(filepath.Dir(f)); len(files) != 2 {
+		t.Errorf("got %d files after a failed write, want the state file and the directory", len(files))
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// Volume tags holding timestamps used by the least-recently-used selection
+// strategy.
+const (
+	tagAttachedAt = "smilodon:attached-at"
+	tagDetachedAt = "smilodon:detached-at"
+)
+
+// selectionStrategy orders available volumes, so that instances booting at
+// the same time do not all race for the same NodeID.
+type selectionStrategy interface {
+	// order returns volumes vs in the order they should be tried. Network
+	// interfaces ns are all network interfaces found.
+	order(vs []volume, ns []networkInterface) []volume
+}
+
+// newSelectionStrategy returns a selection strategy by name for instance i.
+func newSelectionStrategy(name string, i instance) (selectionStrategy, error) {
+	switch name {
+	case "api":
+		return apiStrategy{}, nil
+	case "lowest":
+		return lowestStrategy{}, nil
+	case "random":
+		return randomStrategy{seed: seedFromID(i.id)}, nil
+	case "least-recently-used":
+		return lruStrategy{}, nil
+	case "spread":
+		return spreadStrategy{}, nil
+	}
+	return nil, fmt.Errorf("unknown selection strategy %q", name)
+}
+
+// apiStrategy keeps volumes in the order the EC2 API returns them.
+type apiStrategy struct{}
+
+func (apiStrategy) order(vs []volume, ns []networkInterface) []volume {
+	return vs
+}
+
+// lowestStrategy orders volumes by NodeID, lowest first.
+type lowestStrategy struct{}
+
+func (lowestStrategy) order(vs []volume, ns []networkInterface) []volume {
+	sorted := make([]volume, len(vs))
+	copy(sorted, vs)
+	sort.Stable(byVolumeNodeID(sorted))
+	return sorted
+}
+
+// randomStrategy shuffles volumes. The seed is derived from the instance ID,
+// so every instance gets a different, yet reproducible order.
+type randomStrategy struct {
+	seed int64
+}
+
+func (s randomStrategy) order(vs []volume, ns []networkInterface) []volume {
+	sorted := lowestStrategy{}.order(vs, ns)
+	shuffled := make([]volume, len(sorted))
+	for i, j := range rand.New(rand.NewSource(s.seed)).Perm(len(sorted)) {
+		shuffled[i] = sorted[j]
+	}
+	return shuffled
+}
+
+// seedFromID returns a random seed derived from id.
+func seedFromID(id string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	return int64(h.Sum64())
+}
+
+// lruStrategy orders volumes by when they were last used, least recently
+// used first. A volume was last used when it was detached, or if smilodon did
+// not get to record that, for example because the instance was terminated,
+// when it was attached. Volumes never used by smilodon come first.
+type lruStrategy struct{}
+
+func (lruStrategy) order(vs []volume, ns []networkInterface) []volume {
+	sorted := lowestStrategy{}.order(vs, ns)
+	sort.Stable(volumesBy{sorted, func(a, b volume) bool {
+		return lastUsed(a).Before(lastUsed(b))
+	}})
+	return sorted
+}
+
+// lastUsed returns when volume v was last used according to its tags.
+func lastUsed(v volume) time.Time {
+	var t time.Time
+	for _, key := range []string{tagAttachedAt, tagDetachedAt, tagHeartbeatAt} {
+		if ts, err := time.Parse(time.RFC3339, v.tags[key]); err == nil && ts.After(t) {
+			t = ts
+		}
+	}
+	return t
+}
+
+// spreadStrategy orders volumes by how many network interfaces are already
+// attached in the subnet of their matching network interface, fewest first,
+// so that NodeIDs spread across subnets. Volumes without an available matching
+// network interface come last.
+type spreadStrategy struct{}
+
+func (spreadStrategy) order(vs []volume, ns []networkInterface) []volume {
+	attached := make(map[string]int)
+	subnets := make(map[string]string)
+	for _, n := range ns {
+		if !n.available {
+			attached[n.subnetID]++
+		} else {
+			subnets[n.nodeID] = n.subnetID
+		}
+	}
+	load := func(v volume) int {
+		subnet, ok := subnets[v.nodeID]
+		if !ok {
+			return len(ns) + 1
+		}
+		return attached[subnet]
+	}
+	sorted := lowestStrategy{}.order(vs, ns)
+	sort.Stable(volumesBy{sorted, func(a, b volume) bool {
+		return load(a) < load(b)
+	}})
+	return sorted
+}
+
+type byVolumeNodeID []volume
+
+func (v byVolumeNodeID) Len() int           { return len(v) }
+func (v byVolumeNodeID) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
+func (v byVolumeNodeID) Less(i, j int) bool { return nodeIDLess(v[i].nodeID, v[j].nodeID) }
+
+// volumesBy sorts volumes using a less function.
+type volumesBy struct {
+	vs   []volume
+	less func(a, b volume) bool
+}
+
+func (v volumesBy) Len() int           { return len(v.vs) }
+func (v volumesBy) Swap(i, j int)      { v.vs[i], v.vs[j] = v.vs[j], v.vs[i] }
+func (v volumesBy) Less(i, j int) bool { return v.less(v.vs[i], v.vs[j]) }
+
+// tagVolumeTimestamp tags volume id with the current time under key.
+func tagVolumeTimestamp(id, key string, ec2c ec2Client) error {
+	_, err := ec2c.CreateTags(&ec2.CreateTagsInput{
+		Resources: []*string{aws.String(id)},
+		Tags: []*ec2.Tag{
+			{
+				Key:   aws.String(key),
+				Value: aws.String(time.Now().UTC().Format(time.RFC3339)),
+			},
+		},
+	})
+	if err != nil {
+		logger.Error("Failed to tag volume", "volume_id", id, "tag", key, "error", err)
+	}
+	return err
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// volumeNodeIDs returns NodeIDs of volumes vs in order.
+func volumeNodeIDs(vs []volume) []string {
+	ids := make([]string, 0, len(vs))
+	for _, v := range vs {
+		ids = append(ids, v.nodeID)
+	}
+	return ids
+}
+
+// volumesWithNodeIDs returns available volumes with NodeIDs ids in order.
+func volumesWithNodeIDs(ids ...string) []volume {
+	vs := make([]volume, 0, len(ids))
+	for _, id := range ids {
+		vs = append(vs, volume{id: "vol-" + id, nodeID: id, available: true})
+	}
+	return vs
+}
+
+func TestNodeIDLess(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"2", "10", true},
+		{"10", "2", false},
+		{"1", "1", false},
+		{"9", "a", true},
+		{"a", "9", false},
+		{"a", "b", true},
+		{"node-10", "node-2", true},
+	}
+	for _, tt := range tests {
+		if got := nodeIDLess(tt.a, tt.b); got != tt.want {
+			t.Errorf("nodeIDLess(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestLowestStrategy(t *testing.T) {
+	tests := []struct {
+		name string
+		ids  []string
+		want []string
+	}{
+		{"empty", nil, []string{}},
+		{"numeric", []string{"10", "2", "1"}, []string{"1", "2", "10"}},
+		{"mixed", []string{"b", "3", "a", "20"}, []string{"3", "20", "a", "b"}},
+	}
+	for _, tt := range tests {
+		vs := volumesWithNodeIDs(tt.ids...)
+		got := volumeNodeIDs(lowestStrategy{}.order(vs, nil))
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+		if !reflect.DeepEqual(volumeNodeIDs(vs), volumeNodeIDs(volumesWithNodeIDs(tt.ids...))) {
+			t.Errorf("%s: the input was reordered", tt.name)
+		}
+	}
+}
+
+func TestRandomStrategy(t *testing.T) {
+	ids := []string{"1", "2", "3", "4", "5", "6", "7", "8"}
+	reversed := []string{"8", "7", "6", "5", "4", "3", "2", "1"}
+	order := func(instanceID string, ids []string) []string {
+		s, err := newSelectionStrategy("random", instance{id: instanceID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return volumeNodeIDs(s.order(volumesWithNodeIDs(ids...), nil))
+	}
+
+	a := order("i-0123456789abcdef0", ids)
+	if !reflect.DeepEqual(volumeNodeIDs(lowestStrategy{}.order(volumesWithNodeIDs(a...), nil)), ids) {
+		t.Fatalf("got %v, want a permutation of %v", a, ids)
+	}
+	// The order only depends on the instance ID, not on the API order.
+	if b := order("i-0123456789abcdef0", reversed); !reflect.DeepEqual(a, b) {
+		t.Errorf("got %v and %v for the same instance ID", a, b)
+	}
+	if c := order("i-0fedcba9876543210", ids); reflect.DeepEqual(a, c) {
+		t.Errorf("got the same order %v for different instance IDs", a)
+	}
+	if seedFromID("i-0123456789abcdef0") != seedFromID("i-0123456789abcdef0") {
+		t.Error("seedFromID is not stable")
+	}
+}
+
+func TestLRUStrategy(t *testing.T) {
+	tagged := func(id string, tags map[string]string) volume {
+		return volume{id: "vol-" + id, nodeID: id, available: true, tags: tags}
+	}
+	tests := []struct {
+		name string
+		vs   []volume
+		want []string
+	}{
+		{
+			"never used first, ties by node ID",
+			[]volume{
+				tagged("3", map[string]string{tagDetachedAt: "2016-06-01T10:00:00Z"}),
+				tagged("2", nil),
+				tagged("1", nil),
+			},
+			[]string{"1", "2", "3"},
+		},
+		{
+			"detached timestamps",
+			[]volume{
+				tagged("1", map[string]string{tagDetachedAt: "2016-06-03T10:00:00Z"}),
+				tagged("2", map[string]string{tagDetachedAt: "2016-06-01T10:00:00Z"}),
+				tagged("3", map[string]string{tagDetachedAt: "2016-06-02T10:00:00Z"}),
+			},
+			[]string{"2", "3", "1"},
+		},
+		{
+			"latest of attached, detached and heartbeat timestamps",
+			[]volume{
+				tagged("1", map[string]string{tagAttachedAt: "2016-06-01T10:00:00Z", tagHeartbeatAt: "2016-06-05T10:00:00Z"}),
+				tagged("2", map[string]string{tagAttachedAt: "2016-06-04T10:00:00Z"}),
+				tagged("3", map[string]string{tagAttachedAt: "2016-06-01T10:00:00Z", tagDetachedAt: "2016-06-02T10:00:00Z"}),
+			},
+			[]string{"3", "2", "1"},
+		},
+		{
+			"invalid timestamps count as never used",
+			[]volume{
+				tagged("1", map[string]string{tagDetachedAt: "2016-06-01T10:00:00Z"}),
+				tagged("2", map[string]string{tagDetachedAt: "yesterday"}),
+			},
+			[]string{"2", "1"},
+		},
+	}
+	for _, tt := range tests {
+		got := volumeNodeIDs(lruStrategy{}.order(tt.vs, nil))
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSpreadStrategy(t *testing.T) {
+	eni := func(nodeID, subnetID string, available bool) networkInterface {
+		return networkInterface{id: "eni-" + nodeID, nodeID: nodeID, subnetID: subnetID, available: available}
+	}
+	tests := []struct {
+		name string
+		ids  []string
+		ns   []networkInterface
+		want []string
+	}{
+		{
+			"fewest attached in subnet first",
+			[]string{"4", "5", "6"},
+			[]networkInterface{
+				eni("1", "subnet-a", false),
+				eni("2", "subnet-a", false),
+				eni("3", "subnet-b", false),
+				eni("4", "subnet-a", true),
+				eni("5", "subnet-b", true),
+				eni("6", "subnet-c", true),
+			},
+			[]string{"6", "5", "4"},
+		},
+		{
+			"ties by node ID",
+			[]string{"12", "11", "10"},
+			[]networkInterface{
+				eni("10", "subnet-a", true),
+				eni("11", "subnet-b", true),
+				eni("12", "subnet-a", true),
+			},
+			[]string{"10", "11", "12"},
+		},
+		{
+			"without an available network interface last",
+			[]string{"1", "2", "3"},
+			[]networkInterface{
+				eni("1", "subnet-a", false),
+				eni("3", "subnet-a", true),
+				eni("4", "subnet-b", false),
+			},
+			[]string{"3", "1", "2"},
+		},
+	}
+	for _, tt := range tests {
+		got := volumeNodeIDs(spreadStrategy{}.order(volumesWithNodeIDs(tt.ids...), tt.ns))
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNewSelectionStrategy(t *testing.T) {
+	for _, name := range []string{"api", "lowest", "random", "least-recently-used", "spread"} {
+		if _, err := newSelectionStrategy(name, instance{id: "i-1"}); err != nil {
+			t.Errorf("newSelectionStrategy(%q): %v", name, err)
+		}
+	}
+	if _, err := newSelectionStrategy("fastest", instance{id: "i-1"}); err == nil {
+		t.Error("newSelectionStrategy accepted an unknown strategy")
+	}
+}
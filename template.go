@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// templateFile is a text/template source file and the destination path it is
+// rendered to.
+type templateFile struct {
+	src  string
+	dest string
+}
+
+// templateData is the data passed to templates when rendering.
+type templateData struct {
+	NodeID             string
+	NodeIP             string
+	NodeIPv6           string
+	VolumeID           string
+	NetworkInterfaceID string
+	InstanceID         string
+	Region             string
+	AvailabilityZone   string
+	VpcID              string
+	// Env holds all variables written to environment files.
+	Env map[string]string
+	// Peers holds all NodeIDs and their IP addresses, sorted by NodeID.
+	Peers []templatePeer
+}
+
+// templatePeer is a NodeID to IP address mapping of a network interface.
+type templatePeer struct {
+	NodeID string
+	IP     string
+	// Local is true when the peer is this instance.
+	Local bool
+}
+
+// parseTemplates parses a comma-delimited list of templates, where each item
+// is a source and destination path separated by a colon.
+func parseTemplates(s string) ([]templateFile, error) {
+	var ts []templateFile
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.Split(item, ":")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("template %q must be in the form of <source>:<destination>", item)
+		}
+		ts = append(ts, templateFile{src: parts[0], dest: parts[1]})
+	}
+	return ts, nil
+}
+
+// newTemplateData builds template data for instance i and its peers ns. Only
+// paired peers are listed.
+func newTemplateData(i instance, ns []networkInterface) templateData {
+	d := templateData{
+		NodeID:             i.nodeID,
+		NodeIP:             i.networkInterface.IPAddress,
+		NodeIPv6:           firstString(i.networkInterface.ipv6Addresses),
+		VolumeID:           i.volume.id,
+		NetworkInterfaceID: i.networkInterfaceID(),
+		InstanceID:         i.id,
+		Region:             i.region,
+		AvailabilityZone:   i.az,
+		VpcID:              i.vpc,
+		Env:                make(map[string]string),
+	}
+	for _, v := range envVars(i) {
+		d.Env[v.key] = v.value
+	}
+	for _, n := range ns {
+		if n.nodeID == "" || n.available {
+			continue
+		}
+		d.Peers = append(d.Peers, templatePeer{
+			NodeID: n.nodeID,
+			IP:     n.IPAddress,
+			Local:  n.id == i.networkInterface.id,
+		})
+	}
+	sort.Sort(byPeerNodeID(d.Peers))
+	return d
+}
+
+type byPeerNodeID []templatePeer
+
+func (p byPeerNodeID) Len() int           { return len(p) }
+func (p byPeerNodeID) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p byPeerNodeID) Less(i, j int) bool { return nodeIDLess(p[i].NodeID, p[j].NodeID) }
+
+// nodeIDLess reports whether NodeID a sorts before NodeID b. Numeric NodeIDs
+// are compared as numbers, so that "2" sorts before "10".
+func nodeIDLess(a, b string) bool {
+	na, errA := strconv.Atoi(a)
+	nb, errB := strconv.Atoi(b)
+	switch {
+	case errA == nil && errB == nil:
+		return na < nb
+	case errA == nil:
+		return true
+	case errB == nil:
+		return false
+	}
+	return a < b
+}
+
+// reloadPending is set while a failed reload command has to be retried, as
+// the files it should pick up are already rendered.
+var reloadPending bool
+
+// renderTemplates renders all templates ts with data d. A destination file is
+// only written when its content changes. If any file was written and cmd is
+// set, cmd is run afterwards. A failed cmd is retried on the next call, even
+// if no file changes then.
+func renderTemplates(ts []templateFile, d templateData, cmd string) error {
+	var changed bool
+	var err error
+	for _, t := range ts {
+		c, e := renderTemplate(t, d)
+		if e != nil {
+			logger.Error("Failed to render template", "source", t.src, "destination", t.dest, "error", e)
+			err = e
+			continue
+		}
+		if c {
+			logger.Info("Rendered template", "source", t.src, "destination", t.dest)
+			changed = true
+		}
+	}
+	if (changed || reloadPending) && cmd != "" {
+		logger.Info("Running template reload command", "command", cmd)
+		o, e := exec.Command("/bin/sh", "-c", cmd).CombinedOutput()
+		if e != nil {
+			logger.Error("Template reload command failed", "error", e, "output", strings.TrimSpace(string(o)))
+			reloadPending = true
+			return e
+		}
+	}
+	reloadPending = false
+	return err
+}
+
+// renderTemplate renders template t with data d and reports whether the
+// destination file has changed.
+func renderTemplate(t templateFile, d templateData) (bool, error) {
+	tmpl, err := template.New(path.Base(t.src)).Option("missingkey=error").ParseFiles(t.src)
+	if err != nil {
+		return false, err
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, d); err != nil {
+		return false, err
+	}
+	old, err := ioutil.ReadFile(t.dest)
+	if err == nil && bytes.Equal(old, b.Bytes()) {
+		return false, nil
+	}
+	if err := os.MkdirAll(path.Dir(t.dest), 0755); err != nil {
+		return false, err
+	}
+	if err := writeFileAtomic(t.dest, b.Bytes(), 0644); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// stubPeers sets up a fake EC2 API holding NodeIDs 1 to 4 of service etcd,
+// whose network interfaces are spread over two availability zones. NodeID 3
+// is not paired and another service holds NodeID 5.
+func stubPeers() (*fakeEC2, *instance, func()) {
+	savedOpts, savedEC2 := opts, ec2c
+	opts.addressMode = addressModeNetworkInterface
+	opts.filters = "tag:Service=etcd"
+
+	f := newFakeEC2()
+	f.subnets["subnet-a"] = "eu-west-1a"
+	f.subnets["subnet-b"] = "eu-west-1b"
+	f.addENI("eni-1", "subnet-a", "10.0.1.10", map[string]string{"NodeID": "1", "Service": "etcd"})
+	f.addENI("eni-2", "subnet-b", "10.0.2.10", map[string]string{"NodeID": "2", "Service": "etcd"})
+	f.addENI("eni-3", "subnet-b", "10.0.2.11", map[string]string{"NodeID": "3", "Service": "etcd"})
+	f.addENI("eni-10", "subnet-a", "10.0.1.11", map[string]string{"NodeID": "10", "Service": "etcd"})
+	f.addENI("eni-5", "subnet-a", "10.0.1.12", map[string]string{"NodeID": "5", "Service": "zookeeper"})
+	f.attach("eni-1", "i-a")
+	f.attach("eni-2", "i-b")
+	f.attach("eni-10", "i-c")
+	f.attach("eni-5", "i-d")
+	ec2c = f
+
+	i := &instance{id: "i-a", az: "eu-west-1a", vpc: "vpc-1", subnetID: "subnet-a"}
+	return f, i, func() {
+		opts, ec2c = savedOpts, savedEC2
+	}
+}
+
+func TestTemplatePeers(t *testing.T) {
+	_, i, restore := stubPeers()
+	defer restore()
+
+	peers, err := findPeers(i, ec2c)
+	if err != nil {
+		t.Fatalf("findPeers: %v", err)
+	}
+	i.nodeID = "1"
+	i.volume = &volume{id: "vol-1", nodeID: "1"}
+	i.networkInterface = &networkInterface{id: "eni-1", nodeID: "1", IPAddress: "10.0.1.10"}
+	d := newTemplateData(*i, peers)
+	want := []templatePeer{
+		{NodeID: "1", IP: "10.0.1.10", Local: true},
+		{NodeID: "2", IP: "10.0.2.10"},
+		{NodeID: "10", IP: "10.0.1.11"},
+	}
+	if !reflect.DeepEqual(d.Peers, want) {
+		t.Errorf("got peers %+v, want %+v", d.Peers, want)
+	}
+
+	// An instance in the other availability zone sees the same peers.
+	other := &instance{id: "i-b", az: "eu-west-1b", vpc: "vpc-1", subnetID: "subnet-b", nodeID: "2"}
+	otherPeers, err := findPeers(other, ec2c)
+	if err != nil {
+		t.Fatalf("findPeers: %v", err)
+	}
+	other.volume = &volume{id: "vol-2", nodeID: "2"}
+	other.networkInterface = &networkInterface{id: "eni-2", nodeID: "2", IPAddress: "10.0.2.10"}
+	od := newTemplateData(*other, otherPeers)
+	want[0].Local, want[1].Local = false, true
+	if !reflect.DeepEqual(od.Peers, want) {
+		t.Errorf("got peers %+v in eu-west-1b, want %+v", od.Peers, want)
+	}
+}